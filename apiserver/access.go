@@ -0,0 +1,160 @@
+package apiserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/util"
+)
+
+const (
+	// headerRequestID is the request id of the access log, it's generated if the client does not send it
+	headerRequestID = "X-Request-Id"
+	// headerOutcome is set by the responses for the access log, it's removed before the response is sent
+	headerOutcome = "X-Proxy-Outcome"
+
+	maxRequestIDLen = 128
+)
+
+// the outcomes of the access log besides the error codes
+const (
+	outcomeOK      = "ok"
+	outcomeSpooled = "spooled"
+)
+
+// accessWriter records the status, the outcome and the response size,
+// it's in the request context so the identity can be set by the authentication
+type accessWriter struct {
+	statusWriter
+	outcome  string
+	size     int64
+	identity string
+}
+
+type accessKey struct{}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.outcome = w.Header().Get(headerOutcome)
+		w.Header().Del(headerOutcome)
+	}
+	w.statusWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+// countingBody counts the bytes of the request body read by the handler
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// accessLog wrap the handler to set the X-Request-Id response header,
+// and log a entry of the request if enabled
+func accessLog(enabled bool, pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get(headerRequestID)
+		if len(id) == 0 || len(id) > maxRequestIDLen {
+			id = util.RandomID(8)
+		}
+		res.Header().Set(headerRequestID, id)
+
+		body := &countingBody{ReadCloser: req.Body}
+		req.Body = body
+		w := &accessWriter{statusWriter: statusWriter{ResponseWriter: res}}
+		h(w, req.WithContext(context.WithValue(req.Context(), accessKey{}, w)))
+
+		if !enabled {
+			return
+		}
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		outcome := w.outcome
+		if len(outcome) == 0 {
+			outcome = outcomeOK
+			if w.status >= http.StatusBadRequest {
+				outcome = http.StatusText(w.status)
+			}
+		}
+
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		query := req.URL.Query()
+		fields := log.Fields{
+			"type":         "access",
+			"requestId":    id,
+			"clientIp":     clientIP,
+			"method":       req.Method,
+			"route":        pattern,
+			"path":         req.URL.Path,
+			"status":       w.status,
+			"outcome":      outcome,
+			"size":         body.n,
+			"responseSize": w.size,
+			"latencyMs":    time.Since(start),
+		}
+		if len(w.identity) > 0 {
+			fields["identity"] = w.identity
+		}
+		if v := req.Header.Get("X-Forwarded-For"); len(v) > 0 {
+			fields["forwardedFor"] = v
+		}
+		if v := query.Get("exchange"); len(v) > 0 {
+			fields["exchange"] = v
+		}
+		if v := query.Get("routingKey"); len(v) > 0 {
+			fields["routingKey"] = v
+		}
+		if v := query.Get("queue"); len(v) > 0 {
+			fields["queue"] = v
+		}
+		log.Info("access", fields)
+	}
+}
+
+// setOutcome set the outcome of the access log, it must be called before the status written
+func setOutcome(res http.ResponseWriter, outcome string) {
+	res.Header().Set(headerOutcome, outcome)
+}
+
+// logLevel is the handler of /log/level, GET return the level of the logger,
+// PUT or POST /log/level?level=debug change it at runtime
+func logLevel(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := log.ParseLevel(req.URL.Query().Get("level"))
+		if err != nil {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "%s", err))
+			return
+		}
+		log.Warn("log level changed", log.Fields{"from": log.GetLevel(), "to": level})
+		log.SetLevel(level)
+	default:
+		writeError(res, errMethodNotAllowed(res, http.MethodGet, http.MethodPut, http.MethodPost))
+		return
+	}
+	writeJSON(res, http.StatusOK, &envelope{OK: true, Data: map[string]string{"level": log.GetLevel().String()}})
+}
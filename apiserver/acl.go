@@ -0,0 +1,164 @@
+package apiserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+const codeForbidden = "FORBIDDEN"
+
+// resource is the target of a operation, the empty names match the nil patterns only
+type resource struct {
+	exchange   string
+	queue      string
+	routingKey string
+}
+
+func (r resource) String() string {
+	var parts []string
+	if len(r.exchange) > 0 {
+		parts = append(parts, "exchange "+r.exchange)
+	}
+	if len(r.queue) > 0 {
+		parts = append(parts, "queue "+r.queue)
+	}
+	if len(r.routingKey) > 0 {
+		parts = append(parts, "routingKey "+r.routingKey)
+	}
+	return strings.Join(parts, " ")
+}
+
+// aclRule is a compiled config.ACLRule, the nil patterns match all
+type aclRule struct {
+	identity   string
+	allow      bool
+	ops        map[string]bool
+	exchange   []string
+	queue      []string
+	routingKey []string
+}
+
+func compileACL(rules []config.ACLRule) []aclRule {
+	acl := make([]aclRule, len(rules))
+	for i, r := range rules {
+		acl[i] = aclRule{
+			identity:   r.Identity,
+			allow:      r.Action == config.ACLAllow,
+			exchange:   topicWords(r.Exchange),
+			queue:      topicWords(r.Queue),
+			routingKey: topicWords(r.RoutingKey),
+		}
+		if len(r.Operations) > 0 {
+			acl[i].ops = make(map[string]bool, len(r.Operations))
+			for _, op := range r.Operations {
+				acl[i].ops[op] = true
+			}
+		}
+	}
+	return acl
+}
+
+func (r *aclRule) match(name, op string, res resource) bool {
+	if r.identity != "*" && r.identity != name {
+		return false
+	}
+	if r.ops != nil && !r.ops[op] {
+		return false
+	}
+	return matchName(r.exchange, res.exchange) && matchName(r.queue, res.queue) && matchName(r.routingKey, res.routingKey)
+}
+
+// matchName report whether the name matches the pattern, the nil patterns match all,
+// the empty names match the nil patterns only, so the exchange rules don't match the queue operations
+func matchName(pattern []string, name string) bool {
+	if pattern == nil {
+		return true
+	}
+	if len(name) == 0 {
+		return false
+	}
+	return topicMatch(pattern, topicWords(name))
+}
+
+// topicWords split the name or pattern into the dot separated words, nil if it's empty
+func topicWords(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, ".")
+}
+
+// topicMatch match the words by the topic pattern as the amqp topic exchange:
+// * matches exactly one word and # matches zero or more words
+func topicMatch(pattern, words []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			// the trailing # matches the rest
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(words); i++ {
+				if topicMatch(pattern[1:], words[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(words) == 0 {
+				return false
+			}
+		default:
+			if len(words) == 0 || words[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, words = pattern[1:], words[1:]
+	}
+	return len(words) == 0
+}
+
+// admin wrap the handler of the admin route to authorize the admin operation
+func (a *Authenticator) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if err := a.authorize(req, config.OpAdmin, resource{}); err != nil {
+			writeError(res, err)
+			return
+		}
+		h(res, req)
+	}
+}
+
+// authorize check the operation of the request identity on the resource by the acl,
+// the denied requests are logged and counted, and the FORBIDDEN error is returned
+func (a *Authenticator) authorize(req *http.Request, op string, res resource) error {
+	id := identityFrom(req.Context())
+	if a == nil || id == nil {
+		// the auth is disabled or the route is public
+		return nil
+	}
+	acl := a.creds.Load().(*credentials).acl
+	if len(acl) == 0 {
+		return nil
+	}
+	for i := range acl {
+		if acl[i].match(id.name, op, res) {
+			if acl[i].allow {
+				return nil
+			}
+			break
+		}
+	}
+
+	log.Warn("authorization denied", log.Fields{"identity": id.name, "operation": op, "path": req.URL.Path,
+		"exchange": res.exchange, "queue": res.queue, "routingKey": res.routingKey})
+	a.denials.Inc(id.name, op)
+	msg := id.name + " is not allowed to " + op
+	if target := res.String(); len(target) > 0 {
+		msg += " " + target
+	}
+	return newAPIError(http.StatusForbidden, codeForbidden, "%s", msg)
+}
@@ -0,0 +1,152 @@
+package apiserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/metrics"
+)
+
+func TestTopicMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.created", "order.updated", false},
+		{"order.*", "order.created", true},
+		{"order.*", "order", false},
+		{"order.*", "order.created.eu", false},
+		{"order.#", "order", true},
+		{"order.#", "order.created.eu", true},
+		{"#.eu", "order.created.eu", true},
+		{"#.eu", "eu", true},
+		{"#.eu", "order.created.us", false},
+		{"*.created.#", "order.created", true},
+		{"*.created.#", "created", false},
+		{"order.#.eu", "order.eu", true},
+		{"order.#.eu", "order.a.b.eu", true},
+		{"#", "anything.at.all", true},
+		{"*", "orders", true},
+		{"*", "team.orders", false},
+	}
+	for _, c := range cases {
+		if got := topicMatch(topicWords(c.pattern), topicWords(c.name)); got != c.match {
+			t.Errorf("topicMatch(%q, %q) = %v, expected %v", c.pattern, c.name, got, c.match)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled: true,
+		ACL: []config.ACLRule{
+			{Identity: "orders", Action: config.ACLDeny, Operations: []string{config.OpPublish}, Exchange: "orders", RoutingKey: "order.internal.#"},
+			{Identity: "orders", Action: config.ACLAllow, Operations: []string{config.OpPublish}, Exchange: "orders"},
+			{Identity: "orders", Action: config.ACLAllow, Operations: []string{config.OpConsume}, Queue: "orders.*"},
+			{Identity: "*", Action: config.ACLAllow, Operations: []string{config.OpConsume}, Queue: "public"},
+		},
+	}, 1024, metrics.NewRegistry())
+
+	check := func(name, op string, res resource) bool {
+		req := httptest.NewRequest(http.MethodPost, "/confirm_send", nil)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &identity{name: name}))
+		return auth.authorize(req, op, res) == nil
+	}
+
+	if !check("orders", config.OpPublish, resource{exchange: "orders", routingKey: "order.created"}) {
+		t.Fatal("publish to the own exchange denied")
+	}
+	if check("orders", config.OpPublish, resource{exchange: "orders", routingKey: "order.internal.audit"}) {
+		t.Fatal("the deny rule before the allow rule is not applied")
+	}
+	if check("orders", config.OpPublish, resource{exchange: "billing", routingKey: "order.created"}) {
+		t.Fatal("publish to the other exchange allowed")
+	}
+	if check("orders", config.OpTopology, resource{exchange: "orders"}) {
+		t.Fatal("the operation not in any rule allowed")
+	}
+	if !check("orders", config.OpConsume, resource{queue: "orders.eu"}) || !check("billing", config.OpConsume, resource{queue: "public"}) {
+		t.Fatal("consume denied")
+	}
+	if check("billing", config.OpConsume, resource{queue: "orders.eu"}) {
+		t.Fatal("consume the other queue allowed")
+	}
+}
+
+func TestAuthorizeScopedRules(t *testing.T) {
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled: true,
+		ACL: []config.ACLRule{
+			{Identity: "audit", Action: config.ACLDeny, Exchange: "#"},
+			{Identity: "audit", Action: config.ACLAllow, Operations: []string{config.OpConsume}},
+			{Identity: "orders", Action: config.ACLAllow, Exchange: "orders"},
+		},
+	}, 1024, metrics.NewRegistry())
+
+	check := func(name, op string, res resource) bool {
+		req := httptest.NewRequest(http.MethodPost, "/get", nil)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &identity{name: name}))
+		return auth.authorize(req, op, res) == nil
+	}
+
+	// the exchange rules don't match the queue only resources
+	if check("orders", config.OpConsume, resource{queue: "billing"}) {
+		t.Fatal("the exchange allow rule matches the queue")
+	}
+	if !check("orders", config.OpPublish, resource{exchange: "orders", routingKey: "order.created"}) {
+		t.Fatal("publish to the own exchange denied")
+	}
+	if !check("audit", config.OpConsume, resource{queue: "audit"}) {
+		t.Fatal("the exchange deny rule matches the queue")
+	}
+	if check("audit", config.OpPublish, resource{exchange: "audit"}) {
+		t.Fatal("the exchange deny rule is not applied")
+	}
+	// the default exchange has the empty name
+	if check("orders", config.OpPublish, resource{routingKey: "billing"}) {
+		t.Fatal("the exchange allow rule matches the default exchange")
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled: true,
+		ACL: []config.ACLRule{
+			{Identity: "ops", Action: config.ACLAllow, Operations: []string{config.OpAdmin}},
+			{Identity: "*", Action: config.ACLAllow, Operations: []string{config.OpPublish}, Exchange: "#"},
+		},
+	}, 1024, metrics.NewRegistry())
+	tracker := newAsyncTracker(10)
+	tracker.add("m1", "orders")
+	status := asyncStatusHandler(tracker, auth)
+	level := auth.admin(logLevel)
+
+	do := func(h http.HandlerFunc, name, method, target string) int {
+		req := httptest.NewRequest(method, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &identity{name: name}))
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	if code := do(status, "orders", http.MethodGet, "/async_status/m1"); code != http.StatusOK {
+		t.Fatalf("the owner get status %d", code)
+	}
+	if code := do(status, "billing", http.MethodGet, "/async_status/m1"); code != http.StatusForbidden {
+		t.Fatalf("the other identity get status %d", code)
+	}
+	if code := do(status, "ops", http.MethodGet, "/async_status/m1"); code != http.StatusOK {
+		t.Fatalf("the admin get status %d", code)
+	}
+	if code := do(level, "orders", http.MethodGet, "/log/level"); code != http.StatusForbidden {
+		t.Fatalf("the non admin get log level %d", code)
+	}
+	if code := do(level, "ops", http.MethodGet, "/log/level"); code != http.StatusOK {
+		t.Fatalf("the admin get log level %d", code)
+	}
+}
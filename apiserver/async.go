@@ -0,0 +1,158 @@
+package apiserver
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/pool"
+	"github.com/iyidan/http-proxy-amqp/util"
+)
+
+// asyncStatusPending is the status of the async message waiting for the confirm
+const asyncStatusPending = "pending"
+
+// asyncStatus is the confirm result of a async message, the status is pending or the batch message status
+type asyncStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Spooled is true if the failed message is spooled to retry
+	Spooled bool `json:"spooled,omitempty"`
+
+	// owner is the identity sent the message, empty if the auth is disabled
+	owner string
+}
+
+// asyncTracker keeps the latest capacity async results, the oldest are evicted
+type asyncTracker struct {
+	l     sync.Mutex
+	items map[string]*asyncStatus
+	// order is a ring of the ids in the add order
+	order []string
+	next  int
+}
+
+func newAsyncTracker(capacity int) *asyncTracker {
+	return &asyncTracker{
+		items: make(map[string]*asyncStatus, capacity),
+		order: make([]string, capacity),
+	}
+}
+
+func (t *asyncTracker) add(id, owner string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if old := t.order[t.next]; old != "" {
+		delete(t.items, old)
+	}
+	t.order[t.next] = id
+	t.next = (t.next + 1) % len(t.order)
+	t.items[id] = &asyncStatus{ID: id, Status: asyncStatusPending, owner: owner}
+}
+
+// set record the confirm result, it's ignored if the id is evicted
+func (t *asyncTracker) set(id string, err error, spooled bool) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	s, ok := t.items[id]
+	if !ok {
+		return
+	}
+	r := newBatchResult(err)
+	s.Status = r.Status
+	s.Error = r.Error
+	s.Spooled = spooled
+}
+
+func (t *asyncTracker) get(id string) (asyncStatus, bool) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	s, ok := t.items[id]
+	if !ok {
+		return asyncStatus{}, false
+	}
+	return *s, true
+}
+
+// asyncSend is the handler of /async_send?exchange=...&routingKey=...
+// it responds the message id after the message is written to the server without waiting for the confirm,
+// the confirm result is queried by /async_status/{id}
+func asyncSend(cop *pool.ConnPool, conf *config.Config, auth *Authenticator, tracker *asyncTracker) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			writeError(res, errMethodNotAllowed(res, http.MethodPost, http.MethodPut))
+			return
+		}
+
+		exchange, routingKey, opts, body, err := parsePublishRequest(req, conf)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		if err := auth.authorize(req, config.OpPublish, resource{exchange: exchange, routingKey: routingKey}); err != nil {
+			writeError(res, err)
+			return
+		}
+
+		ctx, cancel := publishContext(req, conf.PublishTimeout)
+		defer cancel()
+
+		owner := ""
+		if who := identityFrom(req.Context()); who != nil {
+			owner = who.name
+		}
+		id := util.RandomID(16)
+		tracker.add(id, owner)
+		err = cop.PublishAsync(ctx, exchange, routingKey, body, opts, func(err error) {
+			// the nacked and unconfirmed messages may be accepted by retry, the unroutable never
+			if err == nil || err == pool.ErrUnroutable || !conf.Async.SpoolFailures {
+				tracker.set(id, err, false)
+				return
+			}
+			// not block the confirm goroutine by the fsync
+			go func() {
+				serr := cop.SpoolMsg(&pool.Message{Exchange: exchange, RoutingKey: routingKey, Properties: opts, Body: body})
+				if serr != nil {
+					log.Error("asyncSend: spool message failed", log.Fields{"id": id, "error": serr, "publishError": err})
+				}
+				tracker.set(id, err, serr == nil)
+			}()
+		})
+		if err != nil {
+			tracker.set(id, err, false)
+			writeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusAccepted, &envelope{OK: true, Data: map[string]string{"id": id}})
+	}
+}
+
+// asyncStatusHandler is the handler of /async_status/{id},
+// the status of the message sent by the other identity requires the admin operation
+func asyncStatusHandler(tracker *asyncTracker, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeError(res, errMethodNotAllowed(res, http.MethodGet))
+			return
+		}
+		id := strings.TrimPrefix(req.URL.Path, "/async_status/")
+		s, ok := tracker.get(id)
+		if !ok {
+			writeError(res, newAPIError(http.StatusNotFound, codeNotFound, "async message %s not found or evicted", id))
+			return
+		}
+		if who := identityFrom(req.Context()); who != nil && who.name != s.owner {
+			if err := auth.authorize(req, config.OpAdmin, resource{}); err != nil {
+				writeError(res, err)
+				return
+			}
+		}
+		writeJSON(res, http.StatusOK, &envelope{OK: true, Data: &s})
+	}
+}
@@ -0,0 +1,94 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/metrics"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+func TestAsyncTracker(t *testing.T) {
+	tracker := newAsyncTracker(2)
+	tracker.add("m1", "orders")
+	tracker.add("m2", "orders")
+
+	if s, ok := tracker.get("m1"); !ok || s.Status != asyncStatusPending || s.owner != "orders" {
+		t.Fatalf("get(m1) = %+v, %v, expected pending", s, ok)
+	}
+	tracker.set("m1", nil, false)
+	tracker.set("m2", pool.ErrNacked, true)
+	if s, _ := tracker.get("m1"); s.Status != batchStatusAck || len(s.Error) > 0 || s.Spooled {
+		t.Fatalf("get(m1) = %+v, expected acked", s)
+	}
+	if s, _ := tracker.get("m2"); s.Status != batchStatusNack || s.Error != pool.ErrNacked.Error() || !s.Spooled {
+		t.Fatalf("get(m2) = %+v, expected nacked and spooled", s)
+	}
+
+	// the oldest is evicted when full, the result of the evicted id is ignored
+	tracker.add("m3", "billing")
+	if _, ok := tracker.get("m1"); ok {
+		t.Fatal("m1 is not evicted")
+	}
+	tracker.set("m1", nil, false)
+	if _, ok := tracker.get("m1"); ok || len(tracker.items) != 2 {
+		t.Fatalf("the evicted m1 is added back, %d items", len(tracker.items))
+	}
+	if _, ok := tracker.get("m2"); !ok {
+		t.Fatal("m2 is evicted")
+	}
+}
+
+func TestAsyncStatusHandler(t *testing.T) {
+	tracker := newAsyncTracker(10)
+	tracker.add("m1", "orders")
+	tracker.set("m1", pool.ErrUnroutable, false)
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled: true,
+		ACL: []config.ACLRule{
+			{Identity: "ops", Action: config.ACLAllow, Operations: []string{config.OpAdmin}},
+			{Identity: "*", Action: config.ACLAllow, Operations: []string{config.OpPublish}},
+		},
+	}, 1024, metrics.NewRegistry())
+	h := asyncStatusHandler(tracker, auth)
+
+	cases := []struct {
+		method   string
+		identity string
+		id       string
+		status   int
+	}{
+		{http.MethodPost, "orders", "m1", http.StatusMethodNotAllowed},
+		{http.MethodGet, "orders", "m2", http.StatusNotFound},
+		{http.MethodGet, "orders", "m1", http.StatusOK},
+		// the status of the other identity requires the admin operation
+		{http.MethodGet, "billing", "m1", http.StatusForbidden},
+		{http.MethodGet, "ops", "m1", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/async_status/"+c.id, nil)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &identity{name: c.identity}))
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s %s by %s: got %d, expected %d", c.method, c.id, c.identity, rec.Code, c.status)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var env struct {
+			Data asyncStatus `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Data.ID != "m1" || env.Data.Status != batchStatusReturned || env.Data.Error != pool.ErrUnroutable.Error() {
+			t.Errorf("unexpected status %+v", env.Data)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/metrics"
+)
+
+// the authentication methods of the identities
+const (
+	authAPIKey = "apikey"
+	authHMAC   = "hmac"
+	authBasic  = "basic"
+	authCert   = "cert"
+)
+
+const (
+	// headerAPIKey is the api key header, the key can be sent as Authorization: Bearer $key too
+	headerAPIKey = "X-API-Key"
+	// schemeHMAC is the Authorization scheme of the signed requests:
+	// Authorization: HMAC-SHA256 keyId=$keyId,timestamp=$unixSeconds,signature=$hexSignature
+	schemeHMAC = "HMAC-SHA256"
+
+	codeUnauthorized = "UNAUTHORIZED"
+)
+
+// the reasons of the authentication failures, they are logged but not responded
+var (
+	errNoCredentials    = errors.New("no credentials")
+	errUnknownKey       = errors.New("unknown api key")
+	errBadSignature     = errors.New("bad signature")
+	errUnknownKeyID     = errors.New("unknown hmac keyId")
+	errBadTimestamp     = errors.New("timestamp out of the replay window")
+	errReplayed         = errors.New("hmac signature replayed")
+	errMalformedHMAC    = errors.New("malformed hmac authorization")
+	errBadBasic         = errors.New("bad user or password")
+	errMalformedBasic   = errors.New("malformed basic authorization")
+	errUnsupportedAuthz = errors.New("unsupported authorization scheme")
+)
+
+// identity is the authenticated client of a request
+type identity struct {
+	name   string
+	method string
+}
+
+type identityKey struct{}
+
+// identityFrom return the identity of the request context, nil if the auth is disabled
+func identityFrom(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
+
+type hmacKey struct {
+	name   string
+	secret []byte
+}
+
+// credentials is a snapshot of the auth config, it's replaced as a whole on reload
+type credentials struct {
+	// apiKeys is the sha256 of the keys to the names
+	apiKeys      map[[sha256.Size]byte]string
+	hmacKeys     map[string]hmacKey
+	users        map[string][sha256.Size]byte
+	replayWindow time.Duration
+	acl          []aclRule
+}
+
+func newCredentials(c *config.AuthConfig) *credentials {
+	creds := &credentials{
+		apiKeys:      make(map[[sha256.Size]byte]string, len(c.APIKeys)),
+		hmacKeys:     make(map[string]hmacKey, len(c.HMACKeys)),
+		users:        make(map[string][sha256.Size]byte, len(c.Users)),
+		replayWindow: time.Duration(c.ReplayWindow) * time.Millisecond,
+		acl:          compileACL(c.ACL),
+	}
+	for _, k := range c.APIKeys {
+		creds.apiKeys[sha256.Sum256([]byte(k.Key))] = k.Name
+	}
+	for _, k := range c.HMACKeys {
+		creds.hmacKeys[k.KeyID] = hmacKey{name: k.Name, secret: []byte(k.Secret)}
+	}
+	for _, u := range c.Users {
+		creds.users[u.User] = sha256.Sum256([]byte(u.Password))
+	}
+	return creds
+}
+
+// signatureCache keeps the accepted hmac signatures until they are out of the replay window,
+// so a signed request is accepted once
+type signatureCache struct {
+	l         sync.Mutex
+	expires   map[string]time.Time
+	nextSweep time.Time
+}
+
+// add record the signature until expires, false if it's already recorded
+func (c *signatureCache) add(sig string, expires time.Time) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, e := range c.expires {
+			if now.After(e) {
+				delete(c.expires, k)
+			}
+		}
+		c.nextSweep = now.Add(time.Minute)
+	}
+	if e, ok := c.expires[sig]; ok && !now.After(e) {
+		return false
+	}
+	c.expires[sig] = expires
+	return true
+}
+
+// Authenticator authenticates the api requests by the api keys, the hmac signatures, the basic users
+// or the client certificates,
+// and authorizes the operations of the identities by the acl
+type Authenticator struct {
+	enabled     bool
+	public      map[string]bool
+	basic       bool
+	maxBodySize int
+	creds       atomic.Value
+	denials     *metrics.Counter
+	signatures  signatureCache
+}
+
+// NewAuthenticator create the authenticator of the auth config,
+// maxBodySize limits the body read to verify the signature, the acl denials are counted in reg
+func NewAuthenticator(c *config.AuthConfig, maxBodySize int, reg *metrics.Registry) *Authenticator {
+	a := &Authenticator{
+		enabled:     c.Enabled,
+		public:      make(map[string]bool, len(c.PublicRoutes)),
+		basic:       len(c.Users) > 0,
+		maxBodySize: maxBodySize,
+		denials: reg.NewCounter("amqp_proxy_acl_denials_total",
+			"The requests denied by the acl by identity and operation.", "identity", "operation"),
+		signatures: signatureCache{expires: make(map[string]time.Time)},
+	}
+	for _, route := range c.PublicRoutes {
+		a.public[route] = true
+	}
+	a.creds.Store(newCredentials(c))
+	return a
+}
+
+// Update replace the credentials and the acl with the reloaded auth config,
+// the requests in progress keep the credentials they are authenticated with
+func (a *Authenticator) Update(c *config.AuthConfig) {
+	a.creds.Store(newCredentials(c))
+}
+
+// wrap the handler to authenticate the requests of the route,
+// the identity is set in the request context
+func (a *Authenticator) wrap(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	if a == nil || !a.enabled || a.public[pattern] {
+		return h
+	}
+	return func(res http.ResponseWriter, req *http.Request) {
+		id, err := a.authenticate(req)
+		if err != nil {
+			if e, ok := err.(*apiError); ok {
+				writeError(res, e)
+				return
+			}
+			clientIP, _, serr := net.SplitHostPort(req.RemoteAddr)
+			if serr != nil {
+				clientIP = req.RemoteAddr
+			}
+			log.Warn("authentication failed", log.Fields{"route": pattern, "method": req.Method, "clientIp": clientIP, "reason": err})
+			if a.basic {
+				res.Header().Set("WWW-Authenticate", `Basic realm="http-proxy-amqp"`)
+			}
+			writeError(res, newAPIError(http.StatusUnauthorized, codeUnauthorized, "unauthorized"))
+			return
+		}
+		if w, ok := req.Context().Value(accessKey{}).(*accessWriter); ok {
+			w.identity = id.name
+		}
+		h(res, req.WithContext(context.WithValue(req.Context(), identityKey{}, id)))
+	}
+}
+
+// authenticate return the identity of the request credentials
+func (a *Authenticator) authenticate(req *http.Request) (*identity, error) {
+	creds := a.creds.Load().(*credentials)
+
+	if key := req.Header.Get(headerAPIKey); len(key) > 0 {
+		return creds.apiKey(key)
+	}
+	authz := req.Header.Get("Authorization")
+	if len(authz) == 0 {
+		// the common name of the client certificate verified by the mTLS,
+		// it's prefixed so it never equals the name of a credential
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			if cn := req.TLS.VerifiedChains[0][0].Subject.CommonName; len(cn) > 0 {
+				return &identity{name: config.CertIdentityPrefix + cn, method: authCert}, nil
+			}
+		}
+		return nil, errNoCredentials
+	}
+	scheme, params := authz, ""
+	if i := strings.IndexByte(authz, ' '); i > 0 {
+		scheme, params = authz[:i], strings.TrimSpace(authz[i+1:])
+	}
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		return creds.apiKey(params)
+	case strings.EqualFold(scheme, schemeHMAC):
+		return a.hmac(creds, req, params)
+	case strings.EqualFold(scheme, "Basic"):
+		user, password, ok := req.BasicAuth()
+		if !ok {
+			return nil, errMalformedBasic
+		}
+		return creds.basic(user, password)
+	}
+	return nil, errUnsupportedAuthz
+}
+
+func (c *credentials) apiKey(key string) (*identity, error) {
+	name, ok := c.apiKeys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return &identity{name: name, method: authAPIKey}, nil
+}
+
+func (c *credentials) basic(user, password string) (*identity, error) {
+	hash, ok := c.users[user]
+	sum := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(hash[:], sum[:]) != 1 || !ok {
+		return nil, errBadBasic
+	}
+	return &identity{name: user, method: authBasic}, nil
+}
+
+// hmac verify the signature of the request, the body is read and replaced for the handler
+func (a *Authenticator) hmac(c *credentials, req *http.Request, params string) (*identity, error) {
+	var keyID, timestamp, signature string
+	for _, kv := range strings.Split(params, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return nil, errMalformedHMAC
+		}
+		v := strings.Trim(strings.TrimSpace(kv[i+1:]), `"`)
+		switch strings.TrimSpace(kv[:i]) {
+		case "keyId":
+			keyID = v
+		case "timestamp":
+			timestamp = v
+		case "signature":
+			signature = v
+		}
+	}
+	if len(keyID) == 0 || len(timestamp) == 0 || len(signature) == 0 {
+		return nil, errMalformedHMAC
+	}
+	key, ok := c.hmacKeys[keyID]
+	if !ok {
+		return nil, errUnknownKeyID
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errMalformedHMAC
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > c.replayWindow || d < -c.replayWindow {
+		return nil, errBadTimestamp
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, errMalformedHMAC
+	}
+
+	body, err := readBody(req, a.maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(sig, signRequest(key.secret, req.Method, req.URL.EscapedPath(), req.URL.RawQuery, timestamp, body)) {
+		return nil, errBadSignature
+	}
+	// the timestamp is checked above, so the signature is kept for the rest of the window,
+	// it's encoded again as the upper case hex is decoded too
+	if !a.signatures.add(keyID+":"+hex.EncodeToString(sig), time.Unix(ts, 0).Add(c.replayWindow)) {
+		return nil, errReplayed
+	}
+	return &identity{name: key.name, method: authHMAC}, nil
+}
+
+// signRequest return the HMAC-SHA256 of the lines:
+// the method, the escaped path, the query sorted by key, the timestamp and the hex sha256 of the body
+func signRequest(secret []byte, method, path, rawQuery, timestamp string, body []byte) []byte {
+	query, _ := url.ParseQuery(rawQuery)
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + query.Encode() + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:])))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,197 @@
+package apiserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/metrics"
+)
+
+// sign the request as a client, independent of signRequest
+func sign(req *http.Request, keyID, secret string, body string, ts time.Time) {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	sum := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", req.Method, req.URL.EscapedPath(), req.URL.Query().Encode(), timestamp, hex.EncodeToString(sum[:]))
+	req.Header.Set("Authorization", fmt.Sprintf(`HMAC-SHA256 keyId="%s", timestamp="%s", signature="%s"`,
+		keyID, timestamp, hex.EncodeToString(mac.Sum(nil))))
+}
+
+func TestHMACAuth(t *testing.T) {
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled:      true,
+		HMACKeys:     []config.HMACCredential{{Name: "orders", KeyID: "k1", Secret: "s3cret"}},
+		ReplayWindow: 60000,
+	}, 1024, metrics.NewRegistry())
+
+	var got *identity
+	var gotBody string
+	h := auth.wrap("/confirm_send", func(res http.ResponseWriter, req *http.Request) {
+		got = identityFrom(req.Context())
+		body, _ := ioutil.ReadAll(req.Body)
+		gotBody = string(body)
+	})
+	do := func(secret, body string, ts time.Time, tamper func(*http.Request)) int {
+		got = nil
+		req := httptest.NewRequest(http.MethodPost, "/confirm_send?routingKey=a.b&exchange=amq.topic", strings.NewReader(body))
+		sign(req, "k1", secret, body, ts)
+		if tamper != nil {
+			tamper(req)
+		}
+		res := httptest.NewRecorder()
+		h(res, req)
+		return res.Code
+	}
+
+	now := time.Now()
+	if code := do("s3cret", "hello", now, nil); code != http.StatusOK || got == nil || got.name != "orders" || gotBody != "hello" {
+		t.Fatalf("signed request not authenticated: %d %+v %q", code, got, gotBody)
+	}
+	if code := do("s3cret", "hello", now, nil); code != http.StatusUnauthorized || got != nil {
+		t.Fatalf("replayed request authenticated: %d", code)
+	}
+	if code := do("s3cret", "hello", now, func(req *http.Request) {
+		req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), "signature=\"", "signature=\"ABCDEF", 1))
+	}); code != http.StatusUnauthorized {
+		t.Fatalf("tampered signature authenticated: %d", code)
+	}
+	if code := do("s3cret", "hello", now, func(req *http.Request) {
+		authz := req.Header.Get("Authorization")
+		i := strings.Index(authz, "signature=") + len("signature=")
+		req.Header.Set("Authorization", authz[:i]+strings.ToUpper(authz[i:]))
+	}); code != http.StatusUnauthorized {
+		t.Fatalf("replayed upper case signature authenticated: %d", code)
+	}
+	if code := do("s3cret", "hello", now.Add(time.Second), nil); code != http.StatusOK {
+		t.Fatalf("request signed again not authenticated: %d", code)
+	}
+	if code := do("wrong", "hello", time.Now(), nil); code != http.StatusUnauthorized || got != nil {
+		t.Fatalf("bad secret authenticated: %d", code)
+	}
+	if code := do("s3cret", "hello", time.Now().Add(-2*time.Minute), nil); code != http.StatusUnauthorized {
+		t.Fatalf("request out of the replay window authenticated: %d", code)
+	}
+	if code := do("s3cret", "hello", time.Now(), func(req *http.Request) {
+		req.URL.RawQuery = "exchange=amq.topic&routingKey=other"
+	}); code != http.StatusUnauthorized {
+		t.Fatalf("tampered query authenticated: %d", code)
+	}
+	if code := do("s3cret", "hello", time.Now(), func(req *http.Request) {
+		req.Body = ioutil.NopCloser(strings.NewReader("hellO"))
+	}); code != http.StatusUnauthorized {
+		t.Fatalf("tampered body authenticated: %d", code)
+	}
+
+	// the rotated secret is used by the next requests
+	auth.Update(&config.AuthConfig{
+		HMACKeys:     []config.HMACCredential{{Name: "orders", KeyID: "k1", Secret: "rotated"}},
+		ReplayWindow: 60000,
+	})
+	if code := do("s3cret", "hello", time.Now(), nil); code != http.StatusUnauthorized {
+		t.Fatalf("old secret authenticated after the rotation: %d", code)
+	}
+	if code := do("rotated", "hello", time.Now(), nil); code != http.StatusOK {
+		t.Fatalf("rotated secret not authenticated: %d", code)
+	}
+}
+
+func TestHMACBodyTooLarge(t *testing.T) {
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled:      true,
+		HMACKeys:     []config.HMACCredential{{Name: "orders", KeyID: "k1", Secret: "s3cret"}},
+		ReplayWindow: 60000,
+	}, 4, metrics.NewRegistry())
+	h := auth.wrap("/confirm_send", func(res http.ResponseWriter, req *http.Request) {
+		t.Fatal("the handler called with the body too large")
+	})
+
+	body := "hello"
+	req := httptest.NewRequest(http.MethodPost, "/confirm_send", strings.NewReader(body))
+	sign(req, "k1", "s3cret", body, time.Now())
+	res := httptest.NewRecorder()
+	h(res, req)
+	if res.Code != http.StatusRequestEntityTooLarge || !strings.Contains(res.Body.String(), codeBodyTooLarge) {
+		t.Fatalf("body too large got %d %s", res.Code, res.Body.String())
+	}
+}
+
+func TestAPIKeyAndBasicAuth(t *testing.T) {
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled:      true,
+		APIKeys:      []config.APIKeyCredential{{Name: "orders", Key: "key-1"}},
+		Users:        []config.BasicCredential{{User: "ops", Password: "pa55"}},
+		PublicRoutes: []string{"/metrics"},
+	}, 1024, metrics.NewRegistry())
+
+	var got *identity
+	handler := func(res http.ResponseWriter, req *http.Request) {
+		got = identityFrom(req.Context())
+	}
+	h := auth.wrap("/confirm_send", handler)
+	do := func(h http.HandlerFunc, set func(*http.Request)) *httptest.ResponseRecorder {
+		got = nil
+		req := httptest.NewRequest(http.MethodPost, "/confirm_send", nil)
+		if set != nil {
+			set(req)
+		}
+		res := httptest.NewRecorder()
+		h(res, req)
+		return res
+	}
+
+	cases := []struct {
+		name   string
+		set    func(*http.Request)
+		status int
+		id     string
+	}{
+		{"api key header", func(req *http.Request) { req.Header.Set(headerAPIKey, "key-1") }, http.StatusOK, "orders"},
+		{"bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer key-1") }, http.StatusOK, "orders"},
+		{"unknown api key", func(req *http.Request) { req.Header.Set(headerAPIKey, "key-2") }, http.StatusUnauthorized, ""},
+		{"unknown bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer key-2") }, http.StatusUnauthorized, ""},
+		{"basic", func(req *http.Request) { req.SetBasicAuth("ops", "pa55") }, http.StatusOK, "ops"},
+		{"basic bad password", func(req *http.Request) { req.SetBasicAuth("ops", "wrong") }, http.StatusUnauthorized, ""},
+		{"basic unknown user", func(req *http.Request) { req.SetBasicAuth("nobody", "pa55") }, http.StatusUnauthorized, ""},
+		{"malformed basic", func(req *http.Request) { req.Header.Set("Authorization", "Basic !!!") }, http.StatusUnauthorized, ""},
+		{"unsupported scheme", func(req *http.Request) { req.Header.Set("Authorization", "Digest x") }, http.StatusUnauthorized, ""},
+		{"no credentials", nil, http.StatusUnauthorized, ""},
+	}
+	for _, c := range cases {
+		res := do(h, c.set)
+		if res.Code != c.status {
+			t.Fatalf("%s: got %d, expected %d", c.name, res.Code, c.status)
+		}
+		if c.status != http.StatusOK {
+			if got != nil {
+				t.Fatalf("%s: the handler called", c.name)
+			}
+			// the basic users are configured
+			if res.Header().Get("WWW-Authenticate") == "" {
+				t.Fatalf("%s: no WWW-Authenticate header", c.name)
+			}
+			continue
+		}
+		if got == nil || got.name != c.id {
+			t.Fatalf("%s: identity %+v, expected %s", c.name, got, c.id)
+		}
+	}
+
+	// the public routes are not authenticated and have no identity
+	called := false
+	public := auth.wrap("/metrics", func(res http.ResponseWriter, req *http.Request) {
+		called = identityFrom(req.Context()) == nil
+	})
+	if res := do(public, nil); res.Code != http.StatusOK || !called {
+		t.Fatalf("public route got %d", res.Code)
+	}
+}
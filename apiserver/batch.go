@@ -0,0 +1,164 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+// batch message status
+const (
+	batchStatusAck  = "ack"
+	batchStatusNack = "nack"
+	// the message is returned by the server because no queue is bound
+	batchStatusReturned = "returned"
+	batchStatusError    = "error"
+)
+
+// batchResult is the confirm result of one message in the batch
+type batchResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newBatchResult return the result of the confirm error
+func newBatchResult(err error) batchResult {
+	switch err {
+	case nil:
+		return batchResult{Status: batchStatusAck}
+	case pool.ErrUnroutable:
+		return batchResult{Status: batchStatusReturned, Error: err.Error()}
+	case pool.ErrNacked:
+		return batchResult{Status: batchStatusNack, Error: err.Error()}
+	}
+	return batchResult{Status: batchStatusError, Error: err.Error()}
+}
+
+// batchResponse is the response of /confirm_send_batch
+// Results has the same order as the request messages
+type batchResponse struct {
+	Acked   int           `json:"acked"`
+	Failed  int           `json:"failed"`
+	Results []batchResult `json:"results"`
+}
+
+// decodeBatchMessages decode a json array or newline delimited json objects
+func decodeBatchMessages(body []byte) ([]*pool.Message, error) {
+	var msgs []*pool.Message
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			return nil, err
+		}
+		return msgs, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		msg := &pool.Message{}
+		err := dec.Decode(msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %s", len(msgs), err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// validateMessage check the required fields of a message
+func validateMessage(msg *pool.Message) error {
+	if msg == nil {
+		return fmt.Errorf("message empty")
+	}
+	msg.Exchange = strings.TrimSpace(msg.Exchange)
+	msg.RoutingKey = strings.TrimSpace(msg.RoutingKey)
+	if len(msg.Exchange) == 0 {
+		return fmt.Errorf("exchange param empty")
+	}
+	if len(msg.RoutingKey) == 0 {
+		return fmt.Errorf("routingKey param empty")
+	}
+	if len(msg.Body) == 0 {
+		return fmt.Errorf("message body empty")
+	}
+	return nil
+}
+
+// confirmSendBatch is the handler of /confirm_send_batch
+func confirmSendBatch(cop *pool.ConnPool, conf *config.Config, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			writeError(res, errMethodNotAllowed(res, http.MethodPost, http.MethodPut))
+			return
+		}
+
+		body, err := readBody(req, conf.MaxBodySize)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+
+		msgs, err := decodeBatchMessages(body)
+		if err != nil {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "decode messages fail: %s", err))
+			return
+		}
+		if len(msgs) == 0 {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "messages empty"))
+			return
+		}
+		if len(msgs) > conf.MaxBatchSize {
+			writeError(res, newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, "too many messages, max batch size is %d", conf.MaxBatchSize))
+			return
+		}
+
+		resp := &batchResponse{Results: make([]batchResult, len(msgs))}
+
+		// only the valid messages are published, idx maps them back to the request order
+		valid := make([]*pool.Message, 0, len(msgs))
+		idx := make([]int, 0, len(msgs))
+		for i, msg := range msgs {
+			if err := validateMessage(msg); err != nil {
+				resp.Results[i] = batchResult{Status: batchStatusError, Error: err.Error()}
+				continue
+			}
+			if err := auth.authorize(req, config.OpPublish, resource{exchange: msg.Exchange, routingKey: msg.RoutingKey}); err != nil {
+				resp.Results[i] = batchResult{Status: batchStatusError, Error: err.Error()}
+				continue
+			}
+			valid = append(valid, msg)
+			idx = append(idx, i)
+		}
+
+		ctx, cancel := publishContext(req, conf.PublishTimeout)
+		defer cancel()
+
+		errs, err := cop.ConfirmSendBatchContext(ctx, valid)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		for j, err := range errs {
+			resp.Results[idx[j]] = newBatchResult(err)
+		}
+		for _, r := range resp.Results {
+			if r.Status == batchStatusAck {
+				resp.Acked++
+			} else {
+				resp.Failed++
+			}
+		}
+
+		writeJSON(res, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,137 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+func TestDecodeBatchMessages(t *testing.T) {
+	bodies := map[string]string{
+		"json": `[{"exchange":"orders","routingKey":"created","body":"m1"},
+			{"exchange":"orders","routingKey":"paid","body":"bTI=","bodyEncoding":"base64","properties":{"priority":3}}]`,
+		"ndjson": `{"exchange":"orders","routingKey":"created","body":"m1"}
+{"exchange":"orders","routingKey":"paid","body":"bTI=","bodyEncoding":"base64","properties":{"priority":3}}
+`,
+	}
+	for name, body := range bodies {
+		msgs, err := decodeBatchMessages([]byte(body))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(msgs) != 2 {
+			t.Fatalf("%s: %d messages, expected 2", name, len(msgs))
+		}
+		if msgs[0].RoutingKey != "created" || string(msgs[0].Body) != "m1" || string(msgs[1].Body) != "m2" {
+			t.Fatalf("%s: unexpected messages %+v %+v", name, msgs[0], msgs[1])
+		}
+		// the properties not given keep the defaults
+		if msgs[0].Properties.DeliveryMode != amqp.Persistent || msgs[1].Properties.Priority != 3 || msgs[1].Properties.DeliveryMode != amqp.Persistent {
+			t.Fatalf("%s: unexpected properties %+v %+v", name, msgs[0].Properties, msgs[1].Properties)
+		}
+	}
+
+	if msgs, err := decodeBatchMessages([]byte("  \n")); err != nil || len(msgs) != 0 {
+		t.Fatalf("empty body = %v, %v", msgs, err)
+	}
+	_, err := decodeBatchMessages([]byte("{\"exchange\":\"orders\",\"body\":\"m1\"}\n{\"exchange\":"))
+	if err == nil || !strings.HasPrefix(err.Error(), "message 1:") {
+		t.Fatalf("truncated ndjson = %v, expected the error of message 1", err)
+	}
+	if _, err := decodeBatchMessages([]byte(`[{"exchange":"orders","body":"m1","bodyEncoding":"hex"}]`)); err == nil {
+		t.Fatal("unknown bodyEncoding accepted")
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	cases := []struct {
+		msg *pool.Message
+		err string
+	}{
+		{nil, "message empty"},
+		{&pool.Message{Exchange: " ", RoutingKey: "k", Body: []byte("m")}, "exchange param empty"},
+		{&pool.Message{Exchange: "orders", Body: []byte("m")}, "routingKey param empty"},
+		{&pool.Message{Exchange: "orders", RoutingKey: "k"}, "message body empty"},
+	}
+	for _, c := range cases {
+		if err := validateMessage(c.msg); err == nil || err.Error() != c.err {
+			t.Errorf("validateMessage(%+v) = %v, expected %q", c.msg, err, c.err)
+		}
+	}
+
+	msg := &pool.Message{Exchange: " orders ", RoutingKey: " k\n", Body: []byte("m")}
+	if err := validateMessage(msg); err != nil || msg.Exchange != "orders" || msg.RoutingKey != "k" {
+		t.Fatalf("validateMessage = %v, exchange %q routingKey %q", err, msg.Exchange, msg.RoutingKey)
+	}
+}
+
+func TestNewBatchResult(t *testing.T) {
+	cases := []struct {
+		err    error
+		status string
+	}{
+		{nil, batchStatusAck},
+		{pool.ErrUnroutable, batchStatusReturned},
+		{pool.ErrNacked, batchStatusNack},
+		{errors.New("publish failed"), batchStatusError},
+	}
+	for _, c := range cases {
+		r := newBatchResult(c.err)
+		if r.Status != c.status || (c.err == nil) != (len(r.Error) == 0) {
+			t.Errorf("newBatchResult(%v) = %+v, expected status %s", c.err, r, c.status)
+		}
+	}
+}
+
+func TestConfirmSendBatchRequest(t *testing.T) {
+	conf := &config.Config{MaxBodySize: 1024, MaxBatchSize: 2}
+	// no valid message is published, so the pool is not used
+	h := confirmSendBatch(nil, conf, nil)
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/confirm_send_batch", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	cases := []struct {
+		method string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.MethodPost, "[", http.StatusBadRequest, codeBadRequest},
+		{http.MethodPost, "[]", http.StatusBadRequest, codeBadRequest},
+		{http.MethodPost, `[{"body":"1"},{"body":"2"},{"body":"3"}]`, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{http.MethodPost, strings.Repeat(" ", 1025), http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+	}
+	for _, c := range cases {
+		rec := do(c.method, c.body)
+		var env envelope
+		json.Unmarshal(rec.Body.Bytes(), &env)
+		if rec.Code != c.status || env.OK || env.Code != c.code {
+			t.Errorf("%s %.20q: got %d %+v, expected %d %s", c.method, c.body, rec.Code, env, c.status, c.code)
+		}
+	}
+
+	// the invalid messages fail alone with the error result
+	rec := do(http.MethodPut, `[{"exchange":"orders","body":"m1"},{"routingKey":"k","body":"m2"}]`)
+	var resp batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body.String())
+	}
+	if resp.Acked != 0 || resp.Failed != 2 || len(resp.Results) != 2 ||
+		resp.Results[0].Error != "routingKey param empty" || resp.Results[1].Error != "exchange param empty" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
@@ -0,0 +1,124 @@
+package apiserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+// getResponse is the response data of /get
+type getResponse struct {
+	// Lease is the lease id to settle the manual acked messages
+	Lease string `json:"lease,omitempty"`
+	// LeaseExpires is the unix milliseconds the unsettled messages are requeued
+	LeaseExpires int64            `json:"leaseExpires,omitempty"`
+	Messages     []*pool.Delivery `json:"messages"`
+}
+
+// get is the handler of /get?queue=...&count=N&ack=auto|manual
+func get(cop *pool.ConnPool, conf *config.Config, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodPost {
+			writeError(res, errMethodNotAllowed(res, http.MethodGet, http.MethodPost))
+			return
+		}
+
+		query := req.URL.Query()
+		queue := strings.TrimSpace(query.Get("queue"))
+		if len(queue) == 0 {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "queue param empty"))
+			return
+		}
+		if err := auth.authorize(req, config.OpConsume, resource{queue: queue}); err != nil {
+			writeError(res, err)
+			return
+		}
+
+		count := 1
+		if v := query.Get("count"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > conf.MaxGetCount {
+				writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "count param must be 1-%d", conf.MaxGetCount))
+				return
+			}
+			count = n
+		}
+
+		var autoAck bool
+		switch query.Get("ack") {
+		case "", "auto":
+			autoAck = true
+		case "manual":
+			autoAck = false
+		default:
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "ack param must be auto or manual"))
+			return
+		}
+
+		ctx, cancel := publishContext(req, conf.PublishTimeout)
+		defer cancel()
+
+		leaseTimeout := time.Duration(conf.LeaseTimeout) * time.Millisecond
+		lease, deliveries, err := cop.Get(ctx, queue, count, autoAck, leaseTimeout)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+
+		resp := &getResponse{Messages: make([]*pool.Delivery, len(deliveries))}
+		for i := range deliveries {
+			resp.Messages[i] = pool.NewDelivery(&deliveries[i])
+		}
+		if lease != nil {
+			resp.Lease = lease.ID
+			resp.LeaseExpires = lease.Expires.UnixNano() / int64(time.Millisecond)
+		}
+		writeJSON(res, http.StatusOK, &envelope{OK: true, Data: resp})
+	}
+}
+
+// settle is the handler of /ack, /nack and /reject
+// ?lease=...&deliveryTag=N&multiple=true|false&requeue=true|false
+func settle(cop *pool.ConnPool, auth *Authenticator, action pool.SettleAction) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			writeError(res, errMethodNotAllowed(res, http.MethodPost, http.MethodPut))
+			return
+		}
+
+		query := req.URL.Query()
+		lease := strings.TrimSpace(query.Get("lease"))
+		if len(lease) == 0 {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "lease param empty"))
+			return
+		}
+		tag, err := strconv.ParseUint(query.Get("deliveryTag"), 10, 64)
+		if err != nil || tag == 0 {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "deliveryTag param invalid"))
+			return
+		}
+		multiple := query.Get("multiple") == "true"
+		// requeue by default, the same as the amqp clients
+		requeue := query.Get("requeue") != "false"
+		// the lease is bound to the queue of /get
+		queue, err := cop.LeaseQueue(lease)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		if err := auth.authorize(req, config.OpConsume, resource{queue: queue}); err != nil {
+			writeError(res, err)
+			return
+		}
+
+		if err := cop.Settle(lease, tag, action, multiple, requeue); err != nil {
+			writeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, &envelope{OK: true})
+	}
+}
@@ -0,0 +1,48 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+func TestGetAndSettleParams(t *testing.T) {
+	conf := &config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1, MaxGetCount: 10}
+	cop := pool.NewPool(conf)
+	defer cop.CloseAll()
+	getH := get(cop, conf, nil)
+	ackH := settle(cop, nil, pool.SettleAck)
+
+	cases := []struct {
+		h      http.HandlerFunc
+		method string
+		url    string
+		status int
+		code   string
+	}{
+		{getH, http.MethodDelete, "/get?queue=orders", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{getH, http.MethodGet, "/get?queue=+", http.StatusBadRequest, codeBadRequest},
+		{getH, http.MethodGet, "/get?queue=orders&count=0", http.StatusBadRequest, codeBadRequest},
+		{getH, http.MethodGet, "/get?queue=orders&count=11", http.StatusBadRequest, codeBadRequest},
+		{getH, http.MethodGet, "/get?queue=orders&count=x", http.StatusBadRequest, codeBadRequest},
+		{getH, http.MethodGet, "/get?queue=orders&ack=none", http.StatusBadRequest, codeBadRequest},
+		{ackH, http.MethodGet, "/ack?lease=l1&deliveryTag=1", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{ackH, http.MethodPost, "/ack?deliveryTag=1", http.StatusBadRequest, codeBadRequest},
+		{ackH, http.MethodPost, "/ack?lease=l1", http.StatusBadRequest, codeBadRequest},
+		{ackH, http.MethodPost, "/ack?lease=l1&deliveryTag=0", http.StatusBadRequest, codeBadRequest},
+		{ackH, http.MethodPost, "/ack?lease=l1&deliveryTag=1", http.StatusNotFound, codeLeaseNotFound},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		c.h(rec, httptest.NewRequest(c.method, c.url, nil))
+		var env envelope
+		json.Unmarshal(rec.Body.Bytes(), &env)
+		if rec.Code != c.status || env.Code != c.code {
+			t.Errorf("%s %s: got %d %+v, expected %d %s", c.method, c.url, rec.Code, env, c.status, c.code)
+		}
+	}
+}
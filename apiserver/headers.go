@@ -0,0 +1,114 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+// request headers mapped onto the amqp message properties
+const (
+	headerContentType     = "X-AMQP-Content-Type"
+	headerContentEncoding = "X-AMQP-Content-Encoding"
+	headerDeliveryMode    = "X-AMQP-Delivery-Mode"
+	headerPriority        = "X-AMQP-Priority"
+	headerCorrelationID   = "X-AMQP-Correlation-Id"
+	headerReplyTo         = "X-AMQP-Reply-To"
+	headerExpiration      = "X-AMQP-Expiration"
+	headerMessageID       = "X-AMQP-Message-Id"
+	headerTimestamp       = "X-AMQP-Timestamp"
+	headerType            = "X-AMQP-Type"
+	headerUserID          = "X-AMQP-User-Id"
+	headerAppID           = "X-AMQP-App-Id"
+
+	// X-AMQP-Header-{name}: {value} set the amqp message header {name}
+	// the header name is lower cased because http header names are case insensitive
+	headerTablePrefix = "X-Amqp-Header-"
+)
+
+// parsePublishOptions map the X-AMQP-* request headers onto the publish options
+// properties not given keep the value of pool.DefaultPublishOptions
+func parsePublishOptions(header http.Header) (*pool.PublishOptions, error) {
+	opts := pool.DefaultPublishOptions()
+
+	if v := header.Get(headerContentType); v != "" {
+		opts.ContentType = v
+	}
+	opts.ContentEncoding = header.Get(headerContentEncoding)
+	opts.CorrelationID = header.Get(headerCorrelationID)
+	opts.ReplyTo = header.Get(headerReplyTo)
+	opts.MessageID = header.Get(headerMessageID)
+	opts.Type = header.Get(headerType)
+	opts.UserID = header.Get(headerUserID)
+	opts.AppID = header.Get(headerAppID)
+
+	if v := header.Get(headerDeliveryMode); v != "" {
+		switch strings.ToLower(v) {
+		case "1", "transient":
+			opts.DeliveryMode = amqp.Transient
+		case "2", "persistent":
+			opts.DeliveryMode = amqp.Persistent
+		default:
+			return nil, fmt.Errorf("invalid header %s: %q, must be 1(transient) or 2(persistent)", headerDeliveryMode, v)
+		}
+	}
+
+	if v := header.Get(headerPriority); v != "" {
+		priority, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header %s: %q, must be 0-255", headerPriority, v)
+		}
+		opts.Priority = uint8(priority)
+	}
+
+	if v := header.Get(headerExpiration); v != "" {
+		// rabbitmq requires the expiration to be a non-negative integer string in milliseconds
+		if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid header %s: %q, must be milliseconds", headerExpiration, v)
+		}
+		opts.Expiration = v
+	}
+
+	if v := header.Get(headerTimestamp); v != "" {
+		ts, err := parseTimestamp(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header %s: %q, must be unix seconds or RFC3339", headerTimestamp, v)
+		}
+		opts.Timestamp = ts
+	}
+
+	for name, values := range header {
+		if !strings.HasPrefix(name, headerTablePrefix) || len(name) == len(headerTablePrefix) {
+			continue
+		}
+		if opts.Headers == nil {
+			opts.Headers = amqp.Table{}
+		}
+		key := strings.ToLower(name[len(headerTablePrefix):])
+		if len(values) == 1 {
+			opts.Headers[key] = values[0]
+			continue
+		}
+		vs := make([]interface{}, len(values))
+		for i, v := range values {
+			vs[i] = v
+		}
+		opts.Headers[key] = vs
+	}
+
+	return opts, nil
+}
+
+// parseTimestamp parse unix seconds or a RFC3339 time
+func parseTimestamp(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,66 @@
+package apiserver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestParsePublishOptions(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-AMQP-Content-Type", "application/json")
+	header.Set("X-AMQP-Delivery-Mode", "transient")
+	header.Set("X-AMQP-Priority", "5")
+	header.Set("X-AMQP-Correlation-Id", "corr-1")
+	header.Set("X-AMQP-Expiration", "60000")
+	header.Set("X-AMQP-Timestamp", "1500000000")
+	header.Set("X-AMQP-Header-Trace-Id", "abc")
+	header.Add("X-AMQP-Header-Tags", "a")
+	header.Add("X-AMQP-Header-Tags", "b")
+
+	opts, err := parsePublishOptions(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ContentType != "application/json" ||
+		opts.DeliveryMode != amqp.Transient ||
+		opts.Priority != 5 ||
+		opts.CorrelationID != "corr-1" ||
+		opts.Expiration != "60000" ||
+		!opts.Timestamp.Equal(time.Unix(1500000000, 0)) {
+		t.Fatalf("unexpected options: %#v", opts)
+	}
+	if opts.Headers["trace-id"] != "abc" {
+		t.Fatalf("unexpected header trace-id: %#v", opts.Headers)
+	}
+	if tags, ok := opts.Headers["tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Fatalf("unexpected header tags: %#v", opts.Headers)
+	}
+}
+
+func TestParsePublishOptionsDefault(t *testing.T) {
+	opts, err := parsePublishOptions(http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ContentType != "text/plain" || opts.DeliveryMode != amqp.Persistent || opts.Headers != nil {
+		t.Fatalf("unexpected default options: %#v", opts)
+	}
+}
+
+func TestParsePublishOptionsInvalid(t *testing.T) {
+	for name, value := range map[string]string{
+		"X-AMQP-Delivery-Mode": "3",
+		"X-AMQP-Priority":      "256",
+		"X-AMQP-Expiration":    "1.5",
+		"X-AMQP-Timestamp":     "yesterday",
+	} {
+		header := http.Header{}
+		header.Set(name, value)
+		if _, err := parsePublishOptions(header); err == nil {
+			t.Fatalf("%s: %s should be invalid", name, value)
+		}
+	}
+}
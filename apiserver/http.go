@@ -1,7 +1,10 @@
 package apiserver
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -10,63 +13,108 @@ import (
 
 	"strings"
 
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/dedup"
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/metrics"
 	"github.com/iyidan/http-proxy-amqp/pool"
-	"github.com/ngaut/log"
+	"github.com/iyidan/http-proxy-amqp/trace"
+	"github.com/iyidan/http-proxy-amqp/util"
 )
 
-// InitServer init a new http server with the given pool
-func InitServer(pool *pool.ConnPool) *http.Server {
-	conf := pool.GetConf()
+// InitServer init a new http server with the given pool,
+// the requests are traced if the tracer is not nil, and authenticated by auth if it's enabled
+func InitServer(cop *pool.ConnPool, tracer *trace.Tracer, auth *Authenticator) *http.Server {
+	conf := cop.GetConf()
 
 	mux := http.NewServeMux()
 
 	// api for get pool stats
-	mux.HandleFunc("/stats", func(res http.ResponseWriter, req *http.Request) {
-		stats, _ := json.Marshal(pool.Stats())
+	mux.HandleFunc("/stats", auth.wrap("/stats", auth.admin(func(res http.ResponseWriter, req *http.Request) {
+		stats, _ := json.Marshal(cop.Stats())
 		fmt.Fprintf(res, "%s", stats)
-	})
+	})))
 
-	// api for confirm send message
-	mux.HandleFunc("/confirm_send", func(res http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodPost && req.Method != http.MethodPut {
-			fmt.Fprint(res, "method not allowed")
-			return
-		}
+	// api for get the metrics in the prometheus text format
+	mux.HandleFunc("/metrics", auth.wrap("/metrics", auth.admin(cop.Metrics().ServeHTTP)))
+
+	// the latency of the apis below is observed by the route pattern, and they are traced, authenticated and access logged
+	latency := cop.Metrics().NewHistogram("amqp_proxy_http_request_seconds",
+		"The seconds of the http requests by route, method and status code.", metrics.DefBuckets, "route", "method", "code")
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, accessLog(conf.Log.AccessLog, pattern, instrument(latency, pattern, traced(tracer, pattern, auth.wrap(pattern, h)))))
+	}
 
-		exchange := strings.TrimSpace(req.URL.Query().Get("exchange"))
-		routingKey := strings.TrimSpace(req.URL.Query().Get("routingKey"))
+	// api for get or change the log level at runtime
+	handle("/log/level", auth.admin(logLevel))
 
-		if len(exchange) == 0 {
-			fmt.Fprint(res, "exchange param empty")
-			return
-		}
+	store, err := dedup.Open(conf.Idempotency.File, conf.Idempotency.Capacity, time.Duration(conf.Idempotency.TTL)*time.Millisecond)
+	util.FailOnError(err, "open idempotency store failed")
 
-		if len(routingKey) == 0 {
-			fmt.Fprint(res, "exchange param empty")
+	// api for confirm send message
+	handle("/confirm_send", idempotent(store, &conf, auth, func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			writeError(res, errMethodNotAllowed(res, http.MethodPost, http.MethodPut))
 			return
 		}
 
-		body, err := ioutil.ReadAll(req.Body)
-		req.Body.Close()
-
+		exchange, routingKey, opts, body, err := parsePublishRequest(req, &conf)
 		if err != nil {
-			log.Errorf("read request body failed: %s\n", err)
-			fmt.Fprintf(res, "read body fail: %s", err.Error())
+			writeError(res, err)
 			return
 		}
-		if len(body) == 0 {
-			fmt.Fprint(res, "message body empty")
+		if err := auth.authorize(req, config.OpPublish, resource{exchange: exchange, routingKey: routingKey}); err != nil {
+			writeError(res, err)
 			return
 		}
 
-		err = pool.ConfirmSendMsg(exchange, routingKey, body)
+		// the message is spooled if it's not confirmed in the spool timeout
+		timeout := conf.PublishTimeout
+		if conf.Spool.Enabled() {
+			timeout = conf.Spool.Timeout
+		}
+		ctx, cancel := publishContext(req, timeout)
+		defer cancel()
+
+		err = cop.ConfirmSendMsgContext(ctx, exchange, routingKey, body, opts)
+		if err != nil && conf.Spool.Enabled() && pool.Spoolable(err) && req.Context().Err() == nil {
+			serr := cop.SpoolMsg(&pool.Message{Exchange: exchange, RoutingKey: routingKey, Properties: opts, Body: body})
+			if serr == nil {
+				writeSpooled(res, req)
+				return
+			}
+			log.Error("spool message failed", log.Fields{"exchange": exchange, "routingKey": routingKey, "error": serr, "publishError": err})
+		}
 		if err != nil {
-			fmt.Fprintf(res, "ConfirmSendMsg error: %s", err)
+			writeError(res, err)
 			return
 		}
 		// ok when message is sent
-		fmt.Fprint(res, "OK")
-	})
+		writeOK(res, req, nil)
+	}))
+
+	// api for send message without waiting for the confirm
+	tracker := newAsyncTracker(conf.Async.StatusCapacity)
+	handle("/async_send", idempotent(store, &conf, auth, asyncSend(cop, &conf, auth, tracker)))
+	handle("/async_status/", asyncStatusHandler(tracker, auth))
+
+	// api for confirm send messages in batch
+	handle("/confirm_send_batch", confirmSendBatch(cop, &conf, auth))
+
+	// api for receive messages with basic.get and settle the manual acked messages
+	handle("/get", get(cop, &conf, auth))
+	handle("/ack", settle(cop, auth, pool.SettleAck))
+	handle("/nack", settle(cop, auth, pool.SettleNack))
+	handle("/reject", settle(cop, auth, pool.SettleReject))
+
+	// api for stream the queue messages
+	handle("/consume/sse", consumeSSE(cop, &conf, auth))
+	handle("/consume/ws", consumeWS(cop, &conf, auth))
+
+	// api for manage the exchanges, queues and bindings
+	handle("/exchanges/", exchanges(cop, &conf, auth))
+	handle("/queues/", queues(cop, &conf, auth))
+	handle("/bindings", bindings(cop, &conf, auth))
 
 	s := &http.Server{
 		Addr:           conf.HTTPListenAddr,
@@ -75,9 +123,68 @@ func InitServer(pool *pool.ConnPool) *http.Server {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
+	if conf.HTTPTLS.Enabled() {
+		s.TLSConfig, err = newTLSConfig(&conf.HTTPTLS)
+		util.FailOnError(err, "load http tls files failed")
+		// http/2 is disabled, the streaming apis hijack the connections
+		s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		go func() {
+			log.Error("https server stopped", log.Fields{"error": s.ListenAndServeTLS("", "")})
+		}()
+		return s
+	}
 	go func() {
-		log.Error(s.ListenAndServe())
+		log.Error("http server stopped", log.Fields{"error": s.ListenAndServe()})
 	}()
 
 	return s
 }
+
+// parsePublishRequest parse the exchange and routingKey params, the X-AMQP-* headers and the message body
+func parsePublishRequest(req *http.Request, conf *config.Config) (string, string, *pool.PublishOptions, []byte, error) {
+	exchange := strings.TrimSpace(req.URL.Query().Get("exchange"))
+	routingKey := strings.TrimSpace(req.URL.Query().Get("routingKey"))
+
+	if len(exchange) == 0 {
+		return "", "", nil, nil, newAPIError(http.StatusBadRequest, codeBadRequest, "exchange param empty")
+	}
+
+	if len(routingKey) == 0 {
+		return "", "", nil, nil, newAPIError(http.StatusBadRequest, codeBadRequest, "routingKey param empty")
+	}
+
+	opts, err := parsePublishOptions(req.Header)
+	if err != nil {
+		return "", "", nil, nil, newAPIError(http.StatusBadRequest, codeBadRequest, "%s", err)
+	}
+
+	body, err := readBody(req, conf.MaxBodySize)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	if len(body) == 0 {
+		return "", "", nil, nil, newAPIError(http.StatusBadRequest, codeBadRequest, "message body empty")
+	}
+	return exchange, routingKey, opts, body, nil
+}
+
+// publishContext derive the publish context from the request with the publish timeout in milliseconds
+// the publish is canceled if the client disconnects
+func publishContext(req *http.Request, timeout int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), time.Duration(timeout)*time.Millisecond)
+}
+
+// readBody read the whole request body, at most maxBodySize bytes
+func readBody(req *http.Request, maxBodySize int) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(maxBodySize)+1))
+	req.Body.Close()
+
+	if err != nil {
+		log.Error("read request body failed", log.Fields{"error": err})
+		return nil, newAPIError(http.StatusBadRequest, codeBadRequest, "read body fail: %s", err)
+	}
+	if len(body) > maxBodySize {
+		return nil, newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge, "request body too large, max body size is %d", maxBodySize)
+	}
+	return body, nil
+}
@@ -0,0 +1,126 @@
+package apiserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/dedup"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	// headerIdempotentReplayed is set on the recorded response returned for a repeated request
+	headerIdempotentReplayed = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLen = 255
+)
+
+// responseRecorder records the status and body written by the handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// idempotent wrap the handler, the response of a request with the Idempotency-Key header is recorded,
+// and returned for the repeated requests with the same key without calling the handler again.
+// The key is the message id if the X-AMQP-Message-Id header is not given, so the consumers can dedupe too.
+// The 5xx responses are not recorded, the request can be retried with the same key.
+// The keys are scoped to the identity, and the publish is authorized before the recorded response is returned.
+func idempotent(store *dedup.Store, conf *config.Config, auth *Authenticator, h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(headerIdempotencyKey)
+		if len(key) == 0 {
+			h(res, req)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "%s header longer than %d", headerIdempotencyKey, maxIdempotencyKeyLen))
+			return
+		}
+
+		// the recorded response is only returned to the identity allowed to publish it
+		exchange := strings.TrimSpace(req.URL.Query().Get("exchange"))
+		routingKey := strings.TrimSpace(req.URL.Query().Get("routingKey"))
+		if err := auth.authorize(req, config.OpPublish, resource{exchange: exchange, routingKey: routingKey}); err != nil {
+			writeError(res, err)
+			return
+		}
+
+		// the same key with a different request is a client error
+		body, err := readBody(req, conf.MaxBodySize)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.New()
+		sum.Write([]byte(req.Method + " " + req.URL.Path + "?" + req.URL.RawQuery + "\n"))
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+		// the clients choose the keys, so the same key of the other identities is a different request
+		storeKey := key
+		if id := identityFrom(req.Context()); id != nil {
+			storeKey = id.method + ":" + id.name + "\n" + key
+		}
+
+		result, err := store.Begin(storeKey, fingerprint)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		if result != nil {
+			res.Header().Set(headerIdempotentReplayed, "true")
+			res.Header().Set("Content-Type", result.ContentType)
+			res.WriteHeader(result.Status)
+			res.Write(result.Body)
+			return
+		}
+
+		if req.Header.Get(headerMessageID) == "" {
+			req.Header.Set(headerMessageID, key)
+		}
+
+		rec := &responseRecorder{ResponseWriter: res}
+		defer func() {
+			// release the key if the handler panics, the panic is recovered by the http server
+			if e := recover(); e != nil {
+				store.Abort(storeKey)
+				panic(e)
+			}
+		}()
+		h(rec, req)
+
+		if rec.status == 0 || rec.status >= 500 {
+			store.Abort(storeKey)
+			return
+		}
+		store.Done(storeKey, &dedup.Result{
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package apiserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/dedup"
+	"github.com/iyidan/http-proxy-amqp/metrics"
+)
+
+func TestIdempotentPanicReleasesKey(t *testing.T) {
+	store, _ := dedup.Open("", 10, time.Hour)
+	conf := &config.Config{MaxBodySize: 1024}
+	calls := 0
+	h := idempotent(store, conf, nil, func(res http.ResponseWriter, req *http.Request) {
+		if calls++; calls == 1 {
+			panic("publish")
+		}
+		writeJSON(res, http.StatusOK, &envelope{OK: true})
+	})
+
+	do := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/confirm_send?exchange=orders", nil)
+		req.Header.Set(headerIdempotencyKey, "k1")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("the panic is not propagated")
+			}
+		}()
+		do()
+	}()
+	if code := do(); code != http.StatusOK {
+		t.Fatalf("retry after the panic got %d, expected the key released", code)
+	}
+	if code := do(); code != http.StatusOK || calls != 2 {
+		t.Fatalf("repeat got %d with %d calls, expected the recorded result", code, calls)
+	}
+}
+
+func TestIdempotentScopedToIdentity(t *testing.T) {
+	store, _ := dedup.Open("", 10, time.Hour)
+	conf := &config.Config{MaxBodySize: 1024}
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled: true,
+		ACL: []config.ACLRule{
+			{Identity: "orders", Action: config.ACLAllow, Operations: []string{config.OpPublish}, Exchange: "orders"},
+			{Identity: "billing", Action: config.ACLAllow, Operations: []string{config.OpPublish}, Exchange: "billing"},
+		},
+	}, 1024, metrics.NewRegistry())
+	calls := map[string]int{}
+	h := idempotent(store, conf, auth, func(res http.ResponseWriter, req *http.Request) {
+		name := identityFrom(req.Context()).name
+		calls[name]++
+		res.Write([]byte(name))
+	})
+
+	do := func(name, exchange, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/confirm_send?exchange="+exchange+"&routingKey=k", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &identity{name: name, method: authAPIKey}))
+		req.Header.Set(headerIdempotencyKey, "k1")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	if rec := do("orders", "orders", "m1"); rec.Code != http.StatusOK || calls["orders"] != 1 {
+		t.Fatalf("orders got %d with %d calls", rec.Code, calls["orders"])
+	}
+	// the same key and request of the identity not allowed to publish it
+	if rec := do("billing", "orders", "m1"); rec.Code != http.StatusForbidden || rec.Body.String() == "orders" {
+		t.Fatalf("billing got %d %q, expected forbidden before the replay", rec.Code, rec.Body.String())
+	}
+	// the same key of the other identity is not reused
+	rec := do("billing", "billing", "m2")
+	if rec.Code != http.StatusOK || rec.Body.String() != "billing" || calls["billing"] != 1 {
+		t.Fatalf("billing got %d %q with %d calls, expected a new request", rec.Code, rec.Body.String(), calls["billing"])
+	}
+	rec = do("orders", "orders", "m1")
+	if rec.Code != http.StatusOK || rec.Body.String() != "orders" || rec.Header().Get(headerIdempotentReplayed) != "true" || calls["orders"] != 1 {
+		t.Fatalf("orders repeat got %d %q, expected the recorded response", rec.Code, rec.Body.String())
+	}
+}
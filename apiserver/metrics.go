@@ -0,0 +1,57 @@
+package apiserver
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/metrics"
+)
+
+// statusWriter records the response status, the streaming handlers can still hijack the connection
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	// the streams write their own status line
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return hj.Hijack()
+}
+
+// instrument wrap the handler to observe the request latency by the route pattern, method and status code
+func instrument(latency *metrics.Histogram, pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		w := &statusWriter{ResponseWriter: res}
+		h(w, req)
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		latency.Since(start, pattern, req.Method, strconv.Itoa(w.status))
+	}
+}
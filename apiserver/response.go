@@ -0,0 +1,182 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/dedup"
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+// error codes of the response envelope
+const (
+	codeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	codeBadRequest       = "BAD_REQUEST"
+	codeBodyTooLarge     = "BODY_TOO_LARGE"
+	codeNacked           = "NACKED"
+	codeUnroutable       = "UNROUTABLE"
+	codePoolClosed       = "POOL_CLOSED"
+	codeTooManyConn      = "TOO_MANY_CONNECTIONS"
+	codeTimeout          = "TIMEOUT"
+	codeCanceled         = "CANCELED"
+	codePublishFailed    = "PUBLISH_FAILED"
+	codeUnavailable      = "BROKER_UNAVAILABLE"
+	codeBlocked          = "CONNECTION_BLOCKED"
+	codeLeaseNotFound    = "LEASE_NOT_FOUND"
+	codeUnknownTag       = "UNKNOWN_DELIVERY_TAG"
+	codeNotFound         = "NOT_FOUND"
+	codeAccessRefused    = "ACCESS_REFUSED"
+	codePrecondition     = "PRECONDITION_FAILED"
+	codeChannelError     = "CHANNEL_ERROR"
+	codeChannelClosed    = "CHANNEL_CLOSED"
+	codeInternal         = "INTERNAL_ERROR"
+	codeInProgress       = "IDEMPOTENCY_IN_PROGRESS"
+	codeKeyReused        = "IDEMPOTENCY_KEY_REUSED"
+)
+
+// apiError is a error with the http status and the error code
+type apiError struct {
+	status int
+	code   string
+	msg    string
+	// retryAfter is the seconds of the Retry-After header if greater than 0
+	retryAfter int
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+// newAPIError return a apiError with the formatted message
+func newAPIError(status int, code string, format string, args ...interface{}) *apiError {
+	return &apiError{status: status, code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// toAPIError map the pool errors to the http status and error code
+func toAPIError(err error) *apiError {
+	switch err {
+	case pool.ErrNacked:
+		return &apiError{status: http.StatusBadGateway, code: codeNacked, msg: err.Error()}
+	case pool.ErrUnroutable:
+		return &apiError{status: http.StatusUnprocessableEntity, code: codeUnroutable, msg: err.Error()}
+	case pool.ErrPoolClosed:
+		return &apiError{status: http.StatusServiceUnavailable, code: codePoolClosed, msg: err.Error()}
+	case pool.ErrTooManyConn:
+		return &apiError{status: http.StatusServiceUnavailable, code: codeTooManyConn, msg: err.Error()}
+	case context.DeadlineExceeded:
+		return &apiError{status: http.StatusGatewayTimeout, code: codeTimeout, msg: err.Error()}
+	case pool.ErrLeaseNotFound:
+		return &apiError{status: http.StatusNotFound, code: codeLeaseNotFound, msg: err.Error()}
+	case pool.ErrUnknownDeliveryTag:
+		return &apiError{status: http.StatusBadRequest, code: codeUnknownTag, msg: err.Error()}
+	case context.Canceled:
+		return &apiError{status: http.StatusServiceUnavailable, code: codeCanceled, msg: err.Error()}
+	case dedup.ErrInProgress:
+		return &apiError{status: http.StatusConflict, code: codeInProgress, msg: err.Error()}
+	case dedup.ErrMismatch:
+		return &apiError{status: http.StatusUnprocessableEntity, code: codeKeyReused, msg: err.Error()}
+	}
+	switch e := err.(type) {
+	case *apiError:
+		return e
+	case *pool.ConnError:
+		return &apiError{status: http.StatusServiceUnavailable, code: codeUnavailable, msg: e.Error()}
+	case *pool.BlockedError:
+		return &apiError{status: http.StatusServiceUnavailable, code: codeBlocked, msg: e.Error(), retryAfter: int(e.RetryAfter / time.Second)}
+	case *pool.ArgumentsError:
+		return &apiError{status: http.StatusBadRequest, code: codeBadRequest, msg: e.Error()}
+	case *pool.ChannelClosedError:
+		return &apiError{status: http.StatusBadGateway, code: codeChannelClosed, msg: e.Error()}
+	case *pool.ConfirmTimeoutError:
+		// the same status and code as the ctx error, with the message of the confirm wait
+		a := *toAPIError(e.Err)
+		a.msg = e.Error()
+		return &a
+	case *amqp.Error:
+		// the channel exceptions of the server
+		switch e.Code {
+		case amqp.NotFound:
+			return &apiError{status: http.StatusNotFound, code: codeNotFound, msg: e.Error()}
+		case amqp.AccessRefused:
+			return &apiError{status: http.StatusForbidden, code: codeAccessRefused, msg: e.Error()}
+		case amqp.PreconditionFailed, amqp.ResourceLocked:
+			return &apiError{status: http.StatusConflict, code: codePrecondition, msg: e.Error()}
+		}
+		return &apiError{status: http.StatusBadGateway, code: codeChannelError, msg: e.Error()}
+	}
+	return &apiError{status: http.StatusBadGateway, code: codePublishFailed, msg: err.Error()}
+}
+
+// envelope is the json response body
+type envelope struct {
+	OK    bool        `json:"ok"`
+	Code  string      `json:"code,omitempty"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// wantJSON report whether the client accepts a json response
+// legacy clients get the plain "OK" response when success
+func wantJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json") ||
+		req.URL.Query().Get("format") == "json"
+}
+
+// writeJSON write v as the json response body with the given status
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Error("marshal response failed", log.Fields{"error": err})
+		status = http.StatusInternalServerError
+		data = []byte(`{"ok":false,"code":"INTERNAL_ERROR","error":"marshal response failed"}`)
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(data)
+}
+
+// writeOK write the success response, the plain "OK" for legacy clients
+func writeOK(res http.ResponseWriter, req *http.Request, data interface{}) {
+	if !wantJSON(req) {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(res, "OK")
+		return
+	}
+	writeJSON(res, http.StatusOK, &envelope{OK: true, Data: data})
+}
+
+// writeSpooled write the 202 response of the spooled message, the plain "Spooled" for legacy clients
+func writeSpooled(res http.ResponseWriter, req *http.Request) {
+	setOutcome(res, outcomeSpooled)
+	if !wantJSON(req) {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(res, "Spooled")
+		return
+	}
+	writeJSON(res, http.StatusAccepted, &envelope{OK: true, Data: map[string]bool{"spooled": true}})
+}
+
+// writeError write the error response envelope
+func writeError(res http.ResponseWriter, err error) {
+	e := toAPIError(err)
+	setOutcome(res, e.code)
+	if e.retryAfter > 0 {
+		res.Header().Set("Retry-After", strconv.Itoa(e.retryAfter))
+	}
+	writeJSON(res, e.status, &envelope{OK: false, Code: e.code, Error: e.msg})
+}
+
+// errMethodNotAllowed is the error for the unsupported request method
+func errMethodNotAllowed(res http.ResponseWriter, allowed ...string) error {
+	res.Header().Set("Allow", strings.Join(allowed, ", "))
+	return newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,108 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+func TestToAPIError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{pool.ErrNacked, http.StatusBadGateway, codeNacked},
+		{pool.ErrUnroutable, http.StatusUnprocessableEntity, codeUnroutable},
+		{pool.ErrPoolClosed, http.StatusServiceUnavailable, codePoolClosed},
+		{pool.ErrTooManyConn, http.StatusServiceUnavailable, codeTooManyConn},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, codeTimeout},
+		{context.Canceled, http.StatusServiceUnavailable, codeCanceled},
+		{pool.ErrLeaseNotFound, http.StatusNotFound, codeLeaseNotFound},
+		{pool.ErrUnknownDeliveryTag, http.StatusBadRequest, codeUnknownTag},
+		{&pool.ConnError{Op: "dial", Err: errors.New("connection refused")}, http.StatusServiceUnavailable, codeUnavailable},
+		{&pool.BlockedError{Reason: "low on memory"}, http.StatusServiceUnavailable, codeBlocked},
+		{&pool.ArgumentsError{Err: errors.New("bad")}, http.StatusBadRequest, codeBadRequest},
+		{&pool.ChannelClosedError{}, http.StatusBadGateway, codeChannelClosed},
+		{&pool.ConfirmTimeoutError{Err: context.DeadlineExceeded}, http.StatusGatewayTimeout, codeTimeout},
+		{&amqp.Error{Code: amqp.NotFound}, http.StatusNotFound, codeNotFound},
+		{&amqp.Error{Code: amqp.AccessRefused}, http.StatusForbidden, codeAccessRefused},
+		{&amqp.Error{Code: amqp.PreconditionFailed}, http.StatusConflict, codePrecondition},
+		{&amqp.Error{Code: amqp.ResourceLocked}, http.StatusConflict, codePrecondition},
+		{&amqp.Error{Code: amqp.ChannelError}, http.StatusBadGateway, codeChannelError},
+		{newAPIError(http.StatusBadRequest, codeBadRequest, "exchange param empty"), http.StatusBadRequest, codeBadRequest},
+		{errors.New("unexpected"), http.StatusBadGateway, codePublishFailed},
+	}
+	for _, c := range cases {
+		e := toAPIError(c.err)
+		if e.status != c.status || e.code != c.code || e.msg != c.err.Error() {
+			t.Errorf("toAPIError(%v) = %d %s %q, expected %d %s", c.err, e.status, e.code, e.msg, c.status, c.code)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, pool.ErrNacked)
+	var env envelope
+	if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("Content-Type") != "application/json" ||
+		env.OK || env.Code != codeNacked || env.Error != pool.ErrNacked.Error() {
+		t.Fatalf("got %d %+v", rec.Code, env)
+	}
+	if len(rec.Header().Get("Retry-After")) > 0 {
+		t.Fatal("Retry-After of the error without the retry hint")
+	}
+
+	rec = httptest.NewRecorder()
+	writeError(rec, errMethodNotAllowed(rec, http.MethodPost, http.MethodPut))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST, PUT" {
+		t.Fatalf("got %d with Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	rec = httptest.NewRecorder()
+	writeError(rec, &pool.BlockedError{Reason: "low on memory", RetryAfter: 5 * time.Second})
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "5" {
+		t.Fatalf("got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestWriteOK(t *testing.T) {
+	cases := []struct {
+		url    string
+		accept string
+		json   bool
+	}{
+		{"/confirm_send", "", false},
+		{"/confirm_send", "text/plain", false},
+		{"/confirm_send", "application/json", true},
+		{"/confirm_send", "text/html, application/json;q=0.9", true},
+		{"/confirm_send?format=json", "", true},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, c.url, nil)
+		if len(c.accept) > 0 {
+			req.Header.Set("Accept", c.accept)
+		}
+		rec := httptest.NewRecorder()
+		writeOK(rec, req, nil)
+
+		expected := "OK"
+		if c.json {
+			expected = `{"ok":true}`
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("%s Accept %q: got %d %q, expected %q", c.url, c.accept, rec.Code, rec.Body.String(), expected)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+const (
+	// the default and max prefetch of the streaming consumers
+	defaultStreamPrefetch = 10
+	maxStreamPrefetch     = 1000
+
+	// streamWriteTimeout is the timeout of writing a event to the client
+	streamWriteTimeout = 10 * time.Second
+	// streamPingInterval is the interval of the keepalive events
+	streamPingInterval = 15 * time.Second
+)
+
+// streamParams parse the queue and prefetch params of the streaming consumers
+func streamParams(req *http.Request) (string, int, error) {
+	query := req.URL.Query()
+	queue := strings.TrimSpace(query.Get("queue"))
+	if len(queue) == 0 {
+		return "", 0, newAPIError(http.StatusBadRequest, codeBadRequest, "queue param empty")
+	}
+
+	prefetch := defaultStreamPrefetch
+	if v := query.Get("prefetch"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStreamPrefetch {
+			return "", 0, newAPIError(http.StatusBadRequest, codeBadRequest, "prefetch param must be 1-%d", maxStreamPrefetch)
+		}
+		prefetch = n
+	}
+	return queue, prefetch, nil
+}
+
+// consume start a consumer of the queue, waiting for a free channel in the publish timeout
+func consume(cop *pool.ConnPool, conf *config.Config, req *http.Request, queue string, prefetch int) (*pool.Consumer, error) {
+	ctx, cancel := publishContext(req, conf.PublishTimeout)
+	defer cancel()
+	return cop.Consume(ctx, queue, prefetch, false)
+}
+
+// consumeSSE is the handler of /consume/sse?queue=...&prefetch=N
+// the deliveries are streamed as server-sent events and acked after written to the client,
+// the consumer is canceled when the client disconnects
+func consumeSSE(cop *pool.ConnPool, conf *config.Config, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeError(res, errMethodNotAllowed(res, http.MethodGet))
+			return
+		}
+		queue, prefetch, err := streamParams(req)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		if err := auth.authorize(req, config.OpConsume, resource{queue: queue}); err != nil {
+			writeError(res, err)
+			return
+		}
+
+		// the stream is not limited by the server write timeout, so take over the connection
+		hj, ok := res.(http.Hijacker)
+		if !ok {
+			writeError(res, newAPIError(http.StatusInternalServerError, codeInternal, "streaming unsupported"))
+			return
+		}
+
+		c, err := consume(cop, conf, req, queue, prefetch)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		defer c.Cancel()
+
+		conn, bufrw, err := hj.Hijack()
+		if err != nil {
+			log.Error("consumeSSE: hijack failed", log.Fields{"queue": queue, "error": err})
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Time{})
+
+		// the client never sends after the request, the read returns when it disconnects
+		disconnected := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, conn)
+			close(disconnected)
+		}()
+
+		write := func(format string, args ...interface{}) error {
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			fmt.Fprintf(bufrw, format, args...)
+			return bufrw.Flush()
+		}
+
+		if err := write("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n"); err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(streamPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case d, ok := <-c.Deliveries:
+				if !ok {
+					write("event: close\ndata: consumer closed\n\n")
+					return
+				}
+				data, _ := json.Marshal(pool.NewDelivery(&d))
+				if err := write("id: %d\nevent: message\ndata: %s\n\n", d.DeliveryTag, data); err != nil {
+					// not acked, it's requeued when the consumer canceled
+					return
+				}
+				if err := d.Ack(false); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if err := write(": ping\n\n"); err != nil {
+					return
+				}
+			case <-disconnected:
+				return
+			}
+		}
+	}
+}
+
+// wsFrame is the json frame of /consume/ws
+// server to client: {"type":"message","message":{...}} or {"type":"error","error":"..."}
+// client to server: {"type":"ack|nack|reject","deliveryTag":N,"multiple":false,"requeue":true}
+type wsFrame struct {
+	Type        string         `json:"type"`
+	Message     *pool.Delivery `json:"message,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	DeliveryTag uint64         `json:"deliveryTag,omitempty"`
+	Multiple    bool           `json:"multiple,omitempty"`
+	Requeue     *bool          `json:"requeue,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// consumeWS is the handler of /consume/ws?queue=...&prefetch=N&ack=auto|manual
+// the deliveries are streamed as json text frames, if ack is manual(default),
+// the client settles them with the ack/nack/reject frames,
+// the consumer is canceled and the unsettled deliveries are requeued when the client disconnects
+func consumeWS(cop *pool.ConnPool, conf *config.Config, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeError(res, errMethodNotAllowed(res, http.MethodGet))
+			return
+		}
+		queue, prefetch, err := streamParams(req)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		if err := auth.authorize(req, config.OpConsume, resource{queue: queue}); err != nil {
+			writeError(res, err)
+			return
+		}
+		var autoAck bool
+		switch req.URL.Query().Get("ack") {
+		case "", "manual":
+		case "auto":
+			autoAck = true
+		default:
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "ack param must be auto or manual"))
+			return
+		}
+
+		c, err := consume(cop, conf, req, queue, prefetch)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		defer c.Cancel()
+
+		ws, err := wsUpgrader.Upgrade(res, req, nil)
+		if err != nil {
+			// the upgrader has responded the error
+			log.Error("consumeWS: upgrade failed", log.Fields{"queue": queue, "error": err})
+			return
+		}
+		defer ws.Close()
+
+		s := &wsSession{ws: ws, c: c, pending: make(map[uint64]struct{})}
+		s.serve(autoAck)
+	}
+}
+
+// wsSession is a websocket consumer
+type wsSession struct {
+	ws *websocket.Conn
+	c  *pool.Consumer
+
+	// the unsettled delivery tags, settle a unknown tag closes the channel
+	l       sync.Mutex
+	pending map[uint64]struct{}
+
+	// wl serializes the writers, the reader also writes the error frames
+	wl sync.Mutex
+}
+
+func (s *wsSession) write(frame *wsFrame) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	s.ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return s.ws.WriteJSON(frame)
+}
+
+func (s *wsSession) ping() error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	return s.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+}
+
+// serve write the deliveries until the consumer closed or the client disconnected
+func (s *wsSession) serve(autoAck bool) {
+	disconnected := make(chan struct{})
+	go func() {
+		s.read()
+		close(disconnected)
+	}()
+
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case d, ok := <-s.c.Deliveries:
+			if !ok {
+				s.write(&wsFrame{Type: "error", Error: "consumer closed"})
+				return
+			}
+			if !autoAck {
+				s.l.Lock()
+				s.pending[d.DeliveryTag] = struct{}{}
+				s.l.Unlock()
+			}
+			if err := s.write(&wsFrame{Type: "message", Message: pool.NewDelivery(&d)}); err != nil {
+				return
+			}
+			if autoAck {
+				if err := d.Ack(false); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			if err := s.ping(); err != nil {
+				return
+			}
+		case <-disconnected:
+			return
+		}
+	}
+}
+
+// read handle the settle frames until the client disconnected
+func (s *wsSession) read() {
+	s.ws.SetReadDeadline(time.Now().Add(2 * streamPingInterval))
+	s.ws.SetPongHandler(func(string) error {
+		s.ws.SetReadDeadline(time.Now().Add(2 * streamPingInterval))
+		return nil
+	})
+
+	for {
+		frame := &wsFrame{}
+		if err := s.ws.ReadJSON(frame); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				s.write(&wsFrame{Type: "error", Error: "invalid frame: " + err.Error()})
+				continue
+			}
+			return
+		}
+		s.ws.SetReadDeadline(time.Now().Add(2 * streamPingInterval))
+
+		if err := s.settle(frame); err != nil {
+			s.write(&wsFrame{Type: "error", DeliveryTag: frame.DeliveryTag, Error: err.Error()})
+		}
+	}
+}
+
+// settle ack, nack or reject the deliveries by the client frame
+func (s *wsSession) settle(frame *wsFrame) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if _, ok := s.pending[frame.DeliveryTag]; !ok {
+		return pool.ErrUnknownDeliveryTag
+	}
+	// requeue by default, the same as the amqp clients
+	requeue := frame.Requeue == nil || *frame.Requeue
+
+	var err error
+	multiple := frame.Multiple
+	switch frame.Type {
+	case "ack":
+		err = s.c.Ack(frame.DeliveryTag, multiple)
+	case "nack":
+		err = s.c.Nack(frame.DeliveryTag, multiple, requeue)
+	case "reject":
+		multiple = false
+		err = s.c.Reject(frame.DeliveryTag, requeue)
+	default:
+		return fmt.Errorf("unknown frame type: %q", frame.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	delete(s.pending, frame.DeliveryTag)
+	if multiple {
+		for tag := range s.pending {
+			if tag < frame.DeliveryTag {
+				delete(s.pending, tag)
+			}
+		}
+	}
+	return nil
+}
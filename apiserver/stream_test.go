@@ -0,0 +1,129 @@
+package apiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+func TestStreamParams(t *testing.T) {
+	cases := []struct {
+		url      string
+		queue    string
+		prefetch int
+		ok       bool
+	}{
+		{"/consume/sse?queue=orders", "orders", defaultStreamPrefetch, true},
+		{"/consume/sse?queue=+orders+&prefetch=1000", "orders", 1000, true},
+		{"/consume/sse", "", 0, false},
+		{"/consume/sse?queue=orders&prefetch=0", "", 0, false},
+		{"/consume/sse?queue=orders&prefetch=1001", "", 0, false},
+		{"/consume/sse?queue=orders&prefetch=x", "", 0, false},
+	}
+	for _, c := range cases {
+		queue, prefetch, err := streamParams(httptest.NewRequest(http.MethodGet, c.url, nil))
+		if (err == nil) != c.ok || queue != c.queue || prefetch != c.prefetch {
+			t.Errorf("streamParams(%s) = %q, %d, %v", c.url, queue, prefetch, err)
+		}
+	}
+}
+
+func TestStreamRequestErrors(t *testing.T) {
+	conf := &config.Config{}
+	sse, ws := consumeSSE(nil, conf, nil), consumeWS(nil, conf, nil)
+	cases := []struct {
+		h      http.HandlerFunc
+		method string
+		url    string
+		status int
+	}{
+		{sse, http.MethodPost, "/consume/sse?queue=orders", http.StatusMethodNotAllowed},
+		{sse, http.MethodGet, "/consume/sse?prefetch=1", http.StatusBadRequest},
+		// the recorder can't be hijacked
+		{sse, http.MethodGet, "/consume/sse?queue=orders", http.StatusInternalServerError},
+		{ws, http.MethodPost, "/consume/ws?queue=orders", http.StatusMethodNotAllowed},
+		{ws, http.MethodGet, "/consume/ws?queue=orders&prefetch=0", http.StatusBadRequest},
+		{ws, http.MethodGet, "/consume/ws?queue=orders&ack=none", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		c.h(rec, httptest.NewRequest(c.method, c.url, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s %s: got %d, expected %d", c.method, c.url, rec.Code, c.status)
+		}
+	}
+}
+
+func TestWSSession(t *testing.T) {
+	deliveries := make(chan amqp.Delivery, 1)
+	served := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ws, err := wsUpgrader.Upgrade(res, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		s := &wsSession{ws: ws, c: &pool.Consumer{Queue: "orders", Deliveries: deliveries}, pending: make(map[uint64]struct{})}
+		s.serve(false)
+		close(served)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() *wsFrame {
+		frame := &wsFrame{}
+		if err := ws.ReadJSON(frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	deliveries <- amqp.Delivery{DeliveryTag: 1, Exchange: "orders", RoutingKey: "created", Body: []byte("msg")}
+	if f := read(); f.Type != "message" || f.Message == nil || f.Message.DeliveryTag != 1 || f.Message.Body != "msg" {
+		t.Fatalf("unexpected message frame %+v", f)
+	}
+
+	frames := []struct {
+		send  string
+		error string
+	}{
+		// the unknown tag is not settled, otherwise the channel is closed
+		{`{"type":"ack","deliveryTag":2}`, pool.ErrUnknownDeliveryTag.Error()},
+		{`{"type":"peek","deliveryTag":1}`, `unknown frame type: "peek"`},
+		{`not json`, "invalid frame: "},
+	}
+	for _, c := range frames {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(c.send)); err != nil {
+			t.Fatal(err)
+		}
+		if f := read(); f.Type != "error" || !strings.HasPrefix(f.Error, c.error) {
+			t.Fatalf("%s: unexpected frame %+v, expected the error %q", c.send, f, c.error)
+		}
+	}
+
+	// the consumer closed by the server
+	close(deliveries)
+	if f := read(); f.Type != "error" || f.Error != "consumer closed" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("the session is not done after the consumer closed")
+	}
+}
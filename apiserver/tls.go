@@ -0,0 +1,132 @@
+package apiserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+var errNoClientCA = errors.New("no PEM certificate in the client CA file")
+
+// tlsFiles keeps the certificate and the client CAs loaded from the files,
+// they are replaced when the files are modified, the established connections are not affected
+type tlsFiles struct {
+	c         *config.HTTPTLSConfig
+	cert      atomic.Value
+	clientCAs atomic.Value
+	modTimes  []time.Time
+}
+
+// newTLSConfig return the server tls config of c, the files are checked every c.ReloadInterval
+func newTLSConfig(c *config.HTTPTLSConfig) (*tls.Config, error) {
+	minVersion, err := config.TLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := config.CipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	f := &tlsFiles{c: c}
+	f.modTimes = f.stat()
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		MinVersion:               minVersion,
+		CipherSuites:             suites,
+		PreferServerCipherSuites: true,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return f.cert.Load().(*tls.Certificate), nil
+		},
+	}
+	if len(c.ClientCAFile) > 0 {
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+		if c.ClientAuth == config.ClientAuthOptional {
+			base.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		// the handshakes get the current client CAs
+		base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := base.Clone()
+			cfg.GetConfigForClient = nil
+			cfg.ClientCAs = f.clientCAs.Load().(*x509.CertPool)
+			return cfg, nil
+		}
+	}
+
+	go f.watch(time.Duration(c.ReloadInterval) * time.Millisecond)
+	return base, nil
+}
+
+// files return the paths of the watched files
+func (f *tlsFiles) files() []string {
+	files := []string{f.c.CertFile, f.c.KeyFile}
+	if len(f.c.ClientCAFile) > 0 {
+		files = append(files, f.c.ClientCAFile)
+	}
+	return files
+}
+
+func (f *tlsFiles) stat() []time.Time {
+	files := f.files()
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// load read the certificate and the client CAs, nothing is replaced if any of them is invalid
+func (f *tlsFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(f.c.CertFile, f.c.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if len(f.c.ClientCAFile) > 0 {
+		data, err := ioutil.ReadFile(f.c.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errNoClientCA
+		}
+		f.clientCAs.Store(pool)
+	}
+	f.cert.Store(&cert)
+	return nil
+}
+
+// watch reload the files when any of them is modified
+func (f *tlsFiles) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		modTimes := f.stat()
+		changed := false
+		for i := range modTimes {
+			if !modTimes[i].Equal(f.modTimes[i]) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		f.modTimes = modTimes
+		if err := f.load(); err != nil {
+			// the cert and key files may be written one by one, it's retried on the next modification
+			log.Error("reload tls files failed", log.Fields{"files": f.files(), "error": err})
+			continue
+		}
+		log.Info("tls files reloaded", log.Fields{"files": f.files()})
+	}
+}
@@ -0,0 +1,300 @@
+package apiserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/metrics"
+)
+
+// testCA issues the certificates of the tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue a server certificate of localhost if server is true, otherwise a client certificate,
+// the PEM certificate and key are written to dir/name.crt and dir/name.key
+func (ca *testCA) issue(t *testing.T, dir, name, cn string, server bool) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func (ca *testCA) writeCert(t *testing.T, file string) {
+	writePEM(t, file, "CERTIFICATE", ca.cert.Raw)
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSServer serve the identity of the authenticated requests allowed to publish to the billing exchange
+// with the tls config of c
+func startTLSServer(t *testing.T, c *config.HTTPTLSConfig) *httptest.Server {
+	tc, err := newTLSConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(&config.AuthConfig{
+		Enabled: true,
+		APIKeys: []config.APIKeyCredential{{Name: "billing", Key: "key-1"}},
+		ACL: []config.ACLRule{
+			{Identity: "billing", Action: config.ACLAllow, Exchange: "billing"},
+			{Identity: "cert:orders", Action: config.ACLAllow, Exchange: "billing"},
+		},
+	}, 1024, metrics.NewRegistry())
+	srv := httptest.NewUnstartedServer(auth.wrap("/whoami", func(res http.ResponseWriter, req *http.Request) {
+		if err := auth.authorize(req, config.OpPublish, resource{exchange: "billing"}); err != nil {
+			writeError(res, err)
+			return
+		}
+		res.Write([]byte(identityFrom(req.Context()).name))
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, tc)
+	srv.Start()
+	return srv
+}
+
+// tlsGet request the server with a new connection, the client certificate is presented if certFile is not empty
+func tlsGet(t *testing.T, srv *httptest.Server, caFile, certFile, keyFile, apiKey string) (*http.Response, string, error) {
+	tc := &tls.Config{ServerName: "localhost", RootCAs: x509.NewCertPool()}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.RootCAs.AppendCertsFromPEM(data)
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc, DisableKeepAlives: true}, Timeout: 5 * time.Second}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://"+srv.Listener.Addr().String()+"/whoami", nil)
+	if len(apiKey) > 0 {
+		req.Header.Set(headerAPIKey, apiKey)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res, string(body), nil
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server", "localhost", true)
+	notPEM := filepath.Join(dir, "ca.txt")
+	ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+
+	cases := []struct {
+		name string
+		c    config.HTTPTLSConfig
+	}{
+		{"missing key", config.HTTPTLSConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key"), MinVersion: "1.2"}},
+		{"key of the other cert", config.HTTPTLSConfig{CertFile: certFile, KeyFile: certFile, MinVersion: "1.2"}},
+		{"client CA not PEM", config.HTTPTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: notPEM, MinVersion: "1.2"}},
+		{"bad version", config.HTTPTLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "2.0"}},
+		{"bad cipher suite", config.HTTPTLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2", CipherSuites: []string{"TLS_NONE"}}},
+	}
+	for _, c := range cases {
+		if _, err := newTLSConfig(&c.c); err == nil {
+			t.Errorf("%s: newTLSConfig succeeded", c.name)
+		}
+	}
+
+	tc, err := newTLSConfig(&config.HTTPTLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}, ReloadInterval: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.MinVersion != tls.VersionTLS12 || len(tc.CipherSuites) != 1 || tc.ClientAuth != tls.NoClientCert {
+		t.Fatalf("unexpected tls config: %v %v %v", tc.MinVersion, tc.CipherSuites, tc.ClientAuth)
+	}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	ca.writeCert(t, caFile)
+	certFile, keyFile := ca.issue(t, dir, "server", "localhost", true)
+	clientCert, clientKey := ca.issue(t, dir, "client", "orders", false)
+
+	// the client certificate of the other CA
+	other := newTestCA(t)
+	otherCert, otherKey := other.issue(t, dir, "other", "orders", false)
+
+	c := config.HTTPTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, MinVersion: "1.2", ReloadInterval: 1000}
+
+	c.ClientAuth = config.ClientAuthRequire
+	srv := startTLSServer(t, &c)
+	if _, _, err := tlsGet(t, srv, caFile, "", "", "key-1"); err == nil {
+		t.Fatal("require: the client without certificate connected")
+	}
+	if _, _, err := tlsGet(t, srv, caFile, otherCert, otherKey, ""); err == nil {
+		t.Fatal("require: the certificate of the other CA accepted")
+	}
+	res, body, err := tlsGet(t, srv, caFile, clientCert, clientKey, "")
+	if err != nil || res.StatusCode != http.StatusOK || body != "cert:orders" {
+		t.Fatalf("require: the client certificate got %v %v %q, expected the CN identity", res, err, body)
+	}
+	srv.Close()
+
+	c.ClientAuth = config.ClientAuthOptional
+	srv = startTLSServer(t, &c)
+	defer srv.Close()
+	res, _, err = tlsGet(t, srv, caFile, "", "", "")
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("optional: the client without certificate and credentials got %v %v, expected 401", res, err)
+	}
+	res, body, err = tlsGet(t, srv, caFile, "", "", "key-1")
+	if err != nil || res.StatusCode != http.StatusOK || body != "billing" {
+		t.Fatalf("optional: the api key got %v %v %q", res, err, body)
+	}
+	res, body, err = tlsGet(t, srv, caFile, clientCert, clientKey, "")
+	if err != nil || res.StatusCode != http.StatusOK || body != "cert:orders" {
+		t.Fatalf("optional: the client certificate got %v %v %q, expected the CN identity", res, err, body)
+	}
+	// the credentials take precedence over the certificate
+	res, body, err = tlsGet(t, srv, caFile, clientCert, clientKey, "key-1")
+	if err != nil || body != "billing" {
+		t.Fatalf("optional: the api key with the certificate got %v %v %q", res, err, body)
+	}
+	if _, _, err := tlsGet(t, srv, caFile, otherCert, otherKey, ""); err == nil {
+		t.Fatal("optional: the certificate of the other CA accepted")
+	}
+
+	// the certificate with the name of the api key doesn't get it's rights
+	billingCert, billingKey := ca.issue(t, dir, "billing", "billing", false)
+	res, body, err = tlsGet(t, srv, caFile, billingCert, billingKey, "")
+	if err != nil || res.StatusCode != http.StatusForbidden || !strings.Contains(body, "cert:billing") {
+		t.Fatalf("the certificate of the api key name got %v %v %q, expected forbidden", res, err, body)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	ca.writeCert(t, caFile)
+	certFile, keyFile := ca.issue(t, dir, "server", "localhost", true)
+
+	srv := startTLSServer(t, &config.HTTPTLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2", ReloadInterval: 10})
+	defer srv.Close()
+
+	served := func() string {
+		res, _, err := tlsGet(t, srv, caFile, "", "", "key-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if cn := served(); cn != "localhost" {
+		t.Fatalf("served %q", cn)
+	}
+
+	// a invalid file is not loaded, the current certificate is kept
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	time.Sleep(50 * time.Millisecond)
+	if cn := served(); cn != "localhost" {
+		t.Fatalf("served %q after the invalid key written", cn)
+	}
+
+	// rotate the certificate, the modification times are later than the last check
+	ca.issue(t, dir, "server", "rotated", true)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	for deadline := time.Now().Add(2 * time.Second); served() != "rotated"; {
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated certificate is not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,186 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/pool"
+)
+
+// queueResponse is the response data of the queue apis
+type queueResponse struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Consumers int    `json:"consumers"`
+}
+
+// pathName return the name after the prefix of the request path
+func pathName(req *http.Request, prefix string) (string, error) {
+	name := strings.TrimPrefix(req.URL.Path, prefix)
+	if len(name) == 0 {
+		return "", newAPIError(http.StatusBadRequest, codeBadRequest, "name empty")
+	}
+	return name, nil
+}
+
+// decodeSpec decode the json body into v, a empty body keeps the default values
+func decodeSpec(req *http.Request, conf *config.Config, v interface{}) error {
+	body, err := readBody(req, conf.MaxBodySize)
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		body = []byte("{}")
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return newAPIError(http.StatusBadRequest, codeBadRequest, "invalid json body: %s", err)
+	}
+	return nil
+}
+
+// exchanges is the handler of /exchanges/{name}
+// PUT declare the exchange with the json body, DELETE delete it, ?ifUnused=true keeps it if it has bindings
+func exchanges(cop *pool.ConnPool, conf *config.Config, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+			writeError(res, errMethodNotAllowed(res, http.MethodPut, http.MethodDelete))
+			return
+		}
+		name, err := pathName(req, "/exchanges/")
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		if err := auth.authorize(req, config.OpTopology, resource{exchange: name}); err != nil {
+			writeError(res, err)
+			return
+		}
+
+		ctx, cancel := publishContext(req, conf.PublishTimeout)
+		defer cancel()
+
+		if req.Method == http.MethodDelete {
+			err = cop.DeleteExchange(ctx, name, req.URL.Query().Get("ifUnused") == "true")
+		} else {
+			spec := &config.ExchangeSpec{}
+			if err := decodeSpec(req, conf, spec); err != nil {
+				writeError(res, err)
+				return
+			}
+			spec.Name = name
+			err = cop.DeclareExchange(ctx, spec)
+		}
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, &envelope{OK: true})
+	}
+}
+
+// queues is the handler of /queues/{name}
+// GET passive declare the queue and return the message and consumer counts,
+// PUT declare the queue with the json body,
+// DELETE delete it, ?ifUnused=true keeps it if it has consumers, ?ifEmpty=true keeps it if it has messages
+func queues(cop *pool.ConnPool, conf *config.Config, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodPut && req.Method != http.MethodDelete {
+			writeError(res, errMethodNotAllowed(res, http.MethodGet, http.MethodPut, http.MethodDelete))
+			return
+		}
+		name, err := pathName(req, "/queues/")
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		if err := auth.authorize(req, config.OpTopology, resource{queue: name}); err != nil {
+			writeError(res, err)
+			return
+		}
+
+		ctx, cancel := publishContext(req, conf.PublishTimeout)
+		defer cancel()
+
+		switch req.Method {
+		case http.MethodDelete:
+			query := req.URL.Query()
+			purged, err := cop.DeleteQueue(ctx, name, query.Get("ifUnused") == "true", query.Get("ifEmpty") == "true")
+			if err != nil {
+				writeError(res, err)
+				return
+			}
+			writeJSON(res, http.StatusOK, &envelope{OK: true, Data: map[string]int{"purged": purged}})
+			return
+		case http.MethodGet:
+			q, err := cop.InspectQueue(ctx, name)
+			if err != nil {
+				writeError(res, err)
+				return
+			}
+			writeJSON(res, http.StatusOK, &envelope{OK: true, Data: &queueResponse{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}})
+			return
+		}
+
+		spec := &config.QueueSpec{}
+		if err := decodeSpec(req, conf, spec); err != nil {
+			writeError(res, err)
+			return
+		}
+		spec.Name = name
+		q, err := cop.DeclareQueue(ctx, spec)
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, &envelope{OK: true, Data: &queueResponse{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}})
+	}
+}
+
+// bindings is the handler of /bindings
+// POST bind with the json body, DELETE unbind with the same body
+func bindings(cop *pool.ConnPool, conf *config.Config, auth *Authenticator) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+			writeError(res, errMethodNotAllowed(res, http.MethodPost, http.MethodDelete))
+			return
+		}
+
+		spec := &config.BindingSpec{}
+		if err := decodeSpec(req, conf, spec); err != nil {
+			writeError(res, err)
+			return
+		}
+		if err := config.CheckBinding(spec); err != nil {
+			writeError(res, newAPIError(http.StatusBadRequest, codeBadRequest, "%s", err))
+			return
+		}
+		// both the source exchange and the destination
+		dest := resource{queue: spec.Destination}
+		if spec.DestinationType == config.DestinationExchange {
+			dest = resource{exchange: spec.Destination}
+		}
+		for _, r := range []resource{{exchange: spec.Exchange, routingKey: spec.RoutingKey}, dest} {
+			if err := auth.authorize(req, config.OpTopology, r); err != nil {
+				writeError(res, err)
+				return
+			}
+		}
+
+		ctx, cancel := publishContext(req, conf.PublishTimeout)
+		defer cancel()
+
+		var err error
+		if req.Method == http.MethodDelete {
+			err = cop.Unbind(ctx, spec)
+		} else {
+			err = cop.Bind(ctx, spec)
+		}
+		if err != nil {
+			writeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, &envelope{OK: true})
+	}
+}
@@ -0,0 +1,35 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/iyidan/http-proxy-amqp/trace"
+)
+
+// traced wrap the handler with a server span of the route,
+// the span continues the trace of the traceparent and tracestate request headers,
+// and it's the parent of the pool spans through the request context
+func traced(tracer *trace.Tracer, pattern string, h http.HandlerFunc) http.HandlerFunc {
+	if tracer == nil {
+		return h
+	}
+	return func(res http.ResponseWriter, req *http.Request) {
+		parent, _ := trace.ParseTraceparent(req.Header.Get(trace.HeaderTraceparent), req.Header.Get(trace.HeaderTracestate))
+		ctx, span := tracer.Start(req.Context(), req.Method+" "+pattern, trace.KindServer, parent)
+		defer span.End()
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("http.route", pattern)
+		span.SetAttribute("url.path", req.URL.Path)
+
+		w := &statusWriter{ResponseWriter: res}
+		h(w, req.WithContext(ctx))
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", w.status)
+		if w.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", w.status, http.StatusText(w.status)))
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package config
+
+import "errors"
+
+// AsyncConfig is the results of /async_send
+type AsyncConfig struct {
+	// StatusCapacity is the max results kept for GET /async_status, default is 100000
+	StatusCapacity int `json:"statusCapacity"`
+	// SpoolFailures spool the nacked and unconfirmed messages to retry them, it requires the spool
+	SpoolFailures bool `json:"spoolFailures"`
+}
+
+// checkAsync validate the async config and fill the default values
+func checkAsync(c *AsyncConfig, spool *SpoolConfig) error {
+	if c.StatusCapacity < 0 {
+		return errors.New("async: statusCapacity less than 0")
+	}
+	if c.StatusCapacity == 0 {
+		c.StatusCapacity = 100000
+	}
+	if c.SpoolFailures && !spool.Enabled() {
+		return errors.New("async: spoolFailures requires the spool dir")
+	}
+	return nil
+}
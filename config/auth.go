@@ -0,0 +1,162 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/iyidan/http-proxy-amqp/jsonconf"
+)
+
+// AuthConfig is the authentication of the http api,
+// the credentials are reloaded from the config file without restart
+type AuthConfig struct {
+	// Enabled requires every api request to be authenticated, it's read at start only
+	Enabled bool `json:"enabled"`
+	// APIKeys are sent as the X-API-Key header or the Authorization: Bearer header
+	APIKeys []APIKeyCredential `json:"apiKeys"`
+	// HMACKeys sign the requests with the Authorization: HMAC-SHA256 header
+	HMACKeys []HMACCredential `json:"hmacKeys"`
+	// Users are the HTTP Basic users
+	Users []BasicCredential `json:"users"`
+	// ReplayWindow is the milliseconds a signed request is accepted once around it's timestamp, default is 300000
+	ReplayWindow int `json:"replayWindow"`
+	// PublicRoutes are the routes without authentication, such as /metrics
+	PublicRoutes []string `json:"publicRoutes"`
+	// ReloadInterval is the milliseconds between the checks of the config file modification,
+	// 0 means the credentials are reloaded on SIGHUP only
+	ReloadInterval int `json:"reloadInterval"`
+	// ACL are the authorization rules of the identities, they are reloaded with the credentials.
+	// The first rule matching the identity, operation and resource is applied, the request matching no rule is denied,
+	// and the empty ACL allows all
+	ACL []ACLRule `json:"acl"`
+}
+
+// APIKeyCredential is a static api key, Name is the identity of the requests
+type APIKeyCredential struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// HMACCredential is a signing key, the requests carry the KeyID and are signed with the Secret
+type HMACCredential struct {
+	Name   string `json:"name"`
+	KeyID  string `json:"keyId"`
+	Secret string `json:"secret"`
+}
+
+// BasicCredential is a HTTP Basic user, the User is the identity of the requests
+type BasicCredential struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// CertIdentityPrefix is the prefix of the identities of the client certificates, the identity is cert:$commonName,
+// so a certificate can't assume the identity of a credential with the same name
+const CertIdentityPrefix = "cert:"
+
+// the actions of the acl rules
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// the operations of the acl rules
+const (
+	// OpPublish is /confirm_send, /async_send and /confirm_send_batch
+	OpPublish = "publish"
+	// OpConsume is /get, /ack, /nack, /reject and /consume
+	OpConsume = "consume"
+	// OpTopology is /exchanges, /queues and /bindings
+	OpTopology = "topology"
+	// OpAdmin is /stats, /metrics, /log/level and /async_status of the other identities, it has no names
+	OpAdmin = "admin"
+)
+
+// ACLRule allows or denies the operations of a identity on the exchanges, queues and routing keys,
+// the names are matched by the topic patterns: * matches a word and # matches zero or more words,
+// a empty pattern matches all
+type ACLRule struct {
+	// Identity is the name of the credential, the basic user or cert:$commonName of the client certificate, * matches all
+	Identity string `json:"identity"`
+	// Action is allow or deny
+	Action string `json:"action"`
+	// Operations are publish, consume, topology or admin, empty matches all
+	Operations []string `json:"operations"`
+	Exchange   string   `json:"exchange"`
+	Queue      string   `json:"queue"`
+	RoutingKey string   `json:"routingKey"`
+}
+
+// checkAuth validate the auth config and fill the default values
+func checkAuth(c *AuthConfig) error {
+	for _, k := range c.APIKeys {
+		if len(k.Name) == 0 || len(k.Key) == 0 {
+			return errors.New("auth: api key name or key empty")
+		}
+		if strings.HasPrefix(k.Name, CertIdentityPrefix) {
+			return fmt.Errorf("auth: api key name %s has the certificate prefix %s", k.Name, CertIdentityPrefix)
+		}
+	}
+	keyIDs := make(map[string]bool, len(c.HMACKeys))
+	for _, k := range c.HMACKeys {
+		if len(k.Name) == 0 || len(k.KeyID) == 0 || len(k.Secret) == 0 {
+			return errors.New("auth: hmac key name, keyId or secret empty")
+		}
+		if strings.HasPrefix(k.Name, CertIdentityPrefix) {
+			return fmt.Errorf("auth: hmac key name %s has the certificate prefix %s", k.Name, CertIdentityPrefix)
+		}
+		if keyIDs[k.KeyID] {
+			return fmt.Errorf("auth: duplicate hmac keyId %s", k.KeyID)
+		}
+		keyIDs[k.KeyID] = true
+	}
+	users := make(map[string]bool, len(c.Users))
+	for _, u := range c.Users {
+		if len(u.User) == 0 || len(u.Password) == 0 {
+			return errors.New("auth: user or password empty")
+		}
+		if strings.HasPrefix(u.User, CertIdentityPrefix) {
+			return fmt.Errorf("auth: user %s has the certificate prefix %s", u.User, CertIdentityPrefix)
+		}
+		if users[u.User] {
+			return fmt.Errorf("auth: duplicate user %s", u.User)
+		}
+		users[u.User] = true
+	}
+	for i, r := range c.ACL {
+		if len(r.Identity) == 0 {
+			return fmt.Errorf("auth: acl rule %d identity empty", i)
+		}
+		if r.Action != ACLAllow && r.Action != ACLDeny {
+			return fmt.Errorf("auth: acl rule %d unknown action %q, must be %s or %s", i, r.Action, ACLAllow, ACLDeny)
+		}
+		for _, op := range r.Operations {
+			if op != OpPublish && op != OpConsume && op != OpTopology && op != OpAdmin {
+				return fmt.Errorf("auth: acl rule %d unknown operation %q, must be %s, %s, %s or %s", i, op, OpPublish, OpConsume, OpTopology, OpAdmin)
+			}
+		}
+	}
+	if c.ReplayWindow < 0 || c.ReloadInterval < 0 {
+		return errors.New("auth: replayWindow or reloadInterval less than 0")
+	}
+	if c.ReplayWindow == 0 {
+		c.ReplayWindow = 300000
+	}
+	return nil
+}
+
+// LoadAuth read the auth config from the config file again, so the credentials can be rotated
+func LoadAuth() (*AuthConfig, error) {
+	if len(File()) == 0 {
+		return nil, errors.New("auth: no config file")
+	}
+	cfg := getDefaultConfig()
+	if err := jsonconf.ParseJSONFile(File(), cfg); err != nil {
+		return nil, err
+	}
+	if err := checkAuth(&cfg.Auth); err != nil {
+		return nil, err
+	}
+	return &cfg.Auth, nil
+}
@@ -3,10 +3,12 @@ package config
 import (
 	"errors"
 	"flag"
+	"fmt"
 
 	"path/filepath"
 
 	"github.com/iyidan/http-proxy-amqp/jsonconf"
+	"github.com/iyidan/http-proxy-amqp/log"
 	"github.com/iyidan/http-proxy-amqp/util"
 )
 
@@ -18,33 +20,146 @@ type Config struct {
 	// Notice: user/password must be urlencoded if necessary
 	// Notice: vhost can have a leading slash
 	DSN string `json:"dsn"`
+	// TLS is the client certificate and the server verification of the amqps:// DSN
+	TLS AMQPTLSConfig `json:"tls"`
+	// SASLMechanism is PLAIN(default) with the user and password of the DSN,
+	// or EXTERNAL with the tls client certificate
+	SASLMechanism string `json:"saslMechanism"`
+
+	// Heartbeat is the milliseconds of the heartbeat interval proposed to the server,
+	// less than 1000 uses the server's interval
+	Heartbeat int `json:"heartbeat"`
+	// DialTimeout is the milliseconds of the tcp dial, the TLS and amqp handshakes
+	DialTimeout int `json:"dialTimeout"`
+	// FrameMax is the max frame bytes proposed to the server, 0 uses the server's
+	FrameMax int `json:"frameMax"`
+	// ChannelMax is the max channels per connection proposed to the server, default is MaxChannelsPerConnection.
+	// The channels per connection are limited by the negotiated channel max too
+	ChannelMax int `json:"channelMax"`
+	// Vhost overrides the vhost of the DSN
+	Vhost string `json:"vhost"`
+	// Locale is the locale of the connections
+	Locale string `json:"locale"`
+	// ConnectionName is the connection_name client property shown in the management ui,
+	// the hostname and the pool index of the connection are appended, such as http-proxy-amqp@host1#3,
+	// the index is the lowest one not used by the open connections, so a reconnected connection gets the index again
+	ConnectionName string `json:"connectionName"`
+	// ClientProperties are the extra client properties of the connections
+	ClientProperties map[string]string `json:"clientProperties"`
 
 	MaxChannelsPerConnection int `json:"maxChannelsPerConnection"`
 	MaxIdleChannels          int `json:"maxIdleChannels"`
 	MaxConnections           int `json:"maxConnections"`
 	MinConnections           int `json:"minConnections"`
 
+	// ReconnectInterval is the initial milliseconds between the reconnect attempts
+	// when the server is unreachable, it's doubled per failed attempt up to MaxReconnectInterval
+	ReconnectInterval    int `json:"reconnectInterval"`
+	MaxReconnectInterval int `json:"maxReconnectInterval"`
+
+	// BlockedWaitTimeout is the milliseconds waiting for a connection unblocked
+	// when all the connections are blocked by the server(memory or disk alarm), 0 means fail fast
+	BlockedWaitTimeout int `json:"blockedWaitTimeout"`
+	// BlockedRetryAfter is the seconds of the Retry-After hint when the connections are blocked
+	BlockedRetryAfter int `json:"blockedRetryAfter"`
+
+	// max messages per /get request
+	MaxGetCount int `json:"maxGetCount"`
+	// LeaseTimeout is the milliseconds to settle the manual acked messages received by /get,
+	// the unsettled messages are requeued after it
+	LeaseTimeout int `json:"leaseTimeout"`
+
+	// max messages per /confirm_send_batch request
+	MaxBatchSize int `json:"maxBatchSize"`
+	// max request body bytes of the http api
+	MaxBodySize int `json:"maxBodySize"`
+
+	// PublishTimeout is the milliseconds the http api waits for a free channel and the server confirm
+	PublishTimeout int `json:"publishTimeout"`
+
+	// PublishChannels is the channels shared by the publishes, the confirms are dispatched by the delivery tag,
+	// the unconfirmed publishes of a closed channel all fail with the channel
+	PublishChannels int `json:"publishChannels"`
+	// MaxInFlightPerChannel is the max unconfirmed publishes per shared channel
+	MaxInFlightPerChannel int `json:"maxInFlightPerChannel"`
+
 	// http api listen address
 	HTTPListenAddr string `json:"httpListenAddr"`
+	// HTTPTLS serves the http api with TLS and verifies the client certificates
+	HTTPTLS HTTPTLSConfig `json:"httpTls"`
+
+	// Consumers deliver the queue messages to the http webhooks
+	Consumers []ConsumerConfig `json:"consumers"`
+
+	// Topology is declared when the pool starts and after every reconnect
+	Topology TopologyConfig `json:"topology"`
+
+	// Spool stores the messages on local disk when the server is unreachable
+	Spool SpoolConfig `json:"spool"`
+
+	// Idempotency deduplicates the /confirm_send requests with the same Idempotency-Key header
+	Idempotency IdempotencyConfig `json:"idempotency"`
+
+	// Async is the publisher of /async_send which does not wait for the confirms
+	Async AsyncConfig `json:"async"`
+
+	// Trace is the tracing of the requests with the W3C trace context
+	Trace TraceConfig `json:"trace"`
+
+	// Log is the logging of the process and the access log of the http api
+	Log LogConfig `json:"log"`
+
+	// Auth is the authentication of the http api
+	Auth AuthConfig `json:"auth"`
 
 	Debug bool `json:"debug"`
 }
 
 var (
 	defaultMaxChannelsPerConnection = 20000
+	defaultHeartbeat                = 10000
+	defaultDialTimeout              = 30000
+	defaultLocale                   = "en_US"
+	defaultConnectionName           = "http-proxy-amqp"
 	defaultMaxIdleChannels          = 500
 	defaultMaxConnections           = 2000
 	defaultMinConnections           = 5
+	defaultReconnectInterval        = 500
+	defaultMaxReconnectInterval     = 30000
+	defaultBlockedWaitTimeout       = 0
+	defaultBlockedRetryAfter        = 5
+	defaultMaxGetCount              = 100
+	defaultLeaseTimeout             = 30000
+	defaultMaxBatchSize             = 1000
+	defaultMaxBodySize              = 16 << 20
+	defaultPublishTimeout           = 5000
+	defaultPublishChannels          = 8
+	defaultMaxInFlightPerChannel    = 1000
 	defaultHTTPListenAddr           = "127.0.0.1:35673"
 )
 
 func getDefaultConfig() *Config {
 	return &Config{
-		DSN: "",
+		DSN:                      "",
+		Heartbeat:                defaultHeartbeat,
+		DialTimeout:              defaultDialTimeout,
+		Locale:                   defaultLocale,
+		ConnectionName:           defaultConnectionName,
 		MaxChannelsPerConnection: defaultMaxChannelsPerConnection,
 		MaxIdleChannels:          defaultMaxIdleChannels,
 		MaxConnections:           defaultMaxConnections,
 		MinConnections:           defaultMinConnections,
+		ReconnectInterval:        defaultReconnectInterval,
+		MaxReconnectInterval:     defaultMaxReconnectInterval,
+		BlockedWaitTimeout:       defaultBlockedWaitTimeout,
+		BlockedRetryAfter:        defaultBlockedRetryAfter,
+		MaxGetCount:              defaultMaxGetCount,
+		LeaseTimeout:             defaultLeaseTimeout,
+		MaxBatchSize:             defaultMaxBatchSize,
+		MaxBodySize:              defaultMaxBodySize,
+		PublishTimeout:           defaultPublishTimeout,
+		PublishChannels:          defaultPublishChannels,
+		MaxInFlightPerChannel:    defaultMaxInFlightPerChannel,
 		HTTPListenAddr:           defaultHTTPListenAddr,
 		Debug:                    false,
 	}
@@ -57,8 +172,11 @@ var (
 	flagMaxIdleChannels          = flag.Int("maxIdleChannels", 0, "The max idle channels for this process")
 	flagMaxConnections           = flag.Int("maxConnections", 0, "The max connections for this process")
 	flagMinConnections           = flag.Int("minConnections", 0, "The min connections keeped for this process")
+	flagMaxBatchSize             = flag.Int("maxBatchSize", 0, "The max messages per batch request")
+	flagMaxBodySize              = flag.Int("maxBodySize", 0, "The max request body bytes of the http api")
+	flagPublishTimeout           = flag.Int("publishTimeout", 0, "The milliseconds the http api waits for a free channel and the server confirm")
 	flagHTTPListenAddr           = flag.String("httpListenAddr", "", "http api listen address")
-	flagDebug                    = flag.Bool("debug", false, "if true, will print pool stats per requests")
+	flagDebug                    = flag.Bool("debug", false, "if true, the log level is debug and the pool stats are logged per requests")
 )
 
 // InitConfig init the current process config
@@ -94,6 +212,15 @@ func InitConfig() *Config {
 	if *flagMinConnections > 0 {
 		cfg.MinConnections = *flagMinConnections
 	}
+	if *flagMaxBatchSize > 0 {
+		cfg.MaxBatchSize = *flagMaxBatchSize
+	}
+	if *flagMaxBodySize > 0 {
+		cfg.MaxBodySize = *flagMaxBodySize
+	}
+	if *flagPublishTimeout > 0 {
+		cfg.PublishTimeout = *flagPublishTimeout
+	}
 	if *flagHTTPListenAddr != "" {
 		cfg.HTTPListenAddr = *flagHTTPListenAddr
 	}
@@ -103,9 +230,18 @@ func InitConfig() *Config {
 
 	CheckConfig(cfg)
 
+	err := applyLog(&cfg.Log)
+	util.FailOnError(err, "open log file failed")
+	log.Info("config loaded", log.Fields{"file": *flagCfgFile, "level": cfg.Log.Level})
+
 	return cfg
 }
 
+// File return the path of the config file, empty if it's not given
+func File() string {
+	return *flagCfgFile
+}
+
 // CheckConfig validate the given cfg
 func CheckConfig(cfg *Config) {
 	if cfg.DSN == "" {
@@ -115,10 +251,83 @@ func CheckConfig(cfg *Config) {
 		util.FailOnError(errors.New("config.HTTPListenAddr empty"), "initConfig")
 	}
 
+	if err := checkAMQPTLS(&cfg.TLS, &cfg.SASLMechanism, cfg.DSN); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if cfg.Heartbeat < 0 || cfg.DialTimeout <= 0 || cfg.FrameMax < 0 || cfg.ChannelMax < 0 {
+		util.FailOnError(errors.New("config.Heartbeat/FrameMax/ChannelMax less than 0 or DialTimeout less than 1"), "initConfig")
+	}
+	// the server may negotiate a smaller channel max, the channels per connection are limited by it
+	if cfg.ChannelMax == 0 {
+		cfg.ChannelMax = cfg.MaxChannelsPerConnection
+	}
+	if cfg.ChannelMax > 65535 || cfg.MaxChannelsPerConnection > cfg.ChannelMax {
+		util.FailOnError(errors.New("config.ChannelMax greater than 65535 or less than MaxChannelsPerConnection"), "initConfig")
+	}
+
+	if cfg.ReconnectInterval <= 0 || cfg.MaxReconnectInterval < cfg.ReconnectInterval {
+		util.FailOnError(errors.New("config.ReconnectInterval less than 1 or greater than MaxReconnectInterval"), "initConfig")
+	}
+
+	names := make(map[string]bool, len(cfg.Consumers))
+	for i := range cfg.Consumers {
+		if err := checkConsumer(&cfg.Consumers[i]); err != nil {
+			util.FailOnError(err, "initConfig")
+		}
+		if names[cfg.Consumers[i].Name] {
+			util.FailOnError(fmt.Errorf("consumer %s: duplicate name", cfg.Consumers[i].Name), "initConfig")
+		}
+		names[cfg.Consumers[i].Name] = true
+	}
+
+	if err := checkTopology(&cfg.Topology); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if err := checkSpool(&cfg.Spool, cfg.PublishTimeout); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if err := checkIdempotency(&cfg.Idempotency); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if err := checkAsync(&cfg.Async, &cfg.Spool); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if err := checkTrace(&cfg.Trace); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if err := checkLog(&cfg.Log, cfg.Debug); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if err := checkAuth(&cfg.Auth); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if err := checkHTTPTLS(&cfg.HTTPTLS); err != nil {
+		util.FailOnError(err, "initConfig")
+	}
+
+	if cfg.BlockedWaitTimeout < 0 || cfg.BlockedRetryAfter <= 0 {
+		util.FailOnError(errors.New("config.BlockedWaitTimeout less than 0 or BlockedRetryAfter less than 1"), "initConfig")
+	}
+
 	if cfg.MaxChannelsPerConnection <= 0 ||
 		cfg.MaxConnections <= 0 ||
 		cfg.MaxIdleChannels <= 0 ||
-		cfg.MinConnections <= 0 {
-		util.FailOnError(errors.New("config.MaxChannelsPerConnection/MaxConnections/MaxIdleChannels less than 1"), "initConfig")
+		cfg.MinConnections <= 0 ||
+		cfg.MaxBatchSize <= 0 ||
+		cfg.MaxGetCount <= 0 ||
+		cfg.LeaseTimeout <= 0 ||
+		cfg.MaxBodySize <= 0 ||
+		cfg.PublishTimeout <= 0 ||
+		cfg.PublishChannels <= 0 ||
+		cfg.MaxInFlightPerChannel <= 0 {
+		util.FailOnError(errors.New("config.MaxChannelsPerConnection/MaxConnections/MaxIdleChannels/MinConnections/MaxBatchSize/MaxGetCount/LeaseTimeout/MaxBodySize/PublishTimeout/PublishChannels/MaxInFlightPerChannel less than 1"), "initConfig")
 	}
 }
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// failure policies of the webhook consumer when the retries are exhausted
+const (
+	// OnFailureRequeue nack the message and requeue it
+	OnFailureRequeue = "requeue"
+	// OnFailureDeadLetter nack the message without requeue,
+	// it's dead-lettered if the queue has a dead letter exchange, otherwise it's dropped
+	OnFailureDeadLetter = "dead-letter"
+)
+
+// ConsumerConfig is a consumer which delivers the queue messages to a http webhook
+type ConsumerConfig struct {
+	// Name is the consumer name in stats, default is the queue name
+	Name  string `json:"name"`
+	Queue string `json:"queue"`
+
+	// Prefetch is the basic.qos prefetch count, default is Concurrency
+	Prefetch int `json:"prefetch"`
+	// Concurrency is the number of the concurrent webhook requests, default is 1
+	Concurrency int `json:"concurrency"`
+
+	// URL is the webhook, each message is POSTed as json
+	URL string `json:"url"`
+	// Timeout is the milliseconds of a webhook request, default is 5000
+	Timeout int `json:"timeout"`
+
+	// MaxRetries is the retries after the first failed webhook request
+	MaxRetries int `json:"maxRetries"`
+	// RetryInterval is the initial milliseconds between the retries, doubled per retry, default is 1000
+	RetryInterval int `json:"retryInterval"`
+	// OnFailure is the policy when the retries are exhausted: requeue(default) or dead-letter
+	OnFailure string `json:"onFailure"`
+}
+
+// checkConsumer validate the consumer config and fill the default values
+func checkConsumer(c *ConsumerConfig) error {
+	if c.Queue == "" {
+		return fmt.Errorf("consumer queue empty")
+	}
+	if c.Name == "" {
+		c.Name = c.Queue
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("consumer %s: invalid url: %q", c.Name, c.URL)
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.Prefetch <= 0 {
+		c.Prefetch = c.Concurrency
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5000
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("consumer %s: maxRetries less than 0", c.Name)
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = 1000
+	}
+	switch c.OnFailure {
+	case "":
+		c.OnFailure = OnFailureRequeue
+	case OnFailureRequeue, OnFailureDeadLetter:
+	default:
+		return fmt.Errorf("consumer %s: onFailure must be %s or %s", c.Name, OnFailureRequeue, OnFailureDeadLetter)
+	}
+	return nil
+}
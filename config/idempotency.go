@@ -0,0 +1,27 @@
+package config
+
+import "errors"
+
+// IdempotencyConfig is the store of the Idempotency-Key results of /confirm_send
+type IdempotencyConfig struct {
+	// Capacity is the max keys, the least recently used keys are evicted, default is 100000
+	Capacity int `json:"capacity"`
+	// TTL is the milliseconds a key is kept, default is 24 hours
+	TTL int `json:"ttl"`
+	// File persists the keys across restarts, empty means in-memory only
+	File string `json:"file"`
+}
+
+// checkIdempotency validate the idempotency config and fill the default values
+func checkIdempotency(c *IdempotencyConfig) error {
+	if c.Capacity < 0 || c.TTL < 0 {
+		return errors.New("idempotency: capacity or ttl less than 0")
+	}
+	if c.Capacity == 0 {
+		c.Capacity = 100000
+	}
+	if c.TTL == 0 {
+		c.TTL = 24 * 3600 * 1000
+	}
+	return nil
+}
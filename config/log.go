@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+// LogConfig is the logging of the process and the http api
+type LogConfig struct {
+	// Level is debug, info, warn or error, default is info, it's debug if Debug is true
+	Level string `json:"level"`
+	// Format is json or text, default is json
+	Format string `json:"format"`
+	// File is the log file, default is stderr
+	File string `json:"file"`
+	// AccessLog logs a entry per http api request
+	AccessLog bool `json:"accessLog"`
+	// Payload is how the message bodies are logged: redact, truncate or full, default is redact
+	Payload string `json:"payload"`
+	// PayloadMaxBytes is the max logged bytes of a truncated body, default is 256
+	PayloadMaxBytes int `json:"payloadMaxBytes"`
+}
+
+// checkLog validate the log config and fill the default values
+func checkLog(c *LogConfig, debug bool) error {
+	if len(c.Level) == 0 {
+		c.Level = log.InfoLevel.String()
+		if debug {
+			c.Level = log.DebugLevel.String()
+		}
+	}
+	if _, err := log.ParseLevel(c.Level); err != nil {
+		return err
+	}
+	switch c.Format {
+	case "":
+		c.Format = log.FormatJSON
+	case log.FormatJSON, log.FormatText:
+	default:
+		return fmt.Errorf("log: unknown format %q, must be %s or %s", c.Format, log.FormatJSON, log.FormatText)
+	}
+	switch c.Payload {
+	case "":
+		c.Payload = log.PayloadRedact
+	case log.PayloadRedact, log.PayloadTruncate, log.PayloadFull:
+	default:
+		return fmt.Errorf("log: unknown payload mode %q, must be %s, %s or %s", c.Payload, log.PayloadRedact, log.PayloadTruncate, log.PayloadFull)
+	}
+	if c.PayloadMaxBytes < 0 {
+		return fmt.Errorf("log: payloadMaxBytes less than 0")
+	}
+	if c.PayloadMaxBytes == 0 {
+		c.PayloadMaxBytes = 256
+	}
+	return nil
+}
+
+// applyLog set up the std logger with the checked log config
+func applyLog(c *LogConfig) error {
+	if len(c.File) > 0 {
+		f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	level, _ := log.ParseLevel(c.Level)
+	log.SetLevel(level)
+	log.SetFormat(c.Format)
+	log.SetPayload(c.Payload, c.PayloadMaxBytes)
+	return nil
+}
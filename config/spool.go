@@ -0,0 +1,49 @@
+package config
+
+import "fmt"
+
+// SpoolConfig is the local disk spool of the messages not confirmed in time,
+// they are replayed in order when the server is reachable again
+type SpoolConfig struct {
+	// Dir is the spool directory, empty disables the spool
+	Dir string `json:"dir"`
+	// SegmentSize is the max bytes of a segment file, default is 64MB
+	SegmentSize int `json:"segmentSize"`
+	// MaxSize is the max bytes of the spool, the messages are not spooled when it's full, default is 1GB
+	MaxSize int `json:"maxSize"`
+	// Timeout is the milliseconds waiting for the publish and the confirm, the message not published in time is spooled, default is PublishTimeout
+	Timeout int `json:"timeout"`
+	// MaxAttempts is the nacked or channel closed attempts of a spooled message before it's dropped, default is 10,
+	// the attempts while the server is unreachable are not counted
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+// Enabled return true if the spool directory is set
+func (s *SpoolConfig) Enabled() bool {
+	return len(s.Dir) > 0
+}
+
+// checkSpool validate the spool config and fill the default values
+func checkSpool(s *SpoolConfig, publishTimeout int) error {
+	if !s.Enabled() {
+		return nil
+	}
+	if s.SegmentSize <= 0 {
+		s.SegmentSize = 64 << 20
+	}
+	if s.MaxSize <= 0 {
+		s.MaxSize = 1 << 30
+	}
+	// the committed records of the read segment are on disk until it's removed,
+	// so the spool needs a read segment and a write segment at least
+	if s.MaxSize < 2*s.SegmentSize {
+		return fmt.Errorf("spool: maxSize less than 2 * segmentSize")
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = publishTimeout
+	}
+	if s.MaxAttempts <= 0 {
+		s.MaxAttempts = 10
+	}
+	return nil
+}
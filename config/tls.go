@@ -0,0 +1,185 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the client certificate policies of the http api
+const (
+	// ClientAuthRequire requires a client certificate signed by the client CA
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies the client certificate if it's given,
+	// the clients without certificate authenticate by the credentials
+	ClientAuthOptional = "optional"
+)
+
+// HTTPTLSConfig is the TLS of the http api, the files are reloaded when they are modified
+type HTTPTLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate chain and private key, empty disables the TLS
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile is the PEM CA certificates verifying the client certificates, empty disables the mTLS
+	ClientCAFile string `json:"clientCaFile"`
+	// ClientAuth is require or optional, default is require
+	ClientAuth string `json:"clientAuth"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, default is 1.2
+	MinVersion string `json:"minVersion"`
+	// CipherSuites are the names of the TLS 1.0-1.2 cipher suites, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	// empty means the go defaults
+	CipherSuites []string `json:"cipherSuites"`
+	// ReloadInterval is the milliseconds between the checks of the files modification, default is 10000
+	ReloadInterval int `json:"reloadInterval"`
+}
+
+// Enabled report whether the http api is served with TLS
+func (c *HTTPTLSConfig) Enabled() bool {
+	return len(c.CertFile) > 0
+}
+
+// the SASL mechanisms of the amqp connections
+const (
+	// SASLPlain authenticates by the user and password of the DSN
+	SASLPlain = "PLAIN"
+	// SASLExternal authenticates by the client certificate, the server must enable rabbitmq_auth_mechanism_ssl
+	SASLExternal = "EXTERNAL"
+)
+
+// AMQPTLSConfig is the TLS of the amqps connections, the files are read per dial
+type AMQPTLSConfig struct {
+	// CAFile is the PEM CA bundle verifying the server certificate, empty means the system roots
+	CAFile string `json:"caFile"`
+	// CertFile and KeyFile are the PEM client certificate and private key
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ServerName is the name verified in the server certificate, default is the DSN host
+	ServerName string `json:"serverName"`
+	// InsecureSkipVerify skips the server certificate verification, only for development
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, default is 1.2
+	MinVersion string `json:"minVersion"`
+	// CipherSuites are the names of the TLS 1.0-1.2 cipher suites, empty means the go defaults
+	CipherSuites []string `json:"cipherSuites"`
+}
+
+// versionTLS13 is tls.VersionTLS13 of go1.12
+const versionTLS13 = 0x0304
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": versionTLS13,
+}
+
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// TLSVersion return the tls version of the name, such as 1.2
+func TLSVersion(name string) (uint16, error) {
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version %q, must be 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return v, nil
+}
+
+// CipherSuites return the ids of the cipher suite names, nil if names is empty
+func CipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// checkHTTPTLS validate the http tls config and fill the default values
+func checkHTTPTLS(c *HTTPTLSConfig) error {
+	if (len(c.CertFile) == 0) != (len(c.KeyFile) == 0) {
+		return errors.New("httpTls: certFile and keyFile must be both set")
+	}
+	if len(c.ClientCAFile) > 0 && !c.Enabled() {
+		return errors.New("httpTls: clientCaFile requires certFile and keyFile")
+	}
+	switch c.ClientAuth {
+	case "":
+		c.ClientAuth = ClientAuthRequire
+	case ClientAuthRequire, ClientAuthOptional:
+	default:
+		return fmt.Errorf("httpTls: unknown clientAuth %q, must be %s or %s", c.ClientAuth, ClientAuthRequire, ClientAuthOptional)
+	}
+	if len(c.MinVersion) == 0 {
+		c.MinVersion = "1.2"
+	}
+	if _, err := TLSVersion(c.MinVersion); err != nil {
+		return fmt.Errorf("httpTls: %s", err)
+	}
+	if _, err := CipherSuites(c.CipherSuites); err != nil {
+		return fmt.Errorf("httpTls: %s", err)
+	}
+	if c.ReloadInterval < 0 {
+		return errors.New("httpTls: reloadInterval less than 0")
+	}
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = 10000
+	}
+	return nil
+}
+
+// checkAMQPTLS validate the amqp tls config and the sasl mechanism with the DSN and fill the default values
+func checkAMQPTLS(c *AMQPTLSConfig, mechanism *string, dsn string) error {
+	amqps := strings.HasPrefix(dsn, "amqps://")
+	if !amqps && (len(c.CAFile) > 0 || len(c.CertFile) > 0 || len(c.ServerName) > 0 || c.InsecureSkipVerify) {
+		return errors.New("tls: requires the amqps:// dsn")
+	}
+	if (len(c.CertFile) == 0) != (len(c.KeyFile) == 0) {
+		return errors.New("tls: certFile and keyFile must be both set")
+	}
+	if len(c.MinVersion) == 0 {
+		c.MinVersion = "1.2"
+	}
+	if _, err := TLSVersion(c.MinVersion); err != nil {
+		return fmt.Errorf("tls: %s", err)
+	}
+	if _, err := CipherSuites(c.CipherSuites); err != nil {
+		return fmt.Errorf("tls: %s", err)
+	}
+
+	switch *mechanism {
+	case "":
+		*mechanism = SASLPlain
+	case SASLPlain:
+	case SASLExternal:
+		if !amqps || len(c.CertFile) == 0 {
+			return errors.New("saslMechanism: EXTERNAL requires the amqps:// dsn and the tls client certificate")
+		}
+	default:
+		return fmt.Errorf("saslMechanism: unknown mechanism %q, must be %s or %s", *mechanism, SASLPlain, SASLExternal)
+	}
+	return nil
+}
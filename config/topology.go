@@ -0,0 +1,129 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ExchangeSpec describes a exchange to declare
+type ExchangeSpec struct {
+	Name string `json:"name"`
+	// Type is direct(default), fanout, topic, headers or a plugin type such as x-delayed-message
+	Type       string `json:"type"`
+	Durable    bool   `json:"durable"` // default true
+	AutoDelete bool   `json:"autoDelete"`
+	Internal   bool   `json:"internal"`
+	// Arguments such as alternate-exchange
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler with the default values
+func (s *ExchangeSpec) UnmarshalJSON(data []byte) error {
+	type spec ExchangeSpec
+	v := spec{Type: "direct", Durable: true}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = ExchangeSpec(v)
+	return nil
+}
+
+// QueueSpec describes a queue to declare
+type QueueSpec struct {
+	Name       string `json:"name"`
+	Durable    bool   `json:"durable"` // default true
+	AutoDelete bool   `json:"autoDelete"`
+	Exclusive  bool   `json:"exclusive"`
+	// Arguments such as x-dead-letter-exchange, x-message-ttl, x-max-length, x-queue-type
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler with the default values
+func (s *QueueSpec) UnmarshalJSON(data []byte) error {
+	type spec QueueSpec
+	v := spec{Durable: true}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = QueueSpec(v)
+	return nil
+}
+
+// binding destination types
+const (
+	DestinationQueue    = "queue"
+	DestinationExchange = "exchange"
+)
+
+// BindingSpec describes a binding from the source exchange to the destination queue or exchange
+type BindingSpec struct {
+	Exchange    string `json:"exchange"`
+	Destination string `json:"destination"`
+	// DestinationType is queue(default) or exchange
+	DestinationType string                 `json:"destinationType"`
+	RoutingKey      string                 `json:"routingKey"`
+	Arguments       map[string]interface{} `json:"arguments,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler with the default values
+func (s *BindingSpec) UnmarshalJSON(data []byte) error {
+	type spec BindingSpec
+	v := spec{DestinationType: DestinationQueue}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = BindingSpec(v)
+	return nil
+}
+
+// CheckBinding check the required fields of the binding
+func CheckBinding(spec *BindingSpec) error {
+	if len(spec.Exchange) == 0 {
+		return errors.New("binding exchange empty")
+	}
+	if len(spec.Destination) == 0 {
+		return errors.New("binding destination empty")
+	}
+	if spec.DestinationType != DestinationQueue && spec.DestinationType != DestinationExchange {
+		return fmt.Errorf("binding destinationType must be %s or %s", DestinationQueue, DestinationExchange)
+	}
+	return nil
+}
+
+// TopologyConfig is the exchanges, queues and bindings the proxy declares
+// when the pool starts and after every reconnect
+type TopologyConfig struct {
+	Exchanges []ExchangeSpec `json:"exchanges"`
+	Queues    []QueueSpec    `json:"queues"`
+	Bindings  []BindingSpec  `json:"bindings"`
+
+	// DryRun declares nothing, it only reports the drift between the config and the server
+	DryRun bool `json:"dryRun"`
+}
+
+// Empty return true if there is nothing to declare
+func (t *TopologyConfig) Empty() bool {
+	return len(t.Exchanges) == 0 && len(t.Queues) == 0 && len(t.Bindings) == 0
+}
+
+// checkTopology check the required fields of the topology
+func checkTopology(t *TopologyConfig) error {
+	for i := range t.Exchanges {
+		if len(t.Exchanges[i].Name) == 0 {
+			return fmt.Errorf("topology.exchanges[%d]: name empty", i)
+		}
+	}
+	for i := range t.Queues {
+		// the server named queues are not reusable after reconnect
+		if len(t.Queues[i].Name) == 0 {
+			return fmt.Errorf("topology.queues[%d]: name empty", i)
+		}
+	}
+	for i := range t.Bindings {
+		if err := CheckBinding(&t.Bindings[i]); err != nil {
+			return fmt.Errorf("topology.bindings[%d]: %s", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTopologyDefaults(t *testing.T) {
+	var topo TopologyConfig
+	err := json.Unmarshal([]byte(`{
+		"exchanges": [{"name": "orders"}, {"name": "delayed", "type": "x-delayed-message", "durable": false}],
+		"queues": [{"name": "orders.created", "arguments": {"x-queue-type": "quorum"}}],
+		"bindings": [{"exchange": "orders", "destination": "orders.created", "routingKey": "created"}]
+	}`), &topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := topo.Exchanges[0]; e.Type != "direct" || !e.Durable {
+		t.Fatalf("unexpected exchange defaults %+v", e)
+	}
+	if e := topo.Exchanges[1]; e.Type != "x-delayed-message" || e.Durable {
+		t.Fatalf("the exchange fields given are overridden %+v", e)
+	}
+	if q := topo.Queues[0]; !q.Durable || q.Arguments["x-queue-type"] != "quorum" {
+		t.Fatalf("unexpected queue %+v", q)
+	}
+	if b := topo.Bindings[0]; b.DestinationType != DestinationQueue {
+		t.Fatalf("unexpected binding defaults %+v", b)
+	}
+	if topo.Empty() || !(&TopologyConfig{DryRun: true}).Empty() {
+		t.Fatal("unexpected Empty")
+	}
+	if err := checkTopology(&topo); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckTopology(t *testing.T) {
+	cases := []struct {
+		topo TopologyConfig
+		err  string
+	}{
+		{TopologyConfig{Exchanges: []ExchangeSpec{{Name: "orders"}, {}}}, "topology.exchanges[1]: name empty"},
+		// the server named queues are not reusable after reconnect
+		{TopologyConfig{Queues: []QueueSpec{{}}}, "topology.queues[0]: name empty"},
+		{TopologyConfig{Bindings: []BindingSpec{{Destination: "q", DestinationType: DestinationQueue}}}, "topology.bindings[0]: binding exchange empty"},
+		{TopologyConfig{Bindings: []BindingSpec{{Exchange: "orders", DestinationType: DestinationQueue}}}, "topology.bindings[0]: binding destination empty"},
+		{TopologyConfig{Bindings: []BindingSpec{{Exchange: "orders", Destination: "q", DestinationType: "topic"}}}, "topology.bindings[0]: binding destinationType"},
+	}
+	for _, c := range cases {
+		err := checkTopology(&c.topo)
+		if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("checkTopology(%+v) = %v, expected %q", c.topo, err, c.err)
+		}
+	}
+
+	ok := TopologyConfig{Bindings: []BindingSpec{{Exchange: "orders", Destination: "audit", DestinationType: DestinationExchange}}}
+	if err := checkTopology(&ok); err != nil {
+		t.Fatalf("the exchange destination rejected: %s", err)
+	}
+}
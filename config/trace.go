@@ -0,0 +1,68 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// the exporters of the spans
+const (
+	TraceExporterOTLP = "otlp"
+	TraceExporterFile = "file"
+)
+
+// TraceConfig is the tracing of the requests, the spans are exported in batches
+type TraceConfig struct {
+	// Exporter is otlp or file, empty disables the tracing
+	Exporter string `json:"exporter"`
+	// Endpoint is the OTLP/HTTP traces url, default is http://127.0.0.1:4318/v1/traces
+	Endpoint string `json:"endpoint"`
+	// Headers are the extra http headers of the OTLP requests, such as the auth token
+	Headers map[string]string `json:"headers"`
+	// File is the path of the file exporter, default is stdout
+	File string `json:"file"`
+	// ServiceName is the service.name of the spans, default is http-proxy-amqp
+	ServiceName string `json:"serviceName"`
+	// BatchSize is the max spans of a export, default is 512
+	BatchSize int `json:"batchSize"`
+	// FlushInterval is the milliseconds between the exports, default is 5000
+	FlushInterval int `json:"flushInterval"`
+	// Timeout is the milliseconds of a OTLP request, default is 10000
+	Timeout int `json:"timeout"`
+}
+
+// Enabled report whether the tracing is enabled
+func (t *TraceConfig) Enabled() bool {
+	return len(t.Exporter) > 0
+}
+
+// checkTrace validate the trace config and fill the default values
+func checkTrace(t *TraceConfig) error {
+	switch t.Exporter {
+	case "", TraceExporterOTLP, TraceExporterFile:
+	default:
+		return fmt.Errorf("trace: unknown exporter %q, must be %s or %s", t.Exporter, TraceExporterOTLP, TraceExporterFile)
+	}
+	if t.BatchSize < 0 || t.FlushInterval < 0 || t.Timeout < 0 {
+		return errors.New("trace: batchSize, flushInterval or timeout less than 0")
+	}
+	if len(t.Endpoint) == 0 {
+		t.Endpoint = "http://127.0.0.1:4318/v1/traces"
+	}
+	if len(t.File) == 0 {
+		t.File = "stdout"
+	}
+	if len(t.ServiceName) == 0 {
+		t.ServiceName = "http-proxy-amqp"
+	}
+	if t.BatchSize == 0 {
+		t.BatchSize = 512
+	}
+	if t.FlushInterval == 0 {
+		t.FlushInterval = 5000
+	}
+	if t.Timeout == 0 {
+		t.Timeout = 10000
+	}
+	return nil
+}
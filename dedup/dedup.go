@@ -0,0 +1,251 @@
+// Package dedup records the results of the requests by the idempotency keys,
+// in a bounded in-memory LRU with TTL, optionally persisted to a file.
+package dedup
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+var (
+	// ErrInProgress occured when the request of the same key is not done
+	ErrInProgress = errors.New("dedup: request with the same key in progress")
+	// ErrMismatch occured when the key is reused by a different request
+	ErrMismatch = errors.New("dedup: key reused by a different request")
+)
+
+// Result is the recorded response of a request
+type Result struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+// entry is a key in the LRU, the result is nil if the request is in progress
+type entry struct {
+	Key         string  `json:"key"`
+	Fingerprint string  `json:"fingerprint"`
+	Result      *Result `json:"result"`
+	// Expires is the unix milliseconds
+	Expires int64 `json:"expires"`
+}
+
+// Store is a bounded LRU of the keys, the least recently used keys are evicted when it's full,
+// the keys are expired after the ttl
+type Store struct {
+	capacity int
+	ttl      time.Duration
+
+	l     sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+
+	// file is the append-only log of the done keys, it's compacted when opened
+	// and when it has too many lines
+	path  string
+	file  *os.File
+	lines int
+}
+
+// Open create the store, the done keys are loaded from the file if the path is not empty
+func Open(path string, capacity int, ttl time.Duration) (*Store, error) {
+	s := &Store{
+		capacity: capacity,
+		ttl:      ttl,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		path:     path,
+	}
+	if len(path) == 0 {
+		return s, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load the unexpired keys from the file, the later lines overwrite the earlier ones
+func (s *Store) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := nowMs()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	for sc.Scan() {
+		e := &entry{}
+		// the torn line written before exit
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil || e.Result == nil {
+			continue
+		}
+		if e.Expires <= now {
+			continue
+		}
+		s.put(e)
+	}
+	if err := sc.Err(); err != nil {
+		log.Warn("dedup: read failed", log.Fields{"path": s.path, "error": err})
+	}
+	return nil
+}
+
+// compact rewrite the file with the done keys in the LRU
+func (s *Store) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	lines := 0
+	// from the least recently used, so the order is kept after load
+	for el := s.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if e.Result == nil {
+			continue
+		}
+		data, _ := json.Marshal(e)
+		w.Write(data)
+		w.WriteByte('\n')
+		lines++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	s.lines = lines
+	return err
+}
+
+// put add the entry as the most recently used and evict the least recently used
+// Notice: must be called with s.l locked or before the store is used
+func (s *Store) put(e *entry) {
+	if el, ok := s.items[e.Key]; ok {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.items[e.Key] = s.lru.PushFront(e)
+	for s.lru.Len() > s.capacity {
+		el := s.lru.Back()
+		s.lru.Remove(el)
+		delete(s.items, el.Value.(*entry).Key)
+	}
+}
+
+// Begin reserve the key for the request with the fingerprint,
+// the recorded result is returned if the request of the key is done,
+// ErrInProgress is returned if it's not done, and ErrMismatch if the key is used by a different request.
+// If the result is nil and err is nil, the caller must call Done or Abort after the request.
+func (s *Store) Begin(key string, fingerprint string) (*Result, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*entry)
+		if e.Expires > nowMs() {
+			s.lru.MoveToFront(el)
+			if e.Fingerprint != fingerprint {
+				return nil, ErrMismatch
+			}
+			if e.Result == nil {
+				return nil, ErrInProgress
+			}
+			return e.Result, nil
+		}
+	}
+
+	s.put(&entry{Key: key, Fingerprint: fingerprint, Expires: nowMs() + int64(s.ttl/time.Millisecond)})
+	return nil, nil
+}
+
+// Done record the result of the key, it's returned by Begin until the key expires
+func (s *Store) Done(key string, r *Result) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		// evicted while in progress
+		return
+	}
+	e := el.Value.(*entry)
+	e.Result = r
+
+	if s.file == nil {
+		return
+	}
+	data, _ := json.Marshal(e)
+	data = append(data, '\n')
+	if _, err := s.file.Write(data); err != nil {
+		log.Error("dedup: write failed", log.Fields{"path": s.path, "error": err})
+		return
+	}
+	if s.lines++; s.lines > 2*s.capacity {
+		if err := s.compact(); err != nil {
+			log.Error("dedup: compact failed", log.Fields{"path": s.path, "error": err})
+		}
+	}
+}
+
+// Abort release the key, so the request can be retried with it
+func (s *Store) Abort(key string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if el, ok := s.items[key]; ok && el.Value.(*entry).Result == nil {
+		s.lru.Remove(el)
+		delete(s.items, key)
+	}
+}
+
+// Len return the keys in the store, including the expired ones not evicted yet
+func (s *Store) Len() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.lru.Len()
+}
+
+// Close close the file
+func (s *Store) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
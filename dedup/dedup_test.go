@@ -0,0 +1,166 @@
+package dedup
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "keys")
+}
+
+func countLines(t *testing.T, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		n++
+	}
+	return n
+}
+
+func TestBeginDoneAbort(t *testing.T) {
+	s, err := Open("", 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r, err := s.Begin("k1", "f1"); r != nil || err != nil {
+		t.Fatalf("first Begin = %v, %v", r, err)
+	}
+	if _, err := s.Begin("k1", "f1"); err != ErrInProgress {
+		t.Fatalf("Begin in progress = %v, expected ErrInProgress", err)
+	}
+	s.Done("k1", &Result{Status: 200, ContentType: "text/plain", Body: []byte("OK")})
+	r, err := s.Begin("k1", "f1")
+	if err != nil || r == nil || r.Status != 200 || string(r.Body) != "OK" {
+		t.Fatalf("Begin done = %v, %v, expected the result", r, err)
+	}
+	// Abort does not release the done key
+	s.Abort("k1")
+	if r, _ := s.Begin("k1", "f1"); r == nil {
+		t.Fatal("the done key is released by Abort")
+	}
+
+	s.Begin("k2", "f2")
+	s.Abort("k2")
+	if r, err := s.Begin("k2", "f2"); r != nil || err != nil {
+		t.Fatalf("Begin after Abort = %v, %v, expected the key released", r, err)
+	}
+}
+
+func TestFingerprintMismatch(t *testing.T) {
+	s, _ := Open("", 10, time.Hour)
+	s.Begin("k1", "f1")
+	if _, err := s.Begin("k1", "f2"); err != ErrMismatch {
+		t.Fatalf("Begin in progress with the other fingerprint = %v, expected ErrMismatch", err)
+	}
+	s.Done("k1", &Result{Status: 200})
+	if _, err := s.Begin("k1", "f2"); err != ErrMismatch {
+		t.Fatalf("Begin done with the other fingerprint = %v, expected ErrMismatch", err)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	s, _ := Open("", 2, time.Hour)
+	for _, key := range []string{"k1", "k2"} {
+		s.Begin(key, "f")
+		s.Done(key, &Result{Status: 200})
+	}
+	// k1 is used, so k2 is the least recently used
+	s.Begin("k1", "f")
+	s.Begin("k3", "f")
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d, expected 2", s.Len())
+	}
+	if r, _ := s.Begin("k1", "f"); r == nil {
+		t.Fatal("the recently used key evicted")
+	}
+	if r, err := s.Begin("k2", "f"); r != nil || err != nil {
+		t.Fatalf("Begin evicted key = %v, %v, expected a new request", r, err)
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	s, _ := Open("", 10, 20*time.Millisecond)
+	s.Begin("k1", "f1")
+	s.Done("k1", &Result{Status: 200})
+	time.Sleep(40 * time.Millisecond)
+	// the expired key can be used by a different request
+	if r, err := s.Begin("k1", "f2"); r != nil || err != nil {
+		t.Fatalf("Begin expired key = %v, %v, expected a new request", r, err)
+	}
+}
+
+func TestReloadAndCompact(t *testing.T) {
+	path := tempFile(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s, err := Open(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than 2*capacity lines compacts the file
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		s.Begin(key, "f")
+		s.Done(key, &Result{Status: 200, Body: []byte(key)})
+	}
+	if n := countLines(t, path); n != 2 {
+		t.Fatalf("%d lines after the compaction, expected 2", n)
+	}
+	s.Begin("k6", "f")
+	s.Close()
+
+	s, err = Open(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the in progress key is not persisted
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d after reload, expected 2", s.Len())
+	}
+	for _, key := range []string{"k4", "k5"} {
+		r, err := s.Begin(key, "f")
+		if err != nil || r == nil || string(r.Body) != key {
+			t.Fatalf("Begin %s after reload = %v, %v, expected the result", key, r, err)
+		}
+	}
+	if n := countLines(t, path); n != 2 {
+		t.Fatalf("%d lines after reopen, expected 2", n)
+	}
+}
+
+func TestReloadSkipsExpiredAndTornLines(t *testing.T) {
+	path := tempFile(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s, _ := Open(path, 10, 20*time.Millisecond)
+	s.Begin("k1", "f")
+	s.Done("k1", &Result{Status: 200})
+	s.Close()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"key":"k2","fingerprint":"f","res`)
+	f.Close()
+	time.Sleep(40 * time.Millisecond)
+
+	s, err := Open(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 0 {
+		t.Fatalf("Len = %d, expected the expired and torn lines skipped", s.Len())
+	}
+}
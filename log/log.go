@@ -0,0 +1,293 @@
+// Package log is a leveled structured logger, the entries are written as JSON lines or text lines.
+// The level can be changed at runtime.
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of the entries
+type Level int32
+
+// the levels, the entries below the logger level are discarded
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > FatalLevel {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parse the level name, such as info
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("log: unknown level %q, must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// the formats of the entries
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Fields are the key values of a entry, the errors are written as their messages
+type Fields map[string]interface{}
+
+// output is shared by a logger and it's children created by With
+type output struct {
+	l      sync.Mutex
+	w      io.Writer
+	format string
+	level  int32
+}
+
+// Logger writes the entries with the fixed fields
+type Logger struct {
+	out    *output
+	fields Fields
+}
+
+// New create a logger writes to w in the format
+func New(w io.Writer, format string, level Level) *Logger {
+	return &Logger{out: &output{w: w, format: format, level: int32(level)}}
+}
+
+// With return a child logger with the fields added to every entry,
+// the child shares the output and level of the logger
+func (lg *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(lg.fields)+len(fields))
+	for k, v := range lg.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{out: lg.out, fields: merged}
+}
+
+// SetLevel change the level of the logger and it's children
+func (lg *Logger) SetLevel(l Level) {
+	atomic.StoreInt32(&lg.out.level, int32(l))
+}
+
+// GetLevel return the level of the logger
+func (lg *Logger) GetLevel() Level {
+	return Level(atomic.LoadInt32(&lg.out.level))
+}
+
+// Enabled report whether the entries of the level are written
+func (lg *Logger) Enabled(l Level) bool {
+	return l >= lg.GetLevel()
+}
+
+// SetOutput change the writer of the logger and it's children
+func (lg *Logger) SetOutput(w io.Writer) {
+	lg.out.l.Lock()
+	lg.out.w = w
+	lg.out.l.Unlock()
+}
+
+// SetFormat change the format of the logger and it's children, json or text
+func (lg *Logger) SetFormat(format string) {
+	lg.out.l.Lock()
+	lg.out.format = format
+	lg.out.l.Unlock()
+}
+
+// Debug write a debug entry
+func (lg *Logger) Debug(msg string, fields ...Fields) {
+	lg.log(DebugLevel, msg, fields)
+}
+
+// Info write a info entry
+func (lg *Logger) Info(msg string, fields ...Fields) {
+	lg.log(InfoLevel, msg, fields)
+}
+
+// Warn write a warn entry
+func (lg *Logger) Warn(msg string, fields ...Fields) {
+	lg.log(WarnLevel, msg, fields)
+}
+
+// Error write a error entry
+func (lg *Logger) Error(msg string, fields ...Fields) {
+	lg.log(ErrorLevel, msg, fields)
+}
+
+// Fatal write a fatal entry and exit the process
+func (lg *Logger) Fatal(msg string, fields ...Fields) {
+	lg.log(FatalLevel, msg, fields)
+	os.Exit(1)
+}
+
+func (lg *Logger) log(level Level, msg string, fields []Fields) {
+	if !lg.Enabled(level) {
+		return
+	}
+
+	all := lg.fields
+	if len(fields) > 0 {
+		all = make(Fields, len(lg.fields)+len(fields[0]))
+		for k, v := range lg.fields {
+			all[k] = v
+		}
+		for _, fs := range fields {
+			for k, v := range fs {
+				all[k] = v
+			}
+		}
+	}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lg.out.l.Lock()
+	defer lg.out.l.Unlock()
+
+	var buf bytes.Buffer
+	now := time.Now().Format(time.RFC3339Nano)
+	if lg.out.format == FormatText {
+		fmt.Fprintf(&buf, "%s %s %s", now, strings.ToUpper(level.String()), msg)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=%s", k, textValue(all[k]))
+		}
+	} else {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for _, k := range keys {
+			buf.WriteByte(',')
+			writeJSON(&buf, k)
+			buf.WriteByte(':')
+			writeJSON(&buf, value(all[k]))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+	lg.out.w.Write(buf.Bytes())
+}
+
+// value convert the errors and stringers to strings, the durations to milliseconds
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Duration:
+		return float64(v) / float64(time.Millisecond)
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// textValue quote the string values with spaces or quotes
+func textValue(v interface{}) string {
+	s := fmt.Sprint(value(v))
+	if strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// std is the logger of the package functions
+var std = New(os.Stderr, FormatJSON, InfoLevel)
+
+// Std return the logger of the package functions
+func Std() *Logger {
+	return std
+}
+
+// With return a child logger of the std logger with the fields
+func With(fields Fields) *Logger {
+	return std.With(fields)
+}
+
+// SetLevel change the level of the std logger
+func SetLevel(l Level) {
+	std.SetLevel(l)
+}
+
+// GetLevel return the level of the std logger
+func GetLevel() Level {
+	return std.GetLevel()
+}
+
+// Enabled report whether the entries of the level are written by the std logger
+func Enabled(l Level) bool {
+	return std.Enabled(l)
+}
+
+// SetOutput change the writer of the std logger
+func SetOutput(w io.Writer) {
+	std.SetOutput(w)
+}
+
+// SetFormat change the format of the std logger
+func SetFormat(format string) {
+	std.SetFormat(format)
+}
+
+// Debug write a debug entry with the std logger
+func Debug(msg string, fields ...Fields) {
+	std.log(DebugLevel, msg, fields)
+}
+
+// Info write a info entry with the std logger
+func Info(msg string, fields ...Fields) {
+	std.log(InfoLevel, msg, fields)
+}
+
+// Warn write a warn entry with the std logger
+func Warn(msg string, fields ...Fields) {
+	std.log(WarnLevel, msg, fields)
+}
+
+// Error write a error entry with the std logger
+func Error(msg string, fields ...Fields) {
+	std.log(ErrorLevel, msg, fields)
+}
+
+// Fatal write a fatal entry with the std logger and exit the process
+func Fatal(msg string, fields ...Fields) {
+	std.log(FatalLevel, msg, fields)
+	os.Exit(1)
+}
@@ -0,0 +1,50 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJSONEntry(t *testing.T) {
+	var buf bytes.Buffer
+	lg := New(&buf, FormatJSON, InfoLevel).With(Fields{"component": "pool"})
+
+	lg.Debug("not written")
+	lg.Warn("publish failed", Fields{"error": errors.New("nacked"), "latencyMs": 1500 * time.Microsecond})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("decode %q: %s", buf.String(), err)
+	}
+	if entry["level"] != "warn" || entry["msg"] != "publish failed" || entry["component"] != "pool" ||
+		entry["error"] != "nacked" || entry["latencyMs"] != 1.5 {
+		t.Fatalf("unexpected entry: %s", buf.String())
+	}
+
+	// the children share the level
+	buf.Reset()
+	lg.SetLevel(DebugLevel)
+	lg.Debug("written")
+	if buf.Len() == 0 {
+		t.Fatal("debug entry not written after the level changed")
+	}
+}
+
+func TestPayload(t *testing.T) {
+	defer SetPayload(PayloadRedact, 256)
+
+	if v := Payload([]byte("secret")); v != "[redacted 6 bytes]" {
+		t.Fatalf("unexpected redacted payload: %v", v)
+	}
+	// not cut in the middle of é
+	SetPayload(PayloadTruncate, 2)
+	if v := Payload([]byte("héllo world")); v != "h...[12 bytes]" {
+		t.Fatalf("unexpected truncated payload: %v", v)
+	}
+	if v := Payload([]byte{0xff, 0x01}); v != "ff01" {
+		t.Fatalf("unexpected binary payload: %v", v)
+	}
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// the modes of logging the message bodies
+const (
+	// PayloadRedact logs the size only
+	PayloadRedact = "redact"
+	// PayloadTruncate logs at most the max bytes
+	PayloadTruncate = "truncate"
+	// PayloadFull logs the whole body
+	PayloadFull = "full"
+)
+
+type payloadConfig struct {
+	mode     string
+	maxBytes int
+}
+
+var payload atomic.Value
+
+func init() {
+	payload.Store(payloadConfig{mode: PayloadRedact, maxBytes: 256})
+}
+
+// SetPayload change the mode of logging the message bodies, maxBytes is used by PayloadTruncate
+func SetPayload(mode string, maxBytes int) {
+	payload.Store(payloadConfig{mode: mode, maxBytes: maxBytes})
+}
+
+// Payload return the field value of the message body by the payload mode,
+// the binary body is hex encoded
+func Payload(data []byte) interface{} {
+	c := payload.Load().(payloadConfig)
+	switch c.mode {
+	case PayloadFull:
+		return payloadString(data)
+	case PayloadTruncate:
+		if len(data) <= c.maxBytes {
+			return payloadString(data)
+		}
+		// not cut in the middle of a rune
+		n := c.maxBytes
+		for n > 0 && n < len(data) && !utf8.RuneStart(data[n]) {
+			n--
+		}
+		return fmt.Sprintf("%s...[%d bytes]", payloadString(data[:n]), len(data))
+	}
+	return fmt.Sprintf("[redacted %d bytes]", len(data))
+}
+
+func payloadString(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return hex.EncodeToString(data)
+}
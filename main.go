@@ -16,8 +16,11 @@ import (
 
 	"github.com/iyidan/http-proxy-amqp/apiserver"
 	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
 	"github.com/iyidan/http-proxy-amqp/pool"
-	"github.com/ngaut/log"
+	"github.com/iyidan/http-proxy-amqp/spool"
+	"github.com/iyidan/http-proxy-amqp/trace"
+	"github.com/iyidan/http-proxy-amqp/util"
 )
 
 // VERSION program version
@@ -33,7 +36,6 @@ func main() {
 	signal.Notify(sc,
 		os.Kill,
 		os.Interrupt,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
@@ -47,22 +49,103 @@ func main() {
 
 	conf := config.InitConfig()
 	connPool := pool.NewPool(conf)
+	connPool.ApplyTopology()
+	connPool.StartConsumers()
+
+	var sp *spool.Spool
+	if conf.Spool.Enabled() {
+		var err error
+		sp, err = spool.Open(conf.Spool.Dir, int64(conf.Spool.SegmentSize), int64(conf.Spool.MaxSize))
+		util.FailOnError(err, "open spool failed")
+		connPool.StartSpool(sp)
+	}
+
+	var tracer *trace.Tracer
+	if conf.Trace.Enabled() {
+		tracer = newTracer(&conf.Trace)
+	}
+
+	auth := apiserver.NewAuthenticator(&conf.Auth, conf.MaxBodySize, connPool.Metrics())
+	if conf.Auth.Enabled {
+		// SIGHUP reloads the credentials instead of exiting
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go reloadAuth(auth, hup, time.Duration(conf.Auth.ReloadInterval)*time.Millisecond)
+	}
 
-	srv := apiserver.InitServer(connPool)
-	log.Infof("server started\n with conf: %#v\n", *conf)
+	srv := apiserver.InitServer(connPool, tracer, auth)
+	log.Info("server started", log.Fields{"version": VERSION, "addr": conf.HTTPListenAddr})
 
 	s := <-sc
-	log.Errorf("main: received signal: %v\n", s)
+	log.Warn("main: received signal", log.Fields{"signal": s})
 
 	// graceful shutdown server
 	timeout := time.Second * 3
 	ctx, cancelf := context.WithTimeout(context.Background(), timeout)
 	defer cancelf()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Errorf("Shutdown server error: %s\n", ctx.Err())
+		log.Error("shutdown server failed", log.Fields{"error": err})
 	}
 
 	// close pool
 	connPool.CloseAll()
 	log.Info("connPool closed")
+
+	if sp != nil {
+		sp.Close()
+	}
+
+	// export the left spans
+	tracer.Close()
+}
+
+// newTracer create the tracer with the exporter of the config
+func newTracer(c *config.TraceConfig) *trace.Tracer {
+	var exporter trace.Exporter
+	switch c.Exporter {
+	case config.TraceExporterOTLP:
+		exporter = trace.NewOTLPExporter(c.Endpoint, c.Headers, time.Duration(c.Timeout)*time.Millisecond)
+	case config.TraceExporterFile:
+		fe, err := trace.NewFileExporter(c.File)
+		util.FailOnError(err, "open trace file failed")
+		exporter = fe
+	}
+	return trace.NewTracer(c.ServiceName, exporter, c.BatchSize, time.Duration(c.FlushInterval)*time.Millisecond)
+}
+
+// reloadAuth reload the credentials from the config file on SIGHUP,
+// or when the file is modified if the interval is greater than 0
+func reloadAuth(auth *apiserver.Authenticator, hup <-chan os.Signal, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	modTime := func() time.Time {
+		fi, err := os.Stat(config.File())
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+
+	last := modTime()
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			mt := modTime()
+			if mt.Equal(last) {
+				continue
+			}
+			last = mt
+		}
+		c, err := config.LoadAuth()
+		if err != nil {
+			log.Error("reload credentials failed", log.Fields{"file": config.File(), "error": err})
+			continue
+		}
+		auth.Update(c)
+		log.Info("credentials reloaded", log.Fields{"file": config.File(),
+			"apiKeys": len(c.APIKeys), "hmacKeys": len(c.HMACKeys), "users": len(c.Users)})
+	}
 }
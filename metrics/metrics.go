@@ -0,0 +1,305 @@
+// Package metrics is a minimal registry of counters, gauges and histograms,
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are the default histogram buckets in seconds, from 1ms to 10s
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a metric family written by the registry
+type metric interface {
+	describe() *desc
+	write(buf *bytes.Buffer)
+}
+
+// desc is the name, help and label names of a metric family
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) describe() *desc {
+	return d
+}
+
+func (d *desc) writeHeader(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key join the label values as a map key, panic if the count does not match the label names
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Registry is a set of metrics, it's a http.Handler serving them in the text format
+type Registry struct {
+	l       sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// NewRegistry return a empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register add the metric, panic if the name is registered
+func (r *Registry) register(m metric) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	name := m.describe().name
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo write the metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.l.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.l.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serve the metrics
+func (r *Registry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(res)
+}
+
+// Counter is a monotonically increasing value per label values
+type Counter struct {
+	*desc
+
+	l      sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      float64
+}
+
+// NewCounter register a counter with the label names
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   &desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]*counterValue),
+	}
+	r.register(c)
+	return c
+}
+
+// Add add v to the counter of the label values, v must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.l.Lock()
+	defer c.l.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: append([]string(nil), labelValues...)}
+		c.values[key] = cv
+	}
+	cv.v += v
+}
+
+// Inc add 1 to the counter of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(buf *bytes.Buffer) {
+	c.writeHeader(buf)
+	c.l.Lock()
+	defer c.l.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		cv := c.values[key]
+		writeSample(buf, c.name, c.labels, cv.labels, "", "", cv.v)
+	}
+}
+
+// GaugeFunc is a gauge without labels, the value is read by the function when collected
+type GaugeFunc struct {
+	*desc
+	fn func() float64
+}
+
+// NewGaugeFunc register a gauge read by fn, fn must be safe for concurrent use
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: &desc{name: name, help: help, typ: "gauge"},
+		fn:   fn,
+	}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(buf *bytes.Buffer) {
+	g.writeHeader(buf)
+	writeSample(buf, g.name, nil, nil, "", "", g.fn())
+}
+
+// Histogram counts the observations in the buckets per label values
+type Histogram struct {
+	*desc
+	buckets []float64
+
+	l      sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	// counts[i] is the observations in (buckets[i-1], buckets[i]], the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram register a histogram with the upper bounds of the buckets in ascending order
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: buckets of " + name + " not sorted")
+	}
+	h := &Histogram{
+		desc:    &desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe add a observation to the histogram of the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.l.Lock()
+	defer h.l.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)+1),
+		}
+		h.values[key] = hv
+	}
+	hv.counts[i]++
+	hv.sum += v
+	hv.count++
+}
+
+// Since observe the seconds elapsed since start
+func (h *Histogram) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.writeHeader(buf)
+	h.l.Lock()
+	defer h.l.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hv.counts[i]
+			writeSample(buf, h.name+"_bucket", h.labels, hv.labels, "le", formatFloat(le), float64(cumulative))
+		}
+		writeSample(buf, h.name+"_bucket", h.labels, hv.labels, "le", "+Inf", float64(hv.count))
+		writeSample(buf, h.name+"_sum", h.labels, hv.labels, "", "", hv.sum)
+		writeSample(buf, h.name+"_count", h.labels, hv.labels, "", "", float64(hv.count))
+	}
+}
+
+// writeSample write a line of name{labels} value, the extra label is appended if it's not empty
+func writeSample(buf *bytes.Buffer, name string, labels []string, values []string, extra string, extraValue string, v float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || len(extra) > 0 {
+		buf.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+		if len(extra) > 0 {
+			if len(labels) > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", extra, extraValue)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(v))
+	buf.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// sortedKeys return the keys of the values in ascending order, so the output is stable
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*counterValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTextFormat(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("publishes_total", "The publishes.", "exchange", "result")
+	h := r.NewHistogram("latency_seconds", "The latency.", []float64{0.1, 1})
+	r.NewGaugeFunc("connections", "The connections.", func() float64 { return 3 })
+
+	c.Inc("ex\"1", "ack")
+	c.Add(2, "ex\"1", "ack")
+	c.Inc("a", "nack")
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+
+	expected := `# HELP publishes_total The publishes.
+# TYPE publishes_total counter
+publishes_total{exchange="a",result="nack"} 1
+publishes_total{exchange="ex\"1",result="ack"} 3
+# HELP latency_seconds The latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.6
+latency_seconds_count 3
+# HELP connections The connections.
+# TYPE connections gauge
+connections 3
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
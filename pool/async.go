@@ -0,0 +1,37 @@
+package pool
+
+import (
+	"context"
+
+	"github.com/iyidan/http-proxy-amqp/trace"
+)
+
+// AsyncCallback is called with the confirm result of a async publish:
+// nil if acked, ErrUnroutable if returned, ErrNacked if nacked, *ChannelClosedError if the channel closed before the confirm.
+// It's called in the dispatcher goroutine of the channel, so it must not block.
+type AsyncCallback func(err error)
+
+// PublishAsync publish a mandatory message without waiting for the confirm,
+// it returns after the message is written to the connection,
+// waiting for a free channel or in-flight slot until ctx is done.
+// The callback is called once with the confirm result if PublishAsync returns nil.
+func (cop *ConnPool) PublishAsync(ctx context.Context, exchange string, routingKey string, data []byte, opts *PublishOptions, cb AsyncCallback) error {
+	ctx, span := startPublishSpan(ctx, spanPublish, exchange, routingKey)
+	defer span.End()
+	msg := opts.publishing(data)
+	injectTrace(&msg, span.Context())
+
+	// the confirm is waited after the request span ended, but it's still a child of the publish
+	_, wait := trace.StartSpan(ctx, spanConfirmWait, trace.KindInternal)
+	done := func(err error) {
+		wait.SetError(err)
+		wait.End()
+		if cb != nil {
+			cb(err)
+		}
+	}
+
+	_, err := cop.publisher.send(ctx, exchange, routingKey, msg, done)
+	span.SetError(err)
+	return err
+}
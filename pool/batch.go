@@ -0,0 +1,91 @@
+package pool
+
+import (
+	"context"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/trace"
+)
+
+// ConfirmSendBatch publish the messages on a single shared channel with confirm mode
+// and wait for all the confirms by the delivery tag.
+// The returned errs has the same length as msgs, errs[i] is nil if msgs[i] is acked,
+// ErrUnroutable if it's returned, ErrNacked if it's nacked, *ChannelClosedError if the channel closed before the confirm,
+// or the publish error.
+func (cop *ConnPool) ConfirmSendBatch(msgs []*Message) ([]error, error) {
+	return cop.ConfirmSendBatchContext(context.Background(), msgs)
+}
+
+// ConfirmSendBatchContext is ConfirmSendBatch waiting for a free channel and the confirms until ctx is done,
+// the unconfirmed messages get *ConfirmTimeoutError
+func (cop *ConnPool) ConfirmSendBatchContext(ctx context.Context, msgs []*Message) ([]error, error) {
+	errs := make([]error, len(msgs))
+	if len(msgs) == 0 {
+		return errs, nil
+	}
+
+	ctx, span := startPublishSpan(ctx, spanPublishBatch, msgs[0].Exchange, "")
+	span.SetAttribute("messaging.batch.message_count", len(msgs))
+	defer span.End()
+
+	acq := startAcquisition(ctx)
+	sc, cha, err := cop.publisher.acquire(ctx)
+	if err != nil {
+		acq.done(cop.metrics, err)
+		span.SetError(err)
+		for _, msg := range msgs {
+			cop.metrics.publish(msg.Exchange, resultError)
+		}
+		return nil, err
+	}
+
+	published := make([]*pendingPublish, len(msgs))
+
+	var publishErr error
+	for i, msg := range msgs {
+		// the channel is broken after a publish error, fail the left messages
+		if publishErr != nil {
+			errs[i] = publishErr
+			cop.metrics.publish(msg.Exchange, resultError)
+			continue
+		}
+		// the later messages wait for the in-flight slots only
+		if i > 0 {
+			acq = acquisition{start: time.Now()}
+		}
+		// the missing exchange fails the message only, not the shared channel
+		if err := cop.publisher.checkExchange(ctx, msg.Exchange); err != nil {
+			errs[i] = err
+			cop.metrics.publish(msg.Exchange, resultError)
+			continue
+		}
+		pub := msg.Properties.publishing(msg.Body)
+		injectTrace(&pub, span.Context())
+		p, err := sc.publish(ctx, cha, acq, msg.Exchange, msg.RoutingKey, pub, nil)
+		if err != nil {
+			span.SetError(err)
+			publishErr = err
+			if isChannelClosed(err) {
+				publishErr = channelClosedError(err)
+			}
+			errs[i] = publishErr
+			continue
+		}
+		published[i] = p
+	}
+
+	// waiting for the server confirms, the unconfirmed messages get *ConfirmTimeoutError
+	_, wait := trace.StartSpan(ctx, spanConfirmWait, trace.KindInternal)
+	defer wait.End()
+	for i, p := range published {
+		if p == nil {
+			continue
+		}
+		if !p.wait(ctx.Done()) {
+			errs[i] = &ConfirmTimeoutError{Err: ctx.Err()}
+			continue
+		}
+		errs[i] = p.err
+	}
+	return errs, nil
+}
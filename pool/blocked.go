@@ -0,0 +1,62 @@
+package pool
+
+import (
+	"context"
+	"time"
+)
+
+// BlockedError occured when all the connections are blocked by the server(connection.blocked),
+// usually because the server raised a memory or disk alarm
+type BlockedError struct {
+	Reason string
+	// RetryAfter is the hint for the client to retry
+	RetryAfter time.Duration
+}
+
+func (e *BlockedError) Error() string {
+	return "pool: connection blocked: " + e.Reason
+}
+
+// blockedError return the BlockedError with the first blocked connection reason
+// Notice: must be called with cop.l locked
+func (cop *ConnPool) blockedError() *BlockedError {
+	e := &BlockedError{RetryAfter: time.Duration(cop.conf.BlockedRetryAfter) * time.Second}
+	for _, conn := range cop.conns {
+		conn.l.RLock()
+		blocked, reason := conn.blocked, conn.blockedReason
+		conn.l.RUnlock()
+		if blocked {
+			e.Reason = reason
+			break
+		}
+	}
+	return e
+}
+
+// notifyUnblocked wake up the waiters of the blocked connections
+func (cop *ConnPool) notifyUnblocked() {
+	cop.l.Lock()
+	defer cop.l.Unlock()
+	close(cop.unblockedCh)
+	cop.unblockedCh = make(chan struct{})
+}
+
+// waitUnblocked wait for unblockedCh closed until the deadline or ctx is done
+// return false if waiting failed
+func waitUnblocked(ctx context.Context, unblockedCh chan struct{}, deadline time.Time) bool {
+	d := deadline.Sub(time.Now())
+	if d <= 0 {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-unblockedCh:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+func TestGetConnPreferUnblocked(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 2, MaxIdleChannels: 1, PublishChannels: 1, BlockedRetryAfter: 5})
+	defer cop.CloseAll()
+	blocked := &Connection{maxChannels: 10, blocked: true, blockedReason: "low on memory"}
+	unblocked := &Connection{maxChannels: 10}
+	cop.conns = append(cop.conns, blocked, unblocked)
+
+	cop.l.Lock()
+	conn, err := cop.getConn()
+	cop.l.Unlock()
+	if err != nil || conn != unblocked {
+		t.Fatalf("getConn = %p, %v, expected the unblocked connection %p", conn, err, unblocked)
+	}
+	if n := cop.Stats().BlockedConnNum; n != 1 {
+		t.Fatalf("BlockedConnNum %d, expected 1", n)
+	}
+
+	// all the connections are blocked
+	unblocked.setBlocked(amqp.Blocking{Active: true, Reason: "low on disk"})
+	cop.l.Lock()
+	_, err = cop.getConn()
+	cop.l.Unlock()
+	be, ok := err.(*BlockedError)
+	if !ok || be.Reason != "low on memory" || be.RetryAfter != 5*time.Second {
+		t.Fatalf("getConn = %#v, expected the BlockedError of the first blocked connection", err)
+	}
+
+	// fail fast without waiting when BlockedWaitTimeout is 0
+	if _, err := cop.getChannel(context.Background()); err == nil || err.Error() != be.Error() {
+		t.Fatalf("getChannel = %v, expected the BlockedError", err)
+	}
+}
+
+func TestGetChannelBlockedWaitTimeout(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1, BlockedWaitTimeout: 50})
+	defer cop.CloseAll()
+	cop.conns = append(cop.conns, &Connection{maxChannels: 10, blocked: true, blockedReason: "low on memory"})
+
+	start := time.Now()
+	_, err := cop.getChannel(context.Background())
+	if _, ok := err.(*BlockedError); !ok {
+		t.Fatalf("getChannel = %v, expected the BlockedError", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("getChannel returned after %s, expected waiting BlockedWaitTimeout", d)
+	}
+}
+
+func TestWatchConnBlocked(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1})
+	defer cop.CloseAll()
+	conn, closeCh, blockCh, watched := watchTestConn(cop)
+	defer func() {
+		close(closeCh)
+		waitWatched(t, watched)
+	}()
+
+	blockCh <- amqp.Blocking{Active: true, Reason: "low on memory"}
+	for i := 0; !conn.isBlocked(); i++ {
+		if i > 100 {
+			t.Fatal("the connection is not blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cop.l.Lock()
+	unblockedCh := cop.unblockedCh
+	cop.l.Unlock()
+	blockCh <- amqp.Blocking{Active: false}
+	if !waitUnblocked(context.Background(), unblockedCh, time.Now().Add(time.Second)) {
+		t.Fatal("the waiters are not woken up by the unblocked connection")
+	}
+	if conn.isBlocked() {
+		t.Fatal("the connection is still blocked")
+	}
+}
+
+func TestWaitUnblocked(t *testing.T) {
+	unblockedCh := make(chan struct{})
+	if waitUnblocked(context.Background(), unblockedCh, time.Now()) {
+		t.Fatal("wait after the deadline")
+	}
+	if waitUnblocked(context.Background(), unblockedCh, time.Now().Add(10*time.Millisecond)) {
+		t.Fatal("wait = true after the deadline")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if waitUnblocked(ctx, unblockedCh, time.Now().Add(time.Second)) {
+		t.Fatal("wait = true after ctx done")
+	}
+	close(unblockedCh)
+	if !waitUnblocked(context.Background(), unblockedCh, time.Now().Add(time.Second)) {
+		t.Fatal("wait = false after unblocked")
+	}
+}
@@ -0,0 +1,254 @@
+package pool
+
+import (
+	"bytes"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+// ChannelClosedError occured when the channel is closed before the confirm of the message,
+// the message may or may not be accepted by the server.
+// All the unconfirmed messages of a shared channel get it, even if the channel is closed by the other message
+type ChannelClosedError struct {
+	// Err is the channel or connection exception, nil if the channel is closed by the pool
+	Err *amqp.Error
+}
+
+func (e *ChannelClosedError) Error() string {
+	if e.Err == nil {
+		return "pool: channel closed before the confirm"
+	}
+	return "pool: channel closed before the confirm: " + e.Err.Error()
+}
+
+// ConfirmTimeoutError occured when the message is published but ctx is done before the server confirm,
+// the message may or may not be delivered, so it should not be published again blindly
+type ConfirmTimeoutError struct {
+	// Err is the ctx.Err()
+	Err error
+}
+
+func (e *ConfirmTimeoutError) Error() string {
+	return "pool: waiting confirm: " + e.Err.Error()
+}
+
+// pendingPublish is a published message waiting for the server confirm
+type pendingPublish struct {
+	tag        uint64
+	exchange   string
+	routingKey string
+	msg        amqp.Publishing
+
+	// returned is true if the message is returned by the server(basic.return)
+	returned bool
+	// err is the publish result after confirmed
+	// nil if acked, ErrUnroutable if returned, ErrNacked if nacked, *ChannelClosedError if the channel closed before the confirm
+	err error
+
+	// confirmed is closed after err is set
+	confirmed chan struct{}
+	// done is called with err after confirmed
+	done AsyncCallback
+}
+
+// matches report whether the returned message is this publish
+// basic.return does not carry the delivery tag, so compare the message itself
+func (p *pendingPublish) matches(ret *amqp.Return) bool {
+	return p.exchange == ret.Exchange &&
+		p.routingKey == ret.RoutingKey &&
+		p.msg.MessageId == ret.MessageId &&
+		p.msg.CorrelationId == ret.CorrelationId &&
+		bytes.Equal(p.msg.Body, ret.Body)
+}
+
+// wait for the confirm until done is closed, return false if it's not confirmed
+func (p *pendingPublish) wait(done <-chan struct{}) bool {
+	select {
+	case <-p.confirmed:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (p *pendingPublish) finish() {
+	close(p.confirmed)
+	if p.done != nil {
+		p.done(p.err)
+	}
+}
+
+// publish send a mandatory message and add it to the pending publishes of the channel,
+// done is called with the result after it's confirmed.
+// The publishes are serialized, so the delivery tags are in the publish order,
+// and several goroutines can share the channel.
+func (cha *Channel) publish(exchange, routingKey string, msg amqp.Publishing, done AsyncCallback) (*pendingPublish, error) {
+	cha.pl.Lock()
+	defer cha.pl.Unlock()
+
+	if cha.cha == nil {
+		return nil, amqp.ErrClosed
+	}
+
+	// the confirm may arrive before Publish returns, so add it to pending first
+	p := &pendingPublish{
+		tag:        cha.deliveryTag + 1,
+		exchange:   exchange,
+		routingKey: routingKey,
+		msg:        msg,
+		confirmed:  make(chan struct{}),
+		done:       done,
+	}
+	cha.l.Lock()
+	if cha.dispatchDone {
+		cha.l.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	cha.pending[p.tag] = p
+	cha.l.Unlock()
+
+	err := cha.cha.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory，若为true，则当没有对应的队列，返回消息(basic.return)
+		false,      // immediate，若为true，则当没有消费者消费，不ack
+		msg)
+	if err != nil {
+		return cha.publishFailed(p, err)
+	}
+	cha.deliveryTag++
+	return p, nil
+}
+
+// publishFailed remove the pending publish failed to write,
+// it's returned as published if it's already failed by the dispatcher when the channel closed,
+// because the done is called by the dispatcher
+func (cha *Channel) publishFailed(p *pendingPublish, err error) (*pendingPublish, error) {
+	cha.l.Lock()
+	owned := cha.pending[p.tag] == p
+	delete(cha.pending, p.tag)
+	cha.l.Unlock()
+
+	if !owned {
+		return p, nil
+	}
+	return nil, err
+}
+
+// dispatch the confirms and returns to the pending publishes by the delivery tag,
+// until the channel closed, then the left pending publishes get the ChannelClosedError.
+// The multiple acks are expanded to a confirm per delivery tag by the amqp library.
+// It's started when the channel opened, so the connection reader is never blocked by the channel.
+func (cha *Channel) dispatch() {
+	returnCh := cha.returnCh
+	for {
+		select {
+		case ret, ok := <-returnCh:
+			if !ok {
+				returnCh = nil
+				continue
+			}
+			cha.l.Lock()
+			cha.markReturned(&ret)
+			cha.l.Unlock()
+
+		case confirmed, ok := <-cha.confirmCh:
+			if !ok {
+				cha.failPending()
+				return
+			}
+
+			cha.l.Lock()
+			// the server always sends basic.return before the confirm of the same message,
+			// and the amqp library dispatches them in order, so the return is already arrived
+			if returnCh != nil {
+				cha.drainReturns()
+			}
+			p, found := cha.pending[confirmed.DeliveryTag]
+			delete(cha.pending, confirmed.DeliveryTag)
+			cha.l.Unlock()
+
+			if !found {
+				continue
+			}
+			if !confirmed.Ack {
+				p.err = ErrNacked
+			} else if p.returned {
+				p.err = ErrUnroutable
+			}
+			p.finish()
+		}
+	}
+}
+
+// failPending fail the pending publishes of the closed channel
+func (cha *Channel) failPending() {
+	// the close error is sent before the confirms channel is closed
+	closeErr := &ChannelClosedError{}
+	select {
+	case closeErr.Err = <-cha.dispatchCloseCh:
+	default:
+	}
+
+	cha.l.Lock()
+	pending := cha.pending
+	cha.pending = nil
+	cha.dispatchDone = true
+	cha.l.Unlock()
+
+	if len(pending) > 0 {
+		log.Warn("Channel.failPending: channel closed with unconfirmed publishes", log.Fields{"pending": len(pending), "error": closeErr})
+	}
+	for _, p := range pending {
+		p.err = closeErr
+		p.finish()
+	}
+	close(cha.dispatched)
+}
+
+// isClosed report whether the channel is closed and it's pending publishes are failed
+func (cha *Channel) isClosed() bool {
+	select {
+	case <-cha.dispatched:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainReturns read the arrived returns without blocking
+// Notice: must be called with cha.l locked
+func (cha *Channel) drainReturns() {
+	for {
+		select {
+		case ret, ok := <-cha.returnCh:
+			if !ok {
+				return
+			}
+			cha.markReturned(&ret)
+		default:
+			return
+		}
+	}
+}
+
+// markReturned mark the earliest matched pending publish as returned
+// Notice: must be called with cha.l locked
+func (cha *Channel) markReturned(ret *amqp.Return) {
+	var found *pendingPublish
+	for _, p := range cha.pending {
+		if p.returned || !p.matches(ret) {
+			continue
+		}
+		if found == nil || p.tag < found.tag {
+			found = p
+		}
+	}
+	if found == nil {
+		log.Warn("Channel.markReturned: unknown returned message", log.Fields{"exchange": ret.Exchange, "routingKey": ret.RoutingKey, "replyCode": ret.ReplyCode, "replyText": ret.ReplyText})
+		return
+	}
+	found.returned = true
+}
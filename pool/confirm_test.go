@@ -0,0 +1,335 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+// newTestChannel return a channel dispatching the confirms and returns of the test
+func newTestChannel() *Channel {
+	cha := &Channel{
+		confirmCh:       make(chan amqp.Confirmation, confirmBufferSize),
+		returnCh:        make(chan amqp.Return, confirmBufferSize),
+		dispatchCloseCh: make(chan *amqp.Error, 1),
+		pending:         make(map[uint64]*pendingPublish),
+		dispatched:      make(chan struct{}),
+	}
+	go cha.dispatch()
+	return cha
+}
+
+// addPending add the pending publish of the next delivery tag as Channel.publish
+func addPending(cha *Channel, routingKey string, body string, results chan<- error) *pendingPublish {
+	cha.deliveryTag++
+	p := &pendingPublish{
+		tag:        cha.deliveryTag,
+		exchange:   "orders",
+		routingKey: routingKey,
+		msg:        amqp.Publishing{Body: []byte(body)},
+		confirmed:  make(chan struct{}),
+		done: func(err error) {
+			if results != nil {
+				results <- err
+			}
+		},
+	}
+	cha.l.Lock()
+	cha.pending[p.tag] = p
+	cha.l.Unlock()
+	return p
+}
+
+func waitConfirmed(t *testing.T, p *pendingPublish) error {
+	select {
+	case <-p.confirmed:
+		return p.err
+	case <-time.After(time.Second):
+		t.Fatalf("publish %d not confirmed", p.tag)
+	}
+	return nil
+}
+
+func TestDispatchOutOfOrder(t *testing.T) {
+	cha := newTestChannel()
+	p1 := addPending(cha, "a", "1", nil)
+	p2 := addPending(cha, "b", "2", nil)
+	p3 := addPending(cha, "c", "3", nil)
+
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+
+	if err := waitConfirmed(t, p3); err != nil {
+		t.Fatalf("tag 3: %v, expected ack", err)
+	}
+	if err := waitConfirmed(t, p1); err != ErrNacked {
+		t.Fatalf("tag 1: %v, expected ErrNacked", err)
+	}
+	if err := waitConfirmed(t, p2); err != nil {
+		t.Fatalf("tag 2: %v, expected ack", err)
+	}
+}
+
+func TestDispatchMultipleExpanded(t *testing.T) {
+	cha := newTestChannel()
+	results := make(chan error, 4)
+	var ps []*pendingPublish
+	for i := 0; i < 4; i++ {
+		ps = append(ps, addPending(cha, "a", "m", results))
+	}
+
+	// basic.ack multiple=true of tag 3 is expanded to a confirm per tag by the amqp library
+	for tag := uint64(1); tag <= 3; tag++ {
+		cha.confirmCh <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+	for _, p := range ps[:3] {
+		if err := waitConfirmed(t, p); err != nil {
+			t.Fatalf("tag %d: %v, expected ack", p.tag, err)
+		}
+	}
+	select {
+	case <-ps[3].confirmed:
+		t.Fatal("tag 4 confirmed by the multiple ack of tag 3")
+	default:
+	}
+	cha.l.Lock()
+	left := len(cha.pending)
+	cha.l.Unlock()
+	if left != 1 {
+		t.Fatalf("%d pending publishes left, expected 1", left)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d callbacks called, expected 3", len(results))
+	}
+}
+
+func TestDispatchReturnBeforeAck(t *testing.T) {
+	cha := newTestChannel()
+	// the same message is published twice, the return matches the earliest
+	p1 := addPending(cha, "missing", "same", nil)
+	p2 := addPending(cha, "missing", "same", nil)
+	p3 := addPending(cha, "bound", "other", nil)
+
+	cha.returnCh <- amqp.Return{Exchange: "orders", RoutingKey: "missing", Body: []byte("same"), ReplyCode: amqp.NoRoute}
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+
+	if err := waitConfirmed(t, p1); err != ErrUnroutable {
+		t.Fatalf("tag 1: %v, expected ErrUnroutable", err)
+	}
+	if err := waitConfirmed(t, p2); err != nil {
+		t.Fatalf("tag 2: %v, expected ack", err)
+	}
+	if err := waitConfirmed(t, p3); err != nil {
+		t.Fatalf("tag 3: %v, expected ack", err)
+	}
+}
+
+func TestPendingPublishMatches(t *testing.T) {
+	p := &pendingPublish{
+		exchange:   "orders",
+		routingKey: "created",
+		msg:        amqp.Publishing{MessageId: "id-1", CorrelationId: "corr-1", Body: []byte("msg")},
+	}
+	ret := amqp.Return{Exchange: "orders", RoutingKey: "created", MessageId: "id-1", CorrelationId: "corr-1", Body: []byte("msg")}
+	if !p.matches(&ret) {
+		t.Fatal("the returned message does not match the publish")
+	}
+
+	others := []func(r *amqp.Return){
+		func(r *amqp.Return) { r.Exchange = "billing" },
+		func(r *amqp.Return) { r.RoutingKey = "paid" },
+		func(r *amqp.Return) { r.MessageId = "id-2" },
+		func(r *amqp.Return) { r.CorrelationId = "" },
+		func(r *amqp.Return) { r.Body = []byte("msg2") },
+	}
+	for i, change := range others {
+		r := ret
+		change(&r)
+		if p.matches(&r) {
+			t.Errorf("case %d: the other returned message %+v matches the publish", i, r)
+		}
+	}
+}
+
+func TestMarkReturned(t *testing.T) {
+	cha := &Channel{pending: make(map[uint64]*pendingPublish)}
+	ret := amqp.Return{Exchange: "orders", RoutingKey: "missing", Body: []byte("same")}
+	for _, tag := range []uint64{7, 3, 5} {
+		cha.pending[tag] = &pendingPublish{tag: tag, exchange: "orders", routingKey: "missing", msg: amqp.Publishing{Body: []byte("same")}}
+	}
+
+	// each return marks the earliest publish not returned yet
+	for _, expected := range []uint64{3, 5, 7} {
+		cha.markReturned(&ret)
+		for tag, p := range cha.pending {
+			if p.returned != (tag <= expected) {
+				t.Fatalf("after the return of %d: tag %d returned %v", expected, tag, p.returned)
+			}
+		}
+	}
+	// the unknown returned message marks nothing
+	cha.pending[9] = &pendingPublish{tag: 9, exchange: "orders", routingKey: "bound", msg: amqp.Publishing{Body: []byte("other")}}
+	cha.markReturned(&ret)
+	if cha.pending[9].returned {
+		t.Fatal("the unknown return marked the other publish")
+	}
+}
+
+func TestDispatchChannelClosed(t *testing.T) {
+	cha := newTestChannel()
+	results := make(chan error, 3)
+	p1 := addPending(cha, "a", "1", results)
+	p2 := addPending(cha, "b", "2", results)
+	p3 := addPending(cha, "c", "3", results)
+
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	if err := waitConfirmed(t, p1); err != nil {
+		t.Fatalf("tag 1: %v, expected ack", err)
+	}
+
+	// the amqp library sends the close error before it closes the notify channels
+	closeErr := &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no exchange 'missing'", Server: true}
+	cha.dispatchCloseCh <- closeErr
+	close(cha.returnCh)
+	close(cha.confirmCh)
+
+	for _, p := range []*pendingPublish{p2, p3} {
+		err := waitConfirmed(t, p)
+		ce, ok := err.(*ChannelClosedError)
+		if !ok || ce.Err != closeErr {
+			t.Fatalf("tag %d: %v, expected the ChannelClosedError of the close error", p.tag, err)
+		}
+	}
+	select {
+	case <-cha.dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatcher not done")
+	}
+	if !cha.isClosed() {
+		t.Fatal("channel not closed")
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d callbacks called, expected 3", len(results))
+	}
+}
+
+func TestPublishFailedOwned(t *testing.T) {
+	cha := newTestChannel()
+	results := make(chan error, 1)
+	p := addPending(cha, "a", "1", results)
+
+	// the publish failed before the channel closed, the caller gets the error and the done is never called
+	pp, err := cha.publishFailed(p, amqp.ErrClosed)
+	if pp != nil || err != amqp.ErrClosed {
+		t.Fatalf("publishFailed = %v, %v, expected the publish error", pp, err)
+	}
+	close(cha.confirmCh)
+	<-cha.dispatched
+	if len(results) != 0 {
+		t.Fatal("the done of the failed publish called")
+	}
+}
+
+func TestPublishFailedAfterChannelClosed(t *testing.T) {
+	cha := newTestChannel()
+	results := make(chan error, 1)
+	p := addPending(cha, "a", "1", results)
+
+	// the dispatcher failed the pending publish before the publish returned the error
+	close(cha.confirmCh)
+	<-cha.dispatched
+	pp, err := cha.publishFailed(p, amqp.ErrClosed)
+	if pp != p || err != nil {
+		t.Fatalf("publishFailed = %v, %v, expected the pending publish", pp, err)
+	}
+	if _, ok := (<-results).(*ChannelClosedError); !ok {
+		t.Fatal("the done is not called with the ChannelClosedError")
+	}
+}
+
+func TestConfirmSendChannelClosed(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1, MaxInFlightPerChannel: 10})
+	// the amqp channel is not open, so the publishes fail with amqp.ErrClosed
+	cha := newTestChannel()
+	cha.conn = &Connection{}
+	cop.publisher.slots[0].cha = cha
+	cop.publisher.known["orders"] = true
+
+	err := cop.ConfirmSendMsgContext(context.Background(), "orders", "k", []byte("msg"), nil)
+	if e, ok := err.(*ChannelClosedError); !ok || e.Err != amqp.ErrClosed {
+		t.Fatalf("ConfirmSendMsgContext = %#v, expected the ChannelClosedError", err)
+	}
+	errs, err := cop.ConfirmSendBatchContext(context.Background(), []*Message{{Exchange: "orders", RoutingKey: "k", Body: []byte("msg")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errs[0].(*ChannelClosedError); !ok {
+		t.Fatalf("ConfirmSendBatchContext = %#v, expected the ChannelClosedError", errs[0])
+	}
+}
+
+func TestPublishMissingExchange(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1, MaxInFlightPerChannel: 10})
+	cha := newTestChannel()
+	cha.conn = &Connection{}
+	cop.publisher.slots[0].cha = cha
+	checks := 0
+	cop.publisher.declarePassive = func(ctx context.Context, exchange string) error {
+		checks++
+		if exchange == "missing" {
+			return &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no exchange 'missing'"}
+		}
+		return nil
+	}
+
+	// a publish in flight on the shared channel
+	results := make(chan error, 1)
+	p := addPending(cha, "a", "1", results)
+
+	err := cop.ConfirmSendMsgContext(context.Background(), "missing", "k", []byte("msg"), nil)
+	if e, ok := err.(*amqp.Error); !ok || e.Code != amqp.NotFound {
+		t.Fatalf("ConfirmSendMsgContext = %#v, expected NOT_FOUND", err)
+	}
+	errs, err := cop.ConfirmSendBatchContext(context.Background(), []*Message{{Exchange: "missing", RoutingKey: "k", Body: []byte("msg")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := errs[0].(*amqp.Error); !ok || e.Code != amqp.NotFound {
+		t.Fatalf("ConfirmSendBatchContext = %#v, expected NOT_FOUND", errs[0])
+	}
+
+	// the missing exchange is not published on the shared channel, the publish in flight is confirmed
+	if cha.isClosed() {
+		t.Fatal("the shared channel closed by the missing exchange")
+	}
+	cha.confirmCh <- amqp.Confirmation{DeliveryTag: p.tag, Ack: true}
+	if err := waitConfirmed(t, p); err != nil || <-results != nil {
+		t.Fatalf("the publish in flight got %v, expected acked", err)
+	}
+
+	// the existing exchange is checked once, the default exchange is never checked
+	for i := 0; i < 2; i++ {
+		if err := cop.publisher.checkExchange(context.Background(), "orders"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cop.publisher.checkExchange(context.Background(), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if checks != 3 {
+		t.Fatalf("%d passive declares, expected 3", checks)
+	}
+	// the deleted exchange is checked again
+	cop.publisher.forgetExchange("orders")
+	cop.publisher.checkExchange(context.Background(), "orders")
+	if checks != 4 {
+		t.Fatalf("%d passive declares after forgotten, expected 4", checks)
+	}
+}
@@ -0,0 +1,90 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/util"
+)
+
+// Consumer is a basic.consume on a pooled channel
+// the channel is held by the consumer until Cancel
+type Consumer struct {
+	Queue string
+	Tag   string
+	// Deliveries is closed when the consumer is canceled or the channel is closed
+	Deliveries <-chan amqp.Delivery
+
+	cop  *ConnPool
+	cha  *Channel
+	once sync.Once
+}
+
+// Consume start a consumer of the queue on a pooled channel with the prefetch count,
+// if autoAck is false, the deliveries must be settled by amqp.Delivery.Ack/Nack/Reject
+func (cop *ConnPool) Consume(ctx context.Context, queue string, prefetch int, autoAck bool) (*Consumer, error) {
+	cha, err := cop.getChannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefetch > 0 {
+		if err := cha.cha.Qos(prefetch, 0, false); err != nil {
+			cop.discardChannel(cha)
+			return nil, err
+		}
+	}
+
+	tag := "http-proxy-amqp." + util.RandomID(8)
+	deliveries, err := cha.cha.Consume(
+		queue,
+		tag,
+		autoAck,
+		false, // exclusive
+		false, // noLocal
+		false, // noWait
+		nil,
+	)
+	if err != nil {
+		cop.discardChannel(cha)
+		return nil, err
+	}
+	atomic.AddInt32(&cop.consumerNum, 1)
+
+	return &Consumer{
+		Queue:      queue,
+		Tag:        tag,
+		Deliveries: deliveries,
+		cop:        cop,
+		cha:        cha,
+	}, nil
+}
+
+// Cancel stop the consumer and close it's channel, the unacked deliveries are requeued by the server
+// the channel is not reused because of it's prefetch setting
+func (c *Consumer) Cancel() {
+	c.once.Do(func() {
+		// not care about the error, the channel may be closed by the server
+		c.cha.cha.Cancel(c.Tag, false)
+		c.cop.discardChannel(c.cha)
+		atomic.AddInt32(&c.cop.consumerNum, -1)
+	})
+}
+
+// Ack ack the delivery of this consumer
+func (c *Consumer) Ack(tag uint64, multiple bool) error {
+	return c.cha.cha.Ack(tag, multiple)
+}
+
+// Nack nack the delivery of this consumer
+func (c *Consumer) Nack(tag uint64, multiple bool, requeue bool) error {
+	return c.cha.cha.Nack(tag, multiple, requeue)
+}
+
+// Reject reject the delivery of this consumer
+func (c *Consumer) Reject(tag uint64, requeue bool) error {
+	return c.cha.cha.Reject(tag, requeue)
+}
@@ -0,0 +1,227 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+// TopologyDrift is a difference between the config topology and the server
+type TopologyDrift struct {
+	// Kind is exchange, queue or binding
+	Kind    string
+	Name    string
+	Problem string
+}
+
+// TopologyReport is the result of the last topology apply
+type TopologyReport struct {
+	DryRun bool
+	Time   time.Time
+	// Errors are the failed declarations
+	Errors []string `json:",omitempty"`
+	// Drift is reported in the dry run mode
+	Drift []*TopologyDrift `json:",omitempty"`
+}
+
+// ApplyTopology declare the config topology, or only report the drift in the dry run mode.
+// It's called when the pool starts, and it's applied again by the first new connection
+// after a connection is closed by the server or network.
+// All the declarations are idempotent, it returns nil if the topology is empty.
+func (cop *ConnPool) ApplyTopology() *TopologyReport {
+	topo := &cop.conf.Topology
+	if topo.Empty() {
+		return nil
+	}
+
+	// the reconnects may start it concurrently
+	cop.topologyL.Lock()
+	defer cop.topologyL.Unlock()
+
+	report := &TopologyReport{DryRun: topo.DryRun, Time: time.Now()}
+	err := cop.applyTopology(topo, report)
+
+	cop.l.Lock()
+	// the server is unreachable, apply it again on the next connection
+	if err != nil {
+		cop.topologyStale = true
+	}
+	cop.lastTopology = report
+	cop.l.Unlock()
+
+	if err != nil {
+		log.Error("ConnPool.ApplyTopology: aborted", log.Fields{"error": err})
+	}
+	for _, d := range report.Drift {
+		log.Warn("ConnPool.ApplyTopology: drift", log.Fields{"kind": d.Kind, "name": d.Name, "problem": d.Problem})
+	}
+	log.Info("ConnPool.ApplyTopology: done", log.Fields{"dryRun": report.DryRun, "errors": len(report.Errors), "drift": len(report.Drift)})
+	return report
+}
+
+// applyTopology declare or check the exchanges, queues and bindings in order,
+// the server errors are recorded in the report, the other errors abort it
+func (cop *ConnPool) applyTopology(topo *config.TopologyConfig, report *TopologyReport) error {
+	// record the server error, return the other errors
+	check := func(kind string, name string, err error) error {
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*amqp.Error); !ok {
+			return err
+		}
+		report.Errors = append(report.Errors, fmt.Sprintf("%s %s: %s", kind, name, err))
+		return nil
+	}
+
+	for i := range topo.Exchanges {
+		spec := &topo.Exchanges[i]
+		var err error
+		if topo.DryRun {
+			err = cop.checkExchange(spec, report)
+		} else {
+			err = cop.timeout(func(ctx context.Context) error { return cop.DeclareExchange(ctx, spec) })
+		}
+		if err := check("exchange", spec.Name, err); err != nil {
+			return err
+		}
+	}
+
+	for i := range topo.Queues {
+		spec := &topo.Queues[i]
+		var err error
+		if topo.DryRun {
+			err = cop.checkQueue(spec, report)
+		} else {
+			err = cop.timeout(func(ctx context.Context) error {
+				_, err := cop.DeclareQueue(ctx, spec)
+				return err
+			})
+		}
+		if err := check("queue", spec.Name, err); err != nil {
+			return err
+		}
+	}
+
+	for i := range topo.Bindings {
+		spec := &topo.Bindings[i]
+		name := fmt.Sprintf("%s -> %s %s(%s)", spec.Exchange, spec.DestinationType, spec.Destination, spec.RoutingKey)
+		var err error
+		if topo.DryRun {
+			err = cop.checkBinding(spec, name, report)
+		} else {
+			err = cop.timeout(func(ctx context.Context) error { return cop.Bind(ctx, spec) })
+		}
+		if err := check("binding", name, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeout run fn with the publish timeout
+func (cop *ConnPool) timeout(fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cop.conf.PublishTimeout)*time.Millisecond)
+	defer cancel()
+	return fn(ctx)
+}
+
+// isNotFound return true if err is the server error 404
+func isNotFound(err error) bool {
+	e, ok := err.(*amqp.Error)
+	return ok && e.Code == amqp.NotFound
+}
+
+// checkExchange report the drift of the exchange without changing it:
+// it's missing if the passive declare failed, and the settings differ if the declare failed
+// the declare of a existing exchange with the same settings is a no-op
+func (cop *ConnPool) checkExchange(spec *config.ExchangeSpec, report *TopologyReport) error {
+	exists, err := cop.exchangeExists(spec.Name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		report.Drift = append(report.Drift, &TopologyDrift{Kind: "exchange", Name: spec.Name, Problem: "missing"})
+		return nil
+	}
+
+	err = cop.timeout(func(ctx context.Context) error { return cop.DeclareExchange(ctx, spec) })
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.PreconditionFailed {
+		report.Drift = append(report.Drift, &TopologyDrift{Kind: "exchange", Name: spec.Name, Problem: "settings differ: " + e.Reason})
+		return nil
+	}
+	return err
+}
+
+// checkQueue report the drift of the queue the same as checkExchange
+func (cop *ConnPool) checkQueue(spec *config.QueueSpec, report *TopologyReport) error {
+	exists, err := cop.queueExists(spec.Name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		report.Drift = append(report.Drift, &TopologyDrift{Kind: "queue", Name: spec.Name, Problem: "missing"})
+		return nil
+	}
+
+	err = cop.timeout(func(ctx context.Context) error {
+		_, err := cop.DeclareQueue(ctx, spec)
+		return err
+	})
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.PreconditionFailed {
+		report.Drift = append(report.Drift, &TopologyDrift{Kind: "queue", Name: spec.Name, Problem: "settings differ: " + e.Reason})
+		return nil
+	}
+	return err
+}
+
+// checkBinding report the missing source or destination of the binding
+// Notice: amqp has no passive bind, the binding itself is not checked
+func (cop *ConnPool) checkBinding(spec *config.BindingSpec, name string, report *TopologyReport) error {
+	exists, err := cop.exchangeExists(spec.Exchange)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		report.Drift = append(report.Drift, &TopologyDrift{Kind: "binding", Name: name, Problem: "source exchange missing"})
+	}
+
+	if spec.DestinationType == config.DestinationExchange {
+		exists, err = cop.exchangeExists(spec.Destination)
+	} else {
+		exists, err = cop.queueExists(spec.Destination)
+	}
+	if err != nil {
+		return err
+	}
+	if !exists {
+		report.Drift = append(report.Drift, &TopologyDrift{Kind: "binding", Name: name, Problem: "destination " + spec.DestinationType + " missing"})
+	}
+	return nil
+}
+
+func (cop *ConnPool) exchangeExists(name string) (bool, error) {
+	err := cop.timeout(func(ctx context.Context) error {
+		return cop.declareExchangePassive(ctx, name)
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (cop *ConnPool) queueExists(name string) (bool, error) {
+	err := cop.timeout(func(ctx context.Context) error {
+		_, err := cop.InspectQueue(ctx, name)
+		return err
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,172 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/util"
+)
+
+var (
+	// ErrLeaseNotFound occured when settle the deliveries of a unknown or expired lease
+	ErrLeaseNotFound = errors.New("pool: lease not found or expired")
+
+	// ErrUnknownDeliveryTag occured when settle a delivery not in the lease or already settled
+	ErrUnknownDeliveryTag = errors.New("pool: unknown delivery tag")
+)
+
+// SettleAction is the way to settle a manual acked delivery
+type SettleAction int
+
+// settle actions
+const (
+	SettleAck SettleAction = iota
+	SettleNack
+	SettleReject
+)
+
+// Lease holds the channel of the manual acked deliveries received by Get,
+// the deliveries must be settled on the same channel before the lease expires,
+// otherwise the channel is closed and the unsettled deliveries are requeued by the server
+type Lease struct {
+	ID      string
+	Queue   string
+	Expires time.Time
+
+	cha *Channel
+	// unsettled delivery tags
+	pending map[uint64]struct{}
+	timer   *time.Timer
+}
+
+// Get receive at most count messages from the queue with basic.get on a pooled channel.
+// If autoAck is false, a Lease is returned when there are messages,
+// the deliveries must be settled by Settle with the lease id before the leaseTimeout.
+func (cop *ConnPool) Get(ctx context.Context, queue string, count int, autoAck bool, leaseTimeout time.Duration) (*Lease, []amqp.Delivery, error) {
+	cha, err := cop.getChannel(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var deliveries []amqp.Delivery
+	for len(deliveries) < count {
+		d, ok, err := cha.cha.Get(queue, autoAck)
+		if err != nil {
+			// the channel is closed by the server, the received deliveries are requeued
+			cop.discardChannel(cha)
+			return nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if autoAck || len(deliveries) == 0 {
+		cop.putChannel(cha)
+		return nil, deliveries, nil
+	}
+
+	lease := &Lease{
+		ID:      util.RandomID(16),
+		Queue:   queue,
+		Expires: time.Now().Add(leaseTimeout),
+		cha:     cha,
+		pending: make(map[uint64]struct{}, len(deliveries)),
+	}
+	for _, d := range deliveries {
+		lease.pending[d.DeliveryTag] = struct{}{}
+	}
+
+	cop.leaseL.Lock()
+	cop.leases[lease.ID] = lease
+	lease.timer = time.AfterFunc(leaseTimeout, func() {
+		cop.expireLease(lease.ID)
+	})
+	cop.leaseL.Unlock()
+
+	return lease, deliveries, nil
+}
+
+// LeaseQueue return the queue the deliveries of the lease are received from
+func (cop *ConnPool) LeaseQueue(leaseID string) (string, error) {
+	cop.leaseL.Lock()
+	defer cop.leaseL.Unlock()
+
+	lease, ok := cop.leases[leaseID]
+	if !ok {
+		return "", ErrLeaseNotFound
+	}
+	return lease.Queue, nil
+}
+
+// Settle ack, nack or reject the delivery of the lease,
+// if multiple is true, all the unsettled deliveries up to the tag are settled.
+// requeue is ignored by SettleAck.
+// The lease channel is put back to the pool when all the deliveries are settled.
+func (cop *ConnPool) Settle(leaseID string, tag uint64, action SettleAction, multiple bool, requeue bool) error {
+	cop.leaseL.Lock()
+	defer cop.leaseL.Unlock()
+
+	lease, ok := cop.leases[leaseID]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	// settle a unknown tag is a channel error, which closes the channel
+	if _, ok := lease.pending[tag]; !ok {
+		return ErrUnknownDeliveryTag
+	}
+
+	var err error
+	switch action {
+	case SettleAck:
+		err = lease.cha.cha.Ack(tag, multiple)
+	case SettleNack:
+		err = lease.cha.cha.Nack(tag, multiple, requeue)
+	case SettleReject:
+		// basic.reject has no multiple flag
+		multiple = false
+		err = lease.cha.cha.Reject(tag, requeue)
+	}
+	if err != nil {
+		delete(cop.leases, leaseID)
+		lease.timer.Stop()
+		cop.discardChannel(lease.cha)
+		return err
+	}
+
+	delete(lease.pending, tag)
+	if multiple {
+		for t := range lease.pending {
+			if t < tag {
+				delete(lease.pending, t)
+			}
+		}
+	}
+
+	if len(lease.pending) == 0 {
+		delete(cop.leases, leaseID)
+		lease.timer.Stop()
+		cop.putChannel(lease.cha)
+	}
+	return nil
+}
+
+// expireLease close the lease channel, the unsettled deliveries are requeued by the server
+func (cop *ConnPool) expireLease(leaseID string) {
+	cop.leaseL.Lock()
+	defer cop.leaseL.Unlock()
+
+	lease, ok := cop.leases[leaseID]
+	if !ok {
+		return
+	}
+	delete(cop.leases, leaseID)
+
+	log.Warn("ConnPool.expireLease: lease expired, deliveries requeued", log.Fields{"lease": leaseID, "deliveries": len(lease.pending)})
+	cop.discardChannel(lease.cha)
+}
@@ -0,0 +1,46 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+func TestSettleUnknown(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1})
+	defer cop.CloseAll()
+	cop.leases["l1"] = &Lease{
+		ID:      "l1",
+		Queue:   "orders",
+		Expires: time.Now().Add(time.Minute),
+		pending: map[uint64]struct{}{1: {}, 2: {}},
+		timer:   time.NewTimer(time.Minute),
+	}
+
+	if queue, err := cop.LeaseQueue("l1"); queue != "orders" || err != nil {
+		t.Fatalf("LeaseQueue = %q, %v", queue, err)
+	}
+	if _, err := cop.LeaseQueue("l2"); err != ErrLeaseNotFound {
+		t.Fatalf("LeaseQueue of the unknown lease = %v, expected ErrLeaseNotFound", err)
+	}
+
+	for _, action := range []SettleAction{SettleAck, SettleNack, SettleReject} {
+		if err := cop.Settle("l2", 1, action, false, true); err != ErrLeaseNotFound {
+			t.Fatalf("Settle(%d) of the unknown lease = %v, expected ErrLeaseNotFound", action, err)
+		}
+		// the unknown tag is rejected before it closes the lease channel
+		if err := cop.Settle("l1", 3, action, true, true); err != ErrUnknownDeliveryTag {
+			t.Fatalf("Settle(%d) of the unknown tag = %v, expected ErrUnknownDeliveryTag", action, err)
+		}
+	}
+	if len(cop.leases["l1"].pending) != 2 || cop.Stats().LeaseNum != 1 {
+		t.Fatal("the lease is changed by the failed settlements")
+	}
+
+	// the settled or expired lease is not expired again
+	cop.expireLease("l2")
+	if cop.Stats().LeaseNum != 1 {
+		t.Fatal("the other lease is expired")
+	}
+}
@@ -0,0 +1,114 @@
+package pool
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/streadway/amqp"
+)
+
+// Message is a message to be published, used by the batch apis
+type Message struct {
+	Exchange   string          `json:"exchange"`
+	RoutingKey string          `json:"routingKey"`
+	Properties *PublishOptions `json:"properties,omitempty"`
+	Body       []byte          `json:"-"`
+}
+
+// messageJSON is the json representation of Message
+// the body is a plain string, or a base64 string if bodyEncoding is "base64"
+type messageJSON struct {
+	Exchange     string          `json:"exchange"`
+	RoutingKey   string          `json:"routingKey"`
+	Properties   *PublishOptions `json:"properties,omitempty"`
+	Body         string          `json:"body"`
+	BodyEncoding string          `json:"bodyEncoding,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+// properties not given keep the value of DefaultPublishOptions
+func (msg *Message) UnmarshalJSON(data []byte) error {
+	m := messageJSON{Properties: DefaultPublishOptions()}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	switch m.BodyEncoding {
+	case "":
+		msg.Body = []byte(m.Body)
+	case "base64":
+		body, err := base64.StdEncoding.DecodeString(m.Body)
+		if err != nil {
+			return fmt.Errorf("invalid base64 body: %s", err)
+		}
+		msg.Body = body
+	default:
+		return fmt.Errorf("unknown bodyEncoding: %q", m.BodyEncoding)
+	}
+
+	msg.Exchange = m.Exchange
+	msg.RoutingKey = m.RoutingKey
+	msg.Properties = m.Properties
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, the body is always base64 encoded
+func (msg *Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&messageJSON{
+		Exchange:     msg.Exchange,
+		RoutingKey:   msg.RoutingKey,
+		Properties:   msg.Properties,
+		Body:         base64.StdEncoding.EncodeToString(msg.Body),
+		BodyEncoding: "base64",
+	})
+}
+
+// Delivery is the json representation of a received amqp.Delivery
+// the body is a plain string if it's valid utf8, otherwise it's base64 encoded
+type Delivery struct {
+	DeliveryTag  uint64          `json:"deliveryTag"`
+	Redelivered  bool            `json:"redelivered"`
+	Exchange     string          `json:"exchange"`
+	RoutingKey   string          `json:"routingKey"`
+	MessageCount uint32          `json:"messageCount,omitempty"`
+	ConsumerTag  string          `json:"consumerTag,omitempty"`
+	Properties   *PublishOptions `json:"properties"`
+	Body         string          `json:"body"`
+	BodyEncoding string          `json:"bodyEncoding,omitempty"`
+}
+
+// NewDelivery return the json representation of d
+func NewDelivery(d *amqp.Delivery) *Delivery {
+	delivery := &Delivery{
+		DeliveryTag:  d.DeliveryTag,
+		Redelivered:  d.Redelivered,
+		Exchange:     d.Exchange,
+		RoutingKey:   d.RoutingKey,
+		MessageCount: d.MessageCount,
+		ConsumerTag:  d.ConsumerTag,
+		Properties: &PublishOptions{
+			Headers:         d.Headers,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			DeliveryMode:    d.DeliveryMode,
+			Priority:        d.Priority,
+			CorrelationID:   d.CorrelationId,
+			ReplyTo:         d.ReplyTo,
+			Expiration:      d.Expiration,
+			MessageID:       d.MessageId,
+			Timestamp:       d.Timestamp,
+			Type:            d.Type,
+			UserID:          d.UserId,
+			AppID:           d.AppId,
+		},
+	}
+	if utf8.Valid(d.Body) {
+		delivery.Body = string(d.Body)
+	} else {
+		delivery.Body = base64.StdEncoding.EncodeToString(d.Body)
+		delivery.BodyEncoding = "base64"
+	}
+	return delivery
+}
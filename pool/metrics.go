@@ -0,0 +1,171 @@
+package pool
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/iyidan/http-proxy-amqp/metrics"
+	"github.com/streadway/amqp"
+)
+
+// the publish results of the publishes counter
+const (
+	resultAck      = "ack"
+	resultNack     = "nack"
+	resultReturned = "returned"
+	resultError    = "error"
+)
+
+const (
+	// otherExchange is the exchange label of the exchanges over maxExchangeLabels,
+	// and the failed publishes of the unlabeled exchanges, they are given by the clients and may not exist
+	otherExchange = "_other"
+	// maxExchangeLabels bounds the series of the publishes counter
+	maxExchangeLabels = 1000
+)
+
+// the reasons of the connection and channel closes counters
+const (
+	// closed by the server, or the network is broken
+	closeReasonServer  = "server"
+	closeReasonNetwork = "network"
+	// the idle connections and channels more than the pool limits
+	closeReasonIdle = "idle"
+	// the busy channel with outstanding confirms or broken
+	closeReasonDiscarded = "discarded"
+	// failed to open a channel on the connection
+	closeReasonBroken = "broken"
+	// the idle channel of a closed connection
+	closeReasonConnClosed = "connection_closed"
+	// the pool is closed
+	closeReasonShutdown = "shutdown"
+)
+
+// the kinds of the channel acquire wait histogram
+const (
+	// getChannel, waiting for a channel of the pool
+	acquirePool = "pool"
+	// a publish waiting for a shared channel and a in-flight slot
+	acquirePublish = "publish"
+)
+
+// poolMetrics are the metrics of the pool
+type poolMetrics struct {
+	registry *metrics.Registry
+
+	publishes      *metrics.Counter
+	confirmLatency *metrics.Histogram
+	acquireWait    *metrics.Histogram
+
+	connOpened *metrics.Counter
+	connClosed *metrics.Counter
+	chaOpened  *metrics.Counter
+	chaClosed  *metrics.Counter
+
+	// l protects the exchanges labeled in the publishes counter
+	l         sync.Mutex
+	exchanges map[string]bool
+}
+
+func newPoolMetrics(cop *ConnPool) *poolMetrics {
+	r := metrics.NewRegistry()
+	m := &poolMetrics{
+		registry:  r,
+		exchanges: make(map[string]bool),
+
+		publishes: r.NewCounter("amqp_proxy_publishes_total",
+			"The publishes by exchange and result(ack, nack, returned, error).", "exchange", "result"),
+		confirmLatency: r.NewHistogram("amqp_proxy_publish_confirm_seconds",
+			"The seconds from a message published to it's confirm.", metrics.DefBuckets),
+		acquireWait: r.NewHistogram("amqp_proxy_channel_acquire_seconds",
+			"The seconds waiting for a channel of the pool(kind=pool) or a shared channel slot to publish(kind=publish).", metrics.DefBuckets, "kind"),
+
+		connOpened: r.NewCounter("amqp_proxy_connections_opened_total",
+			"The connections opened."),
+		connClosed: r.NewCounter("amqp_proxy_connections_closed_total",
+			"The connections removed from the pool by reason.", "reason"),
+		chaOpened: r.NewCounter("amqp_proxy_channels_opened_total",
+			"The channels opened."),
+		chaClosed: r.NewCounter("amqp_proxy_channels_closed_total",
+			"The channels closed by reason.", "reason"),
+	}
+
+	r.NewGaugeFunc("amqp_proxy_connections", "The connections in the pool.", func() float64 {
+		cop.l.Lock()
+		defer cop.l.Unlock()
+		return float64(len(cop.conns))
+	})
+	r.NewGaugeFunc("amqp_proxy_connections_blocked", "The connections blocked by the server.", func() float64 {
+		cop.l.Lock()
+		defer cop.l.Unlock()
+		blocked := 0
+		for _, conn := range cop.conns {
+			if conn.isBlocked() {
+				blocked++
+			}
+		}
+		return float64(blocked)
+	})
+	r.NewGaugeFunc("amqp_proxy_channels_idle", "The idle channels in the pool.", func() float64 {
+		cop.l.Lock()
+		defer cop.l.Unlock()
+		return float64(len(cop.idleChas))
+	})
+	r.NewGaugeFunc("amqp_proxy_channels_busy", "The channels in use, including the shared publish channels and the consumers.", func() float64 {
+		return float64(cop.getChaBusyNum())
+	})
+	r.NewGaugeFunc("amqp_proxy_channel_waiters", "The requests waiting for a free channel when the connections reach the limit.", func() float64 {
+		return float64(cop.reqChaList.Len())
+	})
+	r.NewGaugeFunc("amqp_proxy_publishes_in_flight", "The publishes waiting for the confirms.", func() float64 {
+		return float64(atomic.LoadInt64(&cop.publisher.inFlight))
+	})
+	return m
+}
+
+// Metrics return the metrics registry of the pool, the http api adds it's metrics to it
+func (cop *ConnPool) Metrics() *metrics.Registry {
+	return cop.metrics.registry
+}
+
+// publish count the publish by the exchange and the result
+func (m *poolMetrics) publish(exchange string, result string) {
+	m.publishes.Inc(m.exchangeLabel(exchange, result), result)
+}
+
+// exchangeLabel return the exchange label of the publish result,
+// the exchange is labeled after the server accepted a publish to it, at most maxExchangeLabels exchanges are labeled,
+// the failed publishes of the labeled exchanges keep the label
+func (m *poolMetrics) exchangeLabel(exchange string, result string) string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.exchanges[exchange] {
+		return exchange
+	}
+	if result == resultError || len(m.exchanges) >= maxExchangeLabels {
+		return otherExchange
+	}
+	m.exchanges[exchange] = true
+	return exchange
+}
+
+// publishResult return the result label of the publish error
+func publishResult(err error) string {
+	switch err {
+	case nil:
+		return resultAck
+	case ErrNacked:
+		return resultNack
+	case ErrUnroutable:
+		return resultReturned
+	}
+	return resultError
+}
+
+// closeReason return the reason label of the connection closed by the server or network
+func closeReason(err *amqp.Error) string {
+	if err.Server {
+		return closeReasonServer
+	}
+	return closeReasonNetwork
+}
@@ -0,0 +1,32 @@
+package pool
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestExchangeLabel(t *testing.T) {
+	m := &poolMetrics{exchanges: make(map[string]bool)}
+
+	if l := m.exchangeLabel("missing", resultError); l != otherExchange || len(m.exchanges) != 0 {
+		t.Fatalf("failed publish of the unlabeled exchange labeled %q", l)
+	}
+	if l := m.exchangeLabel("orders", resultNack); l != "orders" {
+		t.Fatalf("accepted exchange labeled %q", l)
+	}
+	for i := 0; len(m.exchanges) < maxExchangeLabels; i++ {
+		m.exchangeLabel("e"+strconv.Itoa(i), resultAck)
+	}
+	if l := m.exchangeLabel("one-more", resultAck); l != otherExchange {
+		t.Fatalf("exchange over the limit labeled %q", l)
+	}
+	if l := m.exchangeLabel("orders", resultAck); l != "orders" {
+		t.Fatalf("labeled exchange folded after the limit: %q", l)
+	}
+	if l := m.exchangeLabel("orders", resultError); l != "orders" {
+		t.Fatalf("failed publish of the labeled exchange labeled %q", l)
+	}
+	if l := m.exchangeLabel("missing", resultError); l != otherExchange {
+		t.Fatalf("failed publish of the unlabeled exchange labeled %q after the limit", l)
+	}
+}
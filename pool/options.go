@@ -0,0 +1,59 @@
+package pool
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublishOptions contains the amqp message properties used when publishing a message
+// A nil *PublishOptions means DefaultPublishOptions
+type PublishOptions struct {
+	// Headers is the application or exchange specific fields
+	Headers amqp.Table `json:"headers,omitempty"`
+
+	ContentType     string    `json:"contentType,omitempty"`     // MIME content type
+	ContentEncoding string    `json:"contentEncoding,omitempty"` // MIME content encoding
+	DeliveryMode    uint8     `json:"deliveryMode,omitempty"`    // Transient (1) or Persistent (2)
+	Priority        uint8     `json:"priority,omitempty"`        // 0 to 9
+	CorrelationID   string    `json:"correlationId,omitempty"`   // correlation identifier
+	ReplyTo         string    `json:"replyTo,omitempty"`         // address to to reply to (ex: RPC)
+	Expiration      string    `json:"expiration,omitempty"`      // message expiration spec, in milliseconds
+	MessageID       string    `json:"messageId,omitempty"`       // message identifier
+	Timestamp       time.Time `json:"timestamp"`                 // RFC3339 in json
+	Type            string    `json:"type,omitempty"`            // message type name
+	UserID          string    `json:"userId,omitempty"`          // creating user id, must be the connection user if not empty
+	AppID           string    `json:"appId,omitempty"`           // creating application id
+}
+
+// DefaultPublishOptions return the options used by ConfirmSendMsg:
+// a persistent text/plain message
+func DefaultPublishOptions() *PublishOptions {
+	return &PublishOptions{
+		ContentType:  "text/plain",
+		DeliveryMode: amqp.Persistent,
+	}
+}
+
+// publishing build the amqp.Publishing with the given body
+func (opts *PublishOptions) publishing(data []byte) amqp.Publishing {
+	if opts == nil {
+		opts = DefaultPublishOptions()
+	}
+	return amqp.Publishing{
+		Headers:         opts.Headers,
+		ContentType:     opts.ContentType,
+		ContentEncoding: opts.ContentEncoding,
+		DeliveryMode:    opts.DeliveryMode,
+		Priority:        opts.Priority,
+		CorrelationId:   opts.CorrelationID,
+		ReplyTo:         opts.ReplyTo,
+		Expiration:      opts.Expiration,
+		MessageId:       opts.MessageID,
+		Timestamp:       opts.Timestamp,
+		Type:            opts.Type,
+		UserId:          opts.UserID,
+		AppId:           opts.AppID,
+		Body:            data,
+	}
+}
@@ -1,15 +1,18 @@
 package pool
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/ngaut/log"
 	"github.com/streadway/amqp"
 
 	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/trace"
 	"github.com/iyidan/http-proxy-amqp/util"
 )
 
@@ -29,6 +32,10 @@ var (
 
 	// ErrPoolClosed occured when the pool was closed
 	ErrPoolClosed = errors.New("pool closed")
+
+	// ErrUnroutable occured when the mandatory message is returned by the server,
+	// that means no queue is bound to the exchange with the routing key
+	ErrUnroutable = errors.New("message unroutable")
 )
 
 // Connection represent a amqp real connection, which record the connection to user
@@ -36,6 +43,45 @@ type Connection struct {
 	conn             *amqp.Connection
 	l                sync.RWMutex
 	numOpenedChannel int
+	// maxChannels is MaxChannelsPerConnection limited by the negotiated channel max
+	maxChannels int
+
+	// bad is true if the connection is broken, it's channels are not reused
+	bad bool
+
+	// blocked is true if the server blocked the connection(connection.blocked)
+	blocked       bool
+	blockedReason string
+
+	// slot is the pool index of the connection in the connection_name
+	slot int
+}
+
+func (conn *Connection) isBlocked() bool {
+	conn.l.RLock()
+	defer conn.l.RUnlock()
+	return conn.blocked
+}
+
+// setBlocked record the connection.blocked/connection.unblocked notification
+func (conn *Connection) setBlocked(b amqp.Blocking) {
+	conn.l.Lock()
+	defer conn.l.Unlock()
+	conn.blocked = b.Active
+	conn.blockedReason = b.Reason
+}
+
+// markBad mark the connection is broken
+func (conn *Connection) markBad() {
+	conn.l.Lock()
+	defer conn.l.Unlock()
+	conn.bad = true
+}
+
+func (conn *Connection) isBad() bool {
+	conn.l.RLock()
+	defer conn.l.RUnlock()
+	return conn.bad
 }
 
 func (conn *Connection) getNumOpenedChannel() int {
@@ -48,7 +94,7 @@ func (conn *Connection) openChannel() (*Channel, error) {
 	conn.l.Lock()
 	defer conn.l.Unlock()
 
-	if conn.conn == nil {
+	if conn.conn == nil || conn.bad {
 		return nil, ErrBadConn
 	}
 
@@ -58,15 +104,22 @@ func (conn *Connection) openChannel() (*Channel, error) {
 	}
 
 	cha := &Channel{
-		conn: conn,
-		cha:  amqpCha,
+		conn:       conn,
+		cha:        amqpCha,
+		pending:    make(map[uint64]*pendingPublish),
+		dispatched: make(chan struct{}),
 	}
+	cha.closeCh = amqpCha.NotifyClose(make(chan *amqp.Error, 1))
+	cha.dispatchCloseCh = amqpCha.NotifyClose(make(chan *amqp.Error, 1))
 
 	// always in confirm mode
 	if err := cha.cha.Confirm(false); err != nil {
+		amqpCha.Close()
 		return nil, util.WrapError(err, "channel set to confirm mode failed")
 	}
-	cha.confirmCh = cha.cha.NotifyPublish(make(chan amqp.Confirmation, 1))
+	cha.confirmCh = cha.cha.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize))
+	cha.returnCh = cha.cha.NotifyReturn(make(chan amqp.Return, confirmBufferSize))
+	go cha.dispatch()
 
 	conn.numOpenedChannel++
 	return cha, nil
@@ -87,10 +140,11 @@ func (conn *Connection) close(force bool) error {
 		return ErrChannelNotAllClosed
 	}
 
-	if conn.conn != nil {
+	// the connection may be already closed by the server or network
+	if conn.conn != nil && !conn.conn.IsClosed() {
 		err := conn.conn.Close()
 		if err != nil {
-			log.Warnf("Connection.close: %s\n", err)
+			log.Warn("Connection.close failed", log.Fields{"error": err})
 		}
 	}
 	conn.conn = nil
@@ -102,10 +156,30 @@ type Channel struct {
 	conn      *Connection
 	cha       *amqp.Channel
 	confirmCh chan amqp.Confirmation
+	returnCh  chan amqp.Return
+	closeCh   chan *amqp.Error
+	// dispatchCloseCh is the close error for the dispatcher
+	dispatchCloseCh chan *amqp.Error
+
+	// pl serializes the publishes and the close
+	pl sync.Mutex
+	// deliveryTag is the tag of the last published message on this channel
+	// the confirm of a message has the same delivery tag
+	deliveryTag uint64
+
+	// l protects the pending publishes waiting for the confirms by the delivery tag
+	l            sync.Mutex
+	pending      map[uint64]*pendingPublish
+	dispatchDone bool
+	// dispatched is closed when the channel closed and the pending publishes are failed
+	dispatched chan struct{}
 }
 
 // close the amqp channel and decr it's connection numOpenedChannel
 func (cha *Channel) close() {
+	cha.pl.Lock()
+	defer cha.pl.Unlock()
+
 	// not care about channel close error, because it's the client action
 	cha.cha.Close()
 
@@ -120,12 +194,47 @@ type ConnPoolStats struct {
 	ConnNum    int
 	BusyChaNum int32
 	ReqChaNum  int
+
+	// Reconnecting is true when the pool is restoring the connections in background
+	Reconnecting bool
+	// DialError is the last dial error if the server is unreachable
+	DialError string `json:",omitempty"`
+
+	// LeaseNum is the leases of the unsettled deliveries received by Get
+	LeaseNum int
+
+	// ConsumerNum is the running consumers, each holds a busy channel
+	ConsumerNum int32
+	// Consumers are the states of the webhook consumers
+	Consumers []*ConsumerStats `json:",omitempty"`
+
+	// BlockedConnNum is the connections blocked by the server(connection.blocked)
+	BlockedConnNum int
+
+	// the connections and channels closed by the server or network
+	ConnClosedNum int64
+	ChaClosedNum  int64
+	LastConnClose *CloseReason `json:",omitempty"`
+	LastChaClose  *CloseReason `json:",omitempty"`
+
+	// Topology is the result of the last config topology apply
+	Topology *TopologyReport `json:",omitempty"`
+
+	// Spool is the states of the disk spool if it's enabled
+	Spool *SpoolStats `json:",omitempty"`
+
+	// the publishes on the shared channels waiting for the confirms, and the confirmed results
+	PublishInFlight int64
+	PublishAcked    int64
+	PublishFailed   int64
 }
 
 // ConnPool is the real connection pool
 type ConnPool struct {
 	conf  *config.Config
 	conns []*Connection
+	// slots are the pool indexes in use by the connections and the dials, the index is in the connection_name
+	slots []bool
 
 	// defer close the unused connection to reduce pool lock time
 	connDelayCloseCh chan *Connection
@@ -140,7 +249,49 @@ type ConnPool struct {
 
 	chaBusyNum int32
 
+	// reconnecting is true when the reconnect loop is running
+	reconnecting bool
+	// dialErr is the last dial error of the reconnect loop,
+	// getConn fails fast with it until the server is reachable again
+	dialErr error
+	// channelMaxOnce warns the channel max negotiated lower than MaxChannelsPerConnection
+	channelMaxOnce sync.Once
+
+	// leases of the manual acked deliveries received by Get
+	leaseL sync.Mutex
+	leases map[string]*Lease
+
+	// consumerNum is the running consumers started by Consume
+	consumerNum int32
+	// webhooks are the webhook consumers started by StartConsumers
+	webhooks []*webhookConsumer
+
+	// unblockedCh is closed and renewed when any connection is unblocked
+	unblockedCh chan struct{}
+
+	// close stats of the connections and channels closed by the server or network
+	connClosedNum int64
+	chaClosedNum  int64
+	lastConnClose *CloseReason
+	lastChaClose  *CloseReason
+
+	// topologyL serializes the topology applies
+	topologyL sync.Mutex
+	// topologyStale is true when the config topology should be applied again by the next new connection
+	topologyStale bool
+	// lastTopology is the result of the last topology apply
+	lastTopology *TopologyReport
+
+	// spool is the forwarder of the spooled messages started by StartSpool
+	spool *spoolForwarder
+
+	// publisher shares the channels among the publishes
+	publisher *publisher
+
+	metrics *poolMetrics
+
 	closed bool
+	done   chan struct{}
 }
 
 // NewPool return a pool inited with the given config
@@ -155,13 +306,26 @@ func NewPool(conf *config.Config) *ConnPool {
 		idleChas: make([]*Channel, 0, conf.MaxIdleChannels),
 
 		reqChaList: &ReqChaList{},
+
+		leases: make(map[string]*Lease),
+
+		unblockedCh: make(chan struct{}),
+
+		done: make(chan struct{}),
 	}
 
+	pool.metrics = newPoolMetrics(pool)
+	pool.publisher = newPublisher(pool)
+
+	// fail fast on the invalid tls files, they are read again per dial
+	_, err := newClientTLSConfig(&conf.TLS)
+	util.FailOnError(err, "load amqp tls files failed")
+
 	go func() {
 		for conn := range pool.connDelayCloseCh {
 			err := conn.close(true)
 			if err != nil {
-				log.Warnf("conn.close: %s\n", err)
+				log.Warn("conn.close failed", log.Fields{"error": err})
 			}
 		}
 		close(pool.connDelayClosed)
@@ -201,29 +365,34 @@ func (cop *ConnPool) close() {
 		return
 	}
 	cop.closed = true
+	close(cop.done)
+
+	// wake up the channel waiters, they will get ErrPoolClosed
+	cop.reqChaList.NotifyAll()
 
 	// wait for connection all closed
 	close(cop.connDelayCloseCh)
 	<-cop.connDelayClosed
 
 	for i, cha := range cop.idleChas {
-		cha.close()
+		cop.closeChannel(cha, closeReasonShutdown)
 		cop.idleChas[i] = nil
 	}
 	cop.idleChas = nil
 
 	for i, conn := range cop.conns {
 		conn.close(true)
+		cop.metrics.connClosed.Inc(closeReasonShutdown)
 		cop.conns[i] = nil
 	}
 	cop.conns = nil
+	cop.slots = nil
 }
 
-func (cop *ConnPool) removeConn(conn *Connection) error {
+// removeConn remove the connection from the pool and close it, reason is the label of the closes counter
+func (cop *ConnPool) removeConn(conn *Connection, reason string) error {
 
-	if cop.conf.Debug {
-		log.Debug("[conn] old conn closed")
-	}
+	log.Debug("[conn] old conn closed", log.Fields{"reason": reason})
 
 	foundIdx := -1
 	for i := 0; i < len(cop.conns); i++ {
@@ -237,6 +406,8 @@ func (cop *ConnPool) removeConn(conn *Connection) error {
 		copy(cop.conns[foundIdx:], cop.conns[foundIdx+1:])
 		cop.conns[len(cop.conns)-1] = nil
 		cop.conns = cop.conns[:len(cop.conns)-1]
+		cop.releaseSlot(conn.slot)
+		cop.metrics.connClosed.Inc(reason)
 	}
 
 	// if pool closed , direct close the connection
@@ -254,43 +425,91 @@ func (cop *ConnPool) removeConn(conn *Connection) error {
 
 func (cop *ConnPool) getConn() (*Connection, error) {
 	if len(cop.conns) > 0 {
+		blocked := 0
 		for i := 0; i < len(cop.conns); i++ {
+			// prefer the unblocked connections
+			if cop.conns[i].isBlocked() {
+				blocked++
+				continue
+			}
 			// notice: the first connection may handel more channels
-			if cop.conns[i].getNumOpenedChannel() < cop.conf.MaxChannelsPerConnection {
+			if cop.conns[i].getNumOpenedChannel() < cop.conns[i].maxChannels {
 				return cop.conns[i], nil
 			}
 		}
+		// the server blocks all the publishing connections when it's alarmed,
+		// a new connection will be blocked too
+		if blocked == len(cop.conns) {
+			return nil, cop.blockedError()
+		}
 	}
 
 	if cop.conf.MaxConnections > 0 && len(cop.conns) >= cop.conf.MaxConnections {
 		return nil, ErrTooManyConn
 	}
 
-	amqpConn, err := amqp.Dial(cop.conf.DSN)
+	// the server is unreachable, wait for the reconnect loop
+	if cop.dialErr != nil {
+		return nil, cop.dialErr
+	}
+
+	slot := cop.acquireSlot()
+	amqpConn, err := cop.dial(slot)
 	if err != nil {
-		return nil, util.WrapError(err, "amqp.Dial")
+		log.Error("ConnPool.getConn: amqp.Dial failed", log.Fields{"error": err})
+		cop.releaseSlot(slot)
+		cop.dialErr = &ConnError{Op: "dial", Err: err}
+		cop.startReconnect()
+		return nil, cop.dialErr
 	}
-	conn := &Connection{conn: amqpConn, numOpenedChannel: 0}
+	conn := cop.newConnection(amqpConn, slot)
 	cop.conns = append(cop.conns, conn)
 
-	if cop.conf.Debug {
-		log.Debug("[conn] new conn opened")
-	}
+	log.Debug("[conn] new conn opened")
 
 	return conn, nil
 }
 
 // Stats return current pool states
 func (cop *ConnPool) Stats() *ConnPoolStats {
+	// Notice: leaseL is locked before cop.l in Settle
+	cop.leaseL.Lock()
+	leaseNum := len(cop.leases)
+	cop.leaseL.Unlock()
+
 	cop.l.Lock()
 	defer cop.l.Unlock()
 
-	return &ConnPoolStats{
-		IdleChaNum: len(cop.idleChas),
-		ConnNum:    len(cop.conns),
-		BusyChaNum: cop.getChaBusyNum(),
-		ReqChaNum:  cop.reqChaList.Len(),
+	stats := &ConnPoolStats{
+		IdleChaNum:   len(cop.idleChas),
+		ConnNum:      len(cop.conns),
+		BusyChaNum:   cop.getChaBusyNum(),
+		ReqChaNum:    cop.reqChaList.Len(),
+		Reconnecting: cop.reconnecting,
+
+		ConnClosedNum: cop.connClosedNum,
+		ChaClosedNum:  cop.chaClosedNum,
+		LastConnClose: cop.lastConnClose,
+		LastChaClose:  cop.lastChaClose,
+
+		Topology: cop.lastTopology,
+	}
+	if cop.dialErr != nil {
+		stats.DialError = cop.dialErr.Error()
+	}
+	for _, conn := range cop.conns {
+		if conn.isBlocked() {
+			stats.BlockedConnNum++
+		}
 	}
+	stats.LeaseNum = leaseNum
+	stats.ConsumerNum = atomic.LoadInt32(&cop.consumerNum)
+	stats.Consumers = cop.consumerStats()
+	stats.Spool = cop.spoolStats()
+	stats.PublishInFlight = atomic.LoadInt64(&cop.publisher.inFlight)
+	stats.PublishAcked = atomic.LoadInt64(&cop.publisher.acked)
+	stats.PublishFailed = atomic.LoadInt64(&cop.publisher.failed)
+	return stats
 }
 
 func (cop *ConnPool) putChannel(cha *Channel) {
@@ -307,7 +526,7 @@ func (cop *ConnPool) putChannel(cha *Channel) {
 	cop.l.Unlock()
 
 	if lenFree >= cop.conf.MaxIdleChannels {
-		cop.probeCloseChannel(cha)
+		cop.probeCloseChannel(cha, closeReasonIdle)
 		return
 	}
 
@@ -318,9 +537,19 @@ func (cop *ConnPool) putChannel(cha *Channel) {
 }
 
 // getChannel get a free channel from pool
-func (cop *ConnPool) getChannel() (*Channel, error) {
+// it waits for a free channel when the connections reach the limit, until ctx is done
+func (cop *ConnPool) getChannel(ctx context.Context) (*Channel, error) {
+	start := time.Now()
+	defer cop.metrics.acquireWait.Since(start, acquirePool)
+
+	// the deadline of waiting for the blocked connections
+	var blockedDeadline time.Time
 
 GETFREECHANNEL:
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	cop.l.Lock()
 
 	if cop.closed {
@@ -328,11 +557,21 @@ GETFREECHANNEL:
 		return nil, ErrPoolClosed
 	}
 
-	// step1: reuse free channels
-	if len(cop.idleChas) > 0 {
-		var cha *Channel
-		// shift from free pool
-		cha, cop.idleChas = cop.idleChas[0], cop.idleChas[1:]
+	// step1: reuse free channels, skip the channels of blocked connections
+	for i := 0; i < len(cop.idleChas); {
+		cha := cop.idleChas[i]
+		bad := cha.conn.isBad()
+		if !bad && cha.conn.isBlocked() {
+			i++
+			continue
+		}
+		cop.removeIdleChannel(i)
+
+		// the channels of a bad connection are broken
+		if bad {
+			cop.closeChannel(cha, closeReasonConnClosed)
+			continue
+		}
 		cop.incrChaBusyNum()
 
 		cop.l.Unlock()
@@ -341,124 +580,170 @@ GETFREECHANNEL:
 
 	// step2: get connection
 	conn, err := cop.getConn()
-	if err == ErrTooManyConn {
+	if be, ok := err.(*BlockedError); ok {
+		unblockedCh := cop.unblockedCh
+		// unlock
+		cop.l.Unlock()
+
+		if blockedDeadline.IsZero() {
+			blockedDeadline = time.Now().Add(time.Duration(cop.conf.BlockedWaitTimeout) * time.Millisecond)
+		}
+		// wait for any connection unblocked, fail fast if BlockedWaitTimeout is 0
+		if !waitUnblocked(ctx, unblockedCh, blockedDeadline) {
+			return nil, be
+		}
+
+		// retry
+		goto GETFREECHANNEL
+	} else if err == ErrTooManyConn {
 		// unlock
 		cop.l.Unlock()
 
 		// wait for available channel
 		// if wait return and has a free channel, use it
-		ch := make(chan *Channel)
+		ch := make(chan *Channel, 1)
 		cop.reqChaList.Put(ch)
-		if cha := <-ch; cha != nil {
-			cop.incrChaBusyNum()
-			return cha, nil
+		select {
+		case cha := <-ch:
+			if cha != nil {
+				cop.incrChaBusyNum()
+				return cha, nil
+			}
+		case <-ctx.Done():
+			// the channel may be notified before removed, give it back
+			if !cop.reqChaList.Remove(ch) {
+				if cha := <-ch; cha != nil {
+					cop.incrChaBusyNum()
+					cop.putChannel(cha)
+				}
+			}
+			return nil, ctx.Err()
 		}
 
 		// retry
 		goto GETFREECHANNEL
 	} else if err != nil {
-		cop.close()
 		// unlock
 		cop.l.Unlock()
-		util.FailOnError(err, "ConnPool.getChannel")
+		return nil, err
 	}
 
 	// step3: open new channel
 	cha, err := conn.openChannel()
 
 	if err == amqp.ErrClosed || err == ErrBadConn {
-		log.Warnf("ConnPool.getChannel: %s", ErrBadConn)
-		cop.removeConn(conn)
+		log.Warn("ConnPool.getChannel: bad connection", log.Fields{"error": err})
+		conn.markBad()
+		cop.removeConn(conn, closeReasonBroken)
 		// unlock
 		cop.l.Unlock()
 		goto GETFREECHANNEL
 	} else if err == amqp.ErrChannelMax {
-		log.Warnf("ConnPool.getChannel: %s", amqp.ErrChannelMax)
+		log.Warn("ConnPool.getChannel: channel max reached", log.Fields{"error": err})
 		cop.l.Unlock()
 		goto GETFREECHANNEL
 	} else if err != nil {
-		cop.close()
+		log.Error("ConnPool.getChannel: open channel failed", log.Fields{"error": err})
+		// the connection may be broken, stop using it and restore the capacity in background
+		conn.markBad()
+		cop.removeConn(conn, closeReasonBroken)
+		cop.startReconnect()
 		// unlock
 		cop.l.Unlock()
-		util.FailOnError(err, "ConnPool.getChannel")
+		return nil, &ConnError{Op: "open channel", Err: err}
 	}
+	go cop.watchChannel(cha, cha.closeCh)
+	cop.metrics.chaOpened.Inc()
 
 	cop.incrChaBusyNum()
 
-	if cop.conf.Debug {
-		log.Debug("[channel] new channel opened")
-	}
+	log.Debug("[channel] new channel opened")
 
 	// unlock
 	cop.l.Unlock()
 	return cha, nil
 }
 
-func (cop *ConnPool) probeCloseChannel(cha *Channel) {
+// discardChannel close a busy channel which may has outstanding confirms or is broken
+// the pending publishes are failed by the channel dispatcher
+func (cop *ConnPool) discardChannel(cha *Channel) {
+	cop.decrChaBusyNum()
+	cop.probeCloseChannel(cha, closeReasonDiscarded)
+}
+
+// probeCloseChannel close the channel, and it's connection if it's unused and more than MinConnections
+func (cop *ConnPool) probeCloseChannel(cha *Channel, reason string) {
 	conn := cha.conn
-	cha.close()
+	cop.closeChannel(cha, reason)
 
-	if cop.conf.Debug {
-		log.Debug("[channel] old channel closed")
-	}
+	log.Debug("[channel] old channel closed", log.Fields{"reason": reason})
 
 	cop.l.Lock()
 	defer cop.l.Unlock()
 	if conn.getNumOpenedChannel() == 0 && len(cop.conns) > cop.conf.MinConnections {
-		cop.removeConn(conn)
+		cop.removeConn(conn, closeReasonIdle)
 	}
 }
 
-// ConfirmSendMsg send message with confirm mode
+// closeChannel close the channel, reason is the label of the closes counter
+func (cop *ConnPool) closeChannel(cha *Channel, reason string) {
+	cha.close()
+	cop.metrics.chaClosed.Inc(reason)
+}
+
+// ConfirmSendMsg send a persistent text/plain message with confirm mode
 func (cop *ConnPool) ConfirmSendMsg(exchange string, routingKey string, data []byte) error {
+	return cop.ConfirmSendMsgWithOptions(exchange, routingKey, data, nil)
+}
+
+// ConfirmSendMsgWithOptions send message with confirm mode and the given message properties
+// if opts is nil, DefaultPublishOptions is used
+func (cop *ConnPool) ConfirmSendMsgWithOptions(exchange string, routingKey string, data []byte, opts *PublishOptions) error {
+	return cop.ConfirmSendMsgContext(context.Background(), exchange, routingKey, data, opts)
+}
+
+// ConfirmSendMsgContext send message with confirm mode and the given message properties,
+// waiting for a free channel and the server confirm until ctx is done.
+// if ctx is done before the message is published, ctx.Err() is returned,
+// if it's done while waiting for the confirm, *ConfirmTimeoutError is returned and the message may or may not be delivered.
+func (cop *ConnPool) ConfirmSendMsgContext(ctx context.Context, exchange string, routingKey string, data []byte, opts *PublishOptions) (err error) {
 
-	if cop.conf.Debug {
+	if log.Enabled(log.DebugLevel) {
 		defer func() {
 			stats, _ := json.Marshal(cop.Stats())
-			conf, _ := json.Marshal(cop.conf)
-			log.Debugf("debugStats: %s %s\n", stats, conf)
+			log.Debug("debugStats", log.Fields{"stats": json.RawMessage(stats)})
 		}()
 	}
 
-	var err error
-	var cha *Channel
-
-	for i := 0; i < 5; i++ {
-		cha, err = cop.getChannel()
-		if err != nil {
-			return err
-		}
-		err = cha.cha.Publish(
-			exchange,   // exchange
-			routingKey, // routing key
-			true,       // mandatory，若为true，则当没有对应的队列，不ack
-			false,      // immediate，若为true，则当没有消费者消费，不ack
-			amqp.Publishing{
-				ContentType:  "text/plain",
-				Body:         data,
-				DeliveryMode: 2, // 持久消息
-			})
-		if err == nil {
-			break
-		}
-		cop.probeCloseChannel(cha)
-	}
+	ctx, span := startPublishSpan(ctx, spanPublish, exchange, routingKey)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	msg := opts.publishing(data)
+	injectTrace(&msg, span.Context())
 
+	p, err := cop.publisher.send(ctx, exchange, routingKey, msg, nil)
 	if err != nil {
-		return util.WrapError(err, "Failed to publish a message")
+		return err
 	}
 
 	// waiting for the server confirm
-	confirmed := <-cha.confirmCh
-
-	// put current channel into idle pool
-	cop.putChannel(cha)
-	//cop.idleChaPutCh <- cha
+	_, wait := trace.StartSpan(ctx, spanConfirmWait, trace.KindInternal)
+	confirmed := p.wait(ctx.Done())
+	wait.End()
+	if !confirmed {
+		log.Warn("ConfirmSendMsg: waiting confirm failed", log.Fields{"exchange": exchange, "routingKey": routingKey, "error": ctx.Err()})
+		return &ConfirmTimeoutError{Err: ctx.Err()}
+	}
 
-	if confirmed.Ack {
+	switch p.err {
+	case nil:
 		return nil
+	case ErrUnroutable:
+		log.Warn("ConfirmSendMsg: message returned", log.Fields{"exchange": exchange, "routingKey": routingKey, "error": ErrUnroutable})
+	default:
+		log.Error("ConfirmSendMsg: message not acked", log.Fields{"exchange": exchange, "routingKey": routingKey, "deliveryTag": p.tag, "payload": log.Payload(data), "error": p.err})
 	}
-	// @todo if channel closed by putChannel method, message would nacked
-	log.Errorf("%s: %#v, %s, %x\n", ErrNacked, confirmed, data, data)
-	return ErrNacked
+	return p.err
 }
@@ -0,0 +1,117 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+// newFullPool return a pool reached MaxConnections with it's only connection out of channels
+func newFullPool() (*ConnPool, *Connection) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1, MaxInFlightPerChannel: 10})
+	conn := &Connection{numOpenedChannel: 1, maxChannels: 1}
+	cop.conns = append(cop.conns, conn)
+	return cop, conn
+}
+
+// waitWaiters wait for n channel waiters of the pool
+func waitWaiters(t *testing.T, cop *ConnPool, n int) {
+	for i := 0; cop.reqChaList.Len() != n; i++ {
+		if i > 100 {
+			t.Fatalf("%d channel waiters, expected %d", cop.reqChaList.Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetChannelWaitDeadline(t *testing.T) {
+	cop, _ := newFullPool()
+	defer cop.CloseAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	cha, err := cop.getChannel(ctx)
+	if cha != nil || err != context.DeadlineExceeded {
+		t.Fatalf("getChannel = %v, %v, expected DeadlineExceeded", cha, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("getChannel returned after %s", d)
+	}
+	// the waiter gave up is removed
+	if n := cop.reqChaList.Len(); n != 0 {
+		t.Fatalf("%d channel waiters left", n)
+	}
+
+	// the done ctx fails before waiting
+	if _, err := cop.getChannel(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("getChannel with the done ctx = %v", err)
+	}
+}
+
+func TestGetChannelWaitNotified(t *testing.T) {
+	cop, conn := newFullPool()
+	defer cop.CloseAll()
+
+	got := make(chan *Channel, 1)
+	go func() {
+		cha, err := cop.getChannel(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- cha
+	}()
+	waitWaiters(t, cop, 1)
+
+	// the channel put back is handed to the waiter instead of the idle channels
+	cha := &Channel{conn: conn}
+	cop.incrChaBusyNum()
+	cop.putChannel(cha)
+	select {
+	case c := <-got:
+		if c != cha {
+			t.Fatalf("getChannel = %p, expected the channel put back %p", c, cha)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter is not notified")
+	}
+	if len(cop.idleChas) != 0 || cop.getChaBusyNum() != 1 {
+		t.Fatalf("idle channels %d busy %d", len(cop.idleChas), cop.getChaBusyNum())
+	}
+}
+
+func TestGetChannelWaitPoolClosed(t *testing.T) {
+	cop, _ := newFullPool()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cop.getChannel(context.Background())
+		errs <- err
+	}()
+	waitWaiters(t, cop, 1)
+
+	cop.CloseAll()
+	select {
+	case err := <-errs:
+		if err != ErrPoolClosed {
+			t.Fatalf("getChannel = %v, expected ErrPoolClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter is not woken up by the close")
+	}
+}
+
+func TestPendingPublishWait(t *testing.T) {
+	p := &pendingPublish{confirmed: make(chan struct{})}
+	done := make(chan struct{})
+	close(done)
+	if p.wait(done) {
+		t.Fatal("wait = true before confirmed")
+	}
+	p.finish()
+	if !p.wait(nil) {
+		t.Fatal("wait = false after confirmed")
+	}
+}
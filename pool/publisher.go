@@ -0,0 +1,247 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// confirmBufferSize is the buffer of the confirm and return notifications of a channel,
+// so the connection reader is rarely waiting for the channel dispatcher
+const confirmBufferSize = 128
+
+// maxKnownExchanges bounds the exchanges known to exist, they are forgotten when it's full
+const maxKnownExchanges = 10000
+
+// publisher shares a fixed number of channels among the publishes,
+// each channel has at most MaxInFlightPerChannel unconfirmed publishes,
+// the confirms are dispatched to the publishes by the delivery tag
+type publisher struct {
+	cop   *ConnPool
+	slots []*sharedChannel
+	next  uint32
+
+	// known is the exchanges checked to exist. A publish to a missing exchange closes the channel
+	// and fails the other publishes in flight on it, so the unknown exchanges are checked on a pooled channel first
+	knownL sync.Mutex
+	known  map[string]bool
+	// declarePassive is the passive exchange declare, it's replaced by the tests
+	declarePassive func(ctx context.Context, exchange string) error
+
+	// stats of the publishes
+	inFlight int64
+	acked    int64
+	failed   int64
+}
+
+// sharedChannel is a slot of the publisher, the channel is reopened when it's closed
+type sharedChannel struct {
+	p *publisher
+
+	// l protects the channel and serializes the reopen
+	l   sync.Mutex
+	cha *Channel
+
+	// sem limits the in-flight publishes
+	sem chan struct{}
+}
+
+func newPublisher(cop *ConnPool) *publisher {
+	p := &publisher{
+		cop:            cop,
+		slots:          make([]*sharedChannel, cop.conf.PublishChannels),
+		known:          make(map[string]bool),
+		declarePassive: cop.declareExchangePassive,
+	}
+	for i := range p.slots {
+		p.slots[i] = &sharedChannel{
+			p:   p,
+			sem: make(chan struct{}, cop.conf.MaxInFlightPerChannel),
+		}
+	}
+	return p
+}
+
+// isChannelClosed report whether the publish failed because the channel is closed
+func isChannelClosed(err error) bool {
+	if err == amqp.ErrClosed {
+		return true
+	}
+	_, ok := err.(*amqp.Error)
+	return ok
+}
+
+// channelClosedError return the ChannelClosedError of the publish failed by the closed channel,
+// so the callers tell it from the other publish errors
+func channelClosedError(err error) error {
+	e, _ := err.(*amqp.Error)
+	return &ChannelClosedError{Err: e}
+}
+
+// channel return the open channel of the slot, a new channel is got from the pool if it's closed
+func (sc *sharedChannel) channel(ctx context.Context) (*Channel, error) {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+
+	if sc.cha != nil && !sc.cha.isClosed() {
+		return sc.cha, nil
+	}
+	if sc.cha != nil {
+		// the pending publishes are failed by the dispatcher
+		sc.p.cop.discardChannel(sc.cha)
+		sc.cha = nil
+	}
+	cha, err := sc.p.cop.getChannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc.cha = cha
+	return cha, nil
+}
+
+// acquire a channel of a unblocked connection in round robin,
+// if all the connections are blocked, wait the same as getChannel
+func (p *publisher) acquire(ctx context.Context) (*sharedChannel, *Channel, error) {
+	var blockedDeadline time.Time
+	for {
+		start := atomic.AddUint32(&p.next, 1)
+		for i := 0; i < len(p.slots); i++ {
+			sc := p.slots[(start+uint32(i))%uint32(len(p.slots))]
+			cha, err := sc.channel(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !cha.conn.isBlocked() {
+				return sc, cha, nil
+			}
+		}
+
+		cop := p.cop
+		cop.l.Lock()
+		be := cop.blockedError()
+		unblockedCh := cop.unblockedCh
+		cop.l.Unlock()
+
+		if blockedDeadline.IsZero() {
+			blockedDeadline = time.Now().Add(time.Duration(cop.conf.BlockedWaitTimeout) * time.Millisecond)
+		}
+		// wait for any connection unblocked, fail fast if BlockedWaitTimeout is 0
+		if !waitUnblocked(ctx, unblockedCh, blockedDeadline) {
+			return nil, nil, be
+		}
+	}
+}
+
+// checkExchange check the exchange exists by a passive declare on a pooled channel if it's not known,
+// so the missing exchange gets the NOT_FOUND error without closing the shared channel
+func (p *publisher) checkExchange(ctx context.Context, exchange string) error {
+	// the default exchange always exists
+	if len(exchange) == 0 {
+		return nil
+	}
+	p.knownL.Lock()
+	known := p.known[exchange]
+	p.knownL.Unlock()
+	if known {
+		return nil
+	}
+
+	if err := p.declarePassive(ctx, exchange); err != nil {
+		return err
+	}
+	p.knownL.Lock()
+	if len(p.known) >= maxKnownExchanges {
+		p.known = make(map[string]bool)
+	}
+	p.known[exchange] = true
+	p.knownL.Unlock()
+	return nil
+}
+
+// forgetExchange forget the deleted exchange, all the exchanges are forgotten if name is empty
+func (p *publisher) forgetExchange(name string) {
+	p.knownL.Lock()
+	defer p.knownL.Unlock()
+	if len(name) == 0 {
+		p.known = make(map[string]bool)
+		return
+	}
+	delete(p.known, name)
+}
+
+// send check the exchange and publish the message, it's retried on the new channel if the shared channel is closed,
+// the publish failed by the closed channel gets the ChannelClosedError
+func (p *publisher) send(ctx context.Context, exchange string, routingKey string, msg amqp.Publishing, done AsyncCallback) (*pendingPublish, error) {
+	if err := p.checkExchange(ctx, exchange); err != nil {
+		p.cop.metrics.publish(exchange, resultError)
+		return nil, err
+	}
+
+	var pp *pendingPublish
+	var err error
+	for i := 0; i < 5; i++ {
+		pp, err = p.publish(ctx, exchange, routingKey, msg, done)
+		if err == nil || !isChannelClosed(err) {
+			return pp, err
+		}
+	}
+	return nil, channelClosedError(err)
+}
+
+// publish the message on a shared channel, waiting for a in-flight slot until ctx is done,
+// done is called with the confirm result if it returns nil error
+func (p *publisher) publish(ctx context.Context, exchange string, routingKey string, msg amqp.Publishing, done AsyncCallback) (*pendingPublish, error) {
+	acq := startAcquisition(ctx)
+	sc, cha, err := p.acquire(ctx)
+	if err != nil {
+		acq.done(p.cop.metrics, err)
+		p.cop.metrics.publish(exchange, resultError)
+		return nil, err
+	}
+	return sc.publish(ctx, cha, acq, exchange, routingKey, msg, done)
+}
+
+// publish the message on the channel of the slot, acq is the wait began before the channel acquired
+func (sc *sharedChannel) publish(ctx context.Context, cha *Channel, acq acquisition, exchange string, routingKey string, msg amqp.Publishing, done AsyncCallback) (*pendingPublish, error) {
+	m := sc.p.cop.metrics
+	select {
+	case sc.sem <- struct{}{}:
+	case <-ctx.Done():
+		acq.done(m, ctx.Err())
+		m.publish(exchange, resultError)
+		return nil, ctx.Err()
+	}
+	acq.done(m, nil)
+
+	p := sc.p
+	atomic.AddInt64(&p.inFlight, 1)
+	published := time.Now()
+	pp, err := cha.publish(exchange, routingKey, msg, func(err error) {
+		atomic.AddInt64(&p.inFlight, -1)
+		if err == nil {
+			atomic.AddInt64(&p.acked, 1)
+		} else {
+			atomic.AddInt64(&p.failed, 1)
+		}
+		// a exchange is deleted after it's checked, check them again
+		if e, ok := err.(*ChannelClosedError); ok && e.Err != nil && e.Err.Code == amqp.NotFound {
+			p.forgetExchange("")
+		}
+		m.publish(exchange, publishResult(err))
+		m.confirmLatency.Since(published)
+		<-sc.sem
+		if done != nil {
+			done(err)
+		}
+	})
+	if err != nil {
+		atomic.AddInt64(&p.inFlight, -1)
+		m.publish(exchange, resultError)
+		<-sc.sem
+		return nil, err
+	}
+	return pp, nil
+}
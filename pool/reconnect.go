@@ -0,0 +1,125 @@
+package pool
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+// ConnError occured when dial the server or open a channel failed.
+// The pool is kept alive and restores the connections in background.
+type ConnError struct {
+	Op  string
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("pool: %s: %s", e.Op, e.Err)
+}
+
+// dial open a new amqp connection of the pool index slot, with TLS if the dsn is amqps://
+func (cop *ConnPool) dial(slot int) (*amqp.Connection, error) {
+	c, err := cop.amqpConfig(slot)
+	if err != nil {
+		return nil, err
+	}
+	return amqp.DialConfig(cop.conf.DSN, c)
+}
+
+// acquireSlot return the lowest pool index not in use and mark it in use
+// Notice: must be called with cop.l locked
+func (cop *ConnPool) acquireSlot() int {
+	for i, used := range cop.slots {
+		if !used {
+			cop.slots[i] = true
+			return i
+		}
+	}
+	cop.slots = append(cop.slots, true)
+	return len(cop.slots) - 1
+}
+
+// releaseSlot mark the pool index not in use
+// Notice: must be called with cop.l locked
+func (cop *ConnPool) releaseSlot(slot int) {
+	if slot < len(cop.slots) {
+		cop.slots[slot] = false
+	}
+}
+
+// startReconnect start the background reconnect loop if it's not running
+// Notice: must be called with cop.l locked
+func (cop *ConnPool) startReconnect() {
+	if cop.reconnecting || cop.closed {
+		return
+	}
+	cop.reconnecting = true
+	go cop.reconnectLoop()
+}
+
+// reconnectLoop dial the server with exponential backoff and jitter,
+// until the pool has MinConnections connections or the pool closed
+func (cop *ConnPool) reconnectLoop() {
+	minInterval := time.Duration(cop.conf.ReconnectInterval) * time.Millisecond
+	maxInterval := time.Duration(cop.conf.MaxReconnectInterval) * time.Millisecond
+	interval := minInterval
+
+	for {
+		select {
+		case <-time.After(jitter(interval)):
+		case <-cop.done:
+			return
+		}
+
+		cop.l.Lock()
+		if cop.closed || len(cop.conns) >= cop.conf.MinConnections {
+			cop.reconnecting = false
+			cop.dialErr = nil
+			cop.l.Unlock()
+			return
+		}
+		slot := cop.acquireSlot()
+		cop.l.Unlock()
+
+		amqpConn, err := cop.dial(slot)
+
+		cop.l.Lock()
+		if err != nil {
+			cop.releaseSlot(slot)
+			cop.dialErr = &ConnError{Op: "dial", Err: err}
+			cop.l.Unlock()
+
+			log.Warn("ConnPool.reconnectLoop: dial failed", log.Fields{"error": err, "retryInMs": interval})
+			if interval *= 2; interval > maxInterval {
+				interval = maxInterval
+			}
+			continue
+		}
+
+		if cop.closed {
+			cop.releaseSlot(slot)
+			cop.l.Unlock()
+			amqpConn.Close()
+			return
+		}
+		// the server is reachable again, let getConn dial on demand
+		cop.dialErr = nil
+		cop.conns = append(cop.conns, cop.newConnection(amqpConn, slot))
+		cop.l.Unlock()
+
+		log.Info("ConnPool.reconnectLoop: connection restored")
+		interval = minInterval
+	}
+}
+
+// jitter return a random duration in [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
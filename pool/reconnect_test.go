@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+// closedAddr return a local address refusing the connections
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestGetChannelDialFailed(t *testing.T) {
+	cop := NewPool(&config.Config{
+		DSN:                  "amqp://guest:guest@" + closedAddr(t) + "/",
+		MaxConnections:       2,
+		MinConnections:       1,
+		MaxIdleChannels:      1,
+		PublishChannels:      1,
+		DialTimeout:          1000,
+		ReconnectInterval:    10,
+		MaxReconnectInterval: 20,
+	})
+	defer cop.CloseAll()
+
+	_, err := cop.getChannel(context.Background())
+	ce, ok := err.(*ConnError)
+	if !ok || ce.Op != "dial" {
+		t.Fatalf("getChannel = %#v, expected the dial ConnError", err)
+	}
+
+	// the pool is alive and restoring the connections in background
+	stats := cop.Stats()
+	if !stats.Reconnecting || len(stats.DialError) == 0 || stats.ConnNum != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// fail fast with the dial error until the server is reachable
+	if _, err := cop.getChannel(context.Background()); err == nil || err.Error() != ce.Error() {
+		t.Fatalf("getChannel = %v, expected the last dial error", err)
+	}
+	// the reconnect loop keeps dialing
+	time.Sleep(100 * time.Millisecond)
+	if stats := cop.Stats(); !stats.Reconnecting || len(stats.DialError) == 0 {
+		t.Fatalf("reconnect loop stopped: %+v", stats)
+	}
+	cop.CloseAll()
+	if _, err := cop.getChannel(context.Background()); err != ErrPoolClosed {
+		t.Fatalf("getChannel after closed = %v, expected ErrPoolClosed", err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, d := range []time.Duration{0, 1, 2, time.Millisecond, time.Second} {
+		for i := 0; i < 100; i++ {
+			j := jitter(d)
+			if d <= 1 {
+				if j != d {
+					t.Fatalf("jitter(%s) = %s", d, j)
+				}
+				continue
+			}
+			if j < d/2 || j >= d {
+				t.Fatalf("jitter(%s) = %s, expected in [%s, %s)", d, j, d/2, d)
+			}
+		}
+	}
+}
@@ -23,6 +23,22 @@ func (rcl *ReqChaList) Put(ch chan *Channel) {
 	rcl.chs = append(rcl.chs, ch)
 }
 
+// Remove remove the wait ch from the set when the waiter gives up
+// return false if the ch is already notified, the waiter must receive from it
+func (rcl *ReqChaList) Remove(ch chan *Channel) bool {
+	rcl.l.Lock()
+	defer rcl.l.Unlock()
+	for i := 0; i < len(rcl.chs); i++ {
+		if rcl.chs[i] == ch {
+			copy(rcl.chs[i:], rcl.chs[i+1:])
+			rcl.chs[len(rcl.chs)-1] = nil
+			rcl.chs = rcl.chs[:len(rcl.chs)-1]
+			return true
+		}
+	}
+	return false
+}
+
 // NotifyOne notify the first wait chan
 func (rcl *ReqChaList) NotifyOne(cha *Channel) bool {
 	rcl.l.Lock()
@@ -0,0 +1,189 @@
+package pool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+	"github.com/iyidan/http-proxy-amqp/spool"
+)
+
+// ErrSpoolDisabled occured when spool a message without the spool
+var ErrSpoolDisabled = errors.New("pool: spool disabled")
+
+// SpoolStats contains the states of the spool and it's forwarder
+type SpoolStats struct {
+	spool.Stats
+	// Forwarded is the spooled messages confirmed by the server
+	Forwarded int64
+	// Dropped is the spooled messages never be confirmed, such as unroutable or nacked MaxAttempts times
+	Dropped   int64
+	LastError string `json:",omitempty"`
+}
+
+// spoolForwarder replays the spooled messages in order
+type spoolForwarder struct {
+	sp *spool.Spool
+
+	forwarded int64
+	dropped   int64
+
+	l         sync.Mutex
+	lastError string
+}
+
+// Spoolable report whether the message should be spooled after the publish failed,
+// that is the message is not published because the server is unreachable, blocked or no channel is free in time.
+// The message published but not confirmed in time(*ConfirmTimeoutError) is not spooled, it may be delivered.
+func Spoolable(err error) bool {
+	switch err.(type) {
+	case *ConnError, *BlockedError:
+		return true
+	}
+	return err == context.DeadlineExceeded || err == ErrTooManyConn
+}
+
+// isClosedBeforeConfirm report whether the channel is closed before the confirm, the message may be published again
+func isClosedBeforeConfirm(err error) bool {
+	_, ok := err.(*ChannelClosedError)
+	return ok
+}
+
+// isConfirmTimeout report whether the message is published but not confirmed in time
+func isConfirmTimeout(err error) bool {
+	_, ok := err.(*ConfirmTimeoutError)
+	return ok
+}
+
+// StartSpool forward the spooled messages by ConfirmSendMsg in the append order,
+// it's stopped when the pool is closed
+func (cop *ConnPool) StartSpool(sp *spool.Spool) {
+	cop.spool = &spoolForwarder{sp: sp}
+	go cop.forwardSpool(cop.spool)
+}
+
+// SpoolMsg fsync the message to the spool
+func (cop *ConnPool) SpoolMsg(msg *Message) error {
+	if cop.spool == nil {
+		return ErrSpoolDisabled
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return cop.spool.sp.Append(data)
+}
+
+// spoolStats return the states of the spool, nil if it's disabled
+func (cop *ConnPool) spoolStats() *SpoolStats {
+	f := cop.spool
+	if f == nil {
+		return nil
+	}
+	f.l.Lock()
+	lastError := f.lastError
+	f.l.Unlock()
+
+	return &SpoolStats{
+		Stats:     *f.sp.Stats(),
+		Forwarded: atomic.LoadInt64(&f.forwarded),
+		Dropped:   atomic.LoadInt64(&f.dropped),
+		LastError: lastError,
+	}
+}
+
+func (f *spoolForwarder) setLastError(err error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.lastError = err.Error()
+}
+
+// forwardSpool send the first spooled message until it's confirmed or dropped,
+// the retries are backoff the same as the reconnects
+func (cop *ConnPool) forwardSpool(f *spoolForwarder) {
+	minInterval := time.Duration(cop.conf.ReconnectInterval) * time.Millisecond
+	maxInterval := time.Duration(cop.conf.MaxReconnectInterval) * time.Millisecond
+	interval := minInterval
+	// attempts is the nacked attempts of the first message
+	attempts := 0
+
+	backoff := func() bool {
+		select {
+		case <-time.After(jitter(interval)):
+		case <-cop.done:
+			return false
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+		return true
+	}
+
+	for {
+		data, err := f.sp.Peek()
+		if err == spool.ErrEmpty {
+			select {
+			case <-f.sp.Notify():
+				continue
+			case <-cop.done:
+				return
+			}
+		}
+		if err == spool.ErrClosed {
+			return
+		}
+		if err != nil {
+			log.Error("ConnPool.forwardSpool: read spool failed", log.Fields{"error": err})
+			f.setLastError(err)
+			if !backoff() {
+				return
+			}
+			continue
+		}
+
+		msg := &Message{}
+		if err = json.Unmarshal(data, msg); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cop.conf.PublishTimeout)*time.Millisecond)
+			err = cop.ConfirmSendMsgContext(ctx, msg.Exchange, msg.RoutingKey, msg.Body, msg.Properties)
+			cancel()
+		}
+
+		switch {
+		case err == nil:
+			atomic.AddInt64(&f.forwarded, 1)
+			interval = minInterval
+		case err == ErrPoolClosed:
+			return
+		case Spoolable(err) || isConfirmTimeout(err):
+			// keep the order, retry the message until the server is reachable and confirms it,
+			// the message not confirmed in time may be delivered twice
+			f.setLastError(err)
+			if !backoff() {
+				return
+			}
+			continue
+		case (err == ErrNacked || isClosedBeforeConfirm(err)) && attempts+1 < cop.conf.Spool.MaxAttempts:
+			// the message may be nacked forever, it's dropped after MaxAttempts not to block the spool
+			attempts++
+			f.setLastError(err)
+			if !backoff() {
+				return
+			}
+			continue
+		default:
+			log.Error("ConnPool.forwardSpool: message dropped", log.Fields{"exchange": msg.Exchange, "routingKey": msg.RoutingKey, "payload": log.Payload(msg.Body), "attempts": attempts + 1, "error": err})
+			atomic.AddInt64(&f.dropped, 1)
+			f.setLastError(err)
+		}
+		attempts = 0
+
+		if err := f.sp.Commit(); err != nil {
+			log.Error("ConnPool.forwardSpool: commit spool failed", log.Fields{"error": err})
+			f.setLastError(err)
+		}
+	}
+}
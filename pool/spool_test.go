@@ -0,0 +1,34 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestSpoolable(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		spoolable bool
+	}{
+		{"connect failed", &ConnError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"blocked", &BlockedError{Reason: "low on memory"}, true},
+		{"too many connections", ErrTooManyConn, true},
+		// the publish never reached the server
+		{"no free channel in time", context.DeadlineExceeded, true},
+		// the publish may be delivered
+		{"confirm timeout", &ConfirmTimeoutError{Err: context.DeadlineExceeded}, false},
+		{"client canceled", context.Canceled, false},
+		{"nacked", ErrNacked, false},
+		{"unroutable", ErrUnroutable, false},
+		{"channel closed", &ChannelClosedError{Err: &amqp.Error{Code: amqp.NotFound}}, false},
+	}
+	for _, c := range cases {
+		if got := Spoolable(c.err); got != c.spoolable {
+			t.Errorf("%s: Spoolable = %v, expected %v", c.name, got, c.spoolable)
+		}
+	}
+}
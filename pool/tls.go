@@ -0,0 +1,100 @@
+package pool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+var errNoCA = errors.New("no PEM certificate in the tls caFile")
+
+// hostname is in the connection_name client property
+var hostname, _ = os.Hostname()
+
+// externalAuth is the SASL EXTERNAL mechanism, the server authenticates the tls client certificate
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return config.SASLExternal
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
+
+// amqpConfig return the dial config of the connection of the pool index slot,
+// the tls files are read per dial so the new connections use the rotated client certificate
+func (cop *ConnPool) amqpConfig(slot int) (amqp.Config, error) {
+	conf := cop.conf
+	c := amqp.Config{
+		Vhost:      conf.Vhost,
+		ChannelMax: conf.ChannelMax,
+		FrameSize:  conf.FrameMax,
+		Heartbeat:  time.Duration(conf.Heartbeat) * time.Millisecond,
+		Locale:     conf.Locale,
+		Dial:       amqp.DefaultDial(time.Duration(conf.DialTimeout) * time.Millisecond),
+		Properties: amqp.Table{
+			"product":         "http-proxy-amqp",
+			"platform":        "Go",
+			"connection_name": fmt.Sprintf("%s@%s#%d", conf.ConnectionName, hostname, slot),
+		},
+	}
+	for k, v := range conf.ClientProperties {
+		c.Properties[k] = v
+	}
+	tc, err := newClientTLSConfig(&conf.TLS)
+	if err != nil {
+		return c, err
+	}
+	// it's used by the amqps:// dsn only
+	c.TLSClientConfig = tc
+	if conf.SASLMechanism == config.SASLExternal {
+		c.SASL = []amqp.Authentication{externalAuth{}}
+	}
+	return c, nil
+}
+
+// newClientTLSConfig return the tls config verifying the server with the CA bundle and presenting the client certificate
+func newClientTLSConfig(c *config.AMQPTLSConfig) (*tls.Config, error) {
+	suites, err := config.CipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		CipherSuites:       suites,
+	}
+	// it's empty if the config is not checked
+	if len(c.MinVersion) > 0 {
+		if tc.MinVersion, err = config.TLSVersion(c.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.CAFile) > 0 {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errNoCA
+		}
+	}
+	if len(c.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
@@ -0,0 +1,124 @@
+package pool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+// writeSelfSigned write a self signed PEM certificate and key, the certificate is the CA of itself
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestNewClientTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSigned(t, dir)
+	notPEM := filepath.Join(dir, "ca.txt")
+	ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+
+	cases := []struct {
+		name  string
+		c     config.AMQPTLSConfig
+		ok    bool
+		check func(*tls.Config) bool
+	}{
+		{"empty", config.AMQPTLSConfig{}, true, func(tc *tls.Config) bool {
+			return tc.RootCAs == nil && len(tc.Certificates) == 0 && tc.MinVersion == 0 && tc.CipherSuites == nil
+		}},
+		{"ca and client cert", config.AMQPTLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "mq"}, true, func(tc *tls.Config) bool {
+			return tc.RootCAs != nil && len(tc.Certificates) == 1 && tc.ServerName == "mq"
+		}},
+		{"minVersion and cipherSuites", config.AMQPTLSConfig{MinVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, true, func(tc *tls.Config) bool {
+			return tc.MinVersion == tls.VersionTLS12 && len(tc.CipherSuites) == 1 && tc.CipherSuites[0] == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+		}},
+		{"insecureSkipVerify", config.AMQPTLSConfig{InsecureSkipVerify: true}, true, func(tc *tls.Config) bool {
+			return tc.InsecureSkipVerify
+		}},
+		{"ca not PEM", config.AMQPTLSConfig{CAFile: notPEM}, false, nil},
+		{"missing ca", config.AMQPTLSConfig{CAFile: filepath.Join(dir, "missing.crt")}, false, nil},
+		{"missing key", config.AMQPTLSConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")}, false, nil},
+		{"bad minVersion", config.AMQPTLSConfig{MinVersion: "1.4"}, false, nil},
+		{"bad cipherSuites", config.AMQPTLSConfig{CipherSuites: []string{"TLS_NONE"}}, false, nil},
+	}
+	for _, c := range cases {
+		tc, err := newClientTLSConfig(&c.c)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: newClientTLSConfig = %v, expected ok %v", c.name, err, c.ok)
+			continue
+		}
+		if c.ok && !c.check(tc) {
+			t.Errorf("%s: unexpected tls config %+v", c.name, tc)
+		}
+	}
+	if _, err := newClientTLSConfig(&config.AMQPTLSConfig{CAFile: notPEM}); err != errNoCA {
+		t.Fatalf("ca not PEM = %v, expected errNoCA", err)
+	}
+}
+
+func TestConnectionNameSlot(t *testing.T) {
+	cop := &ConnPool{conf: &config.Config{ConnectionName: "proxy"}}
+	for i := 0; i < 3; i++ {
+		if slot := cop.acquireSlot(); slot != i {
+			t.Fatalf("acquireSlot = %d, expected %d", slot, i)
+		}
+	}
+	// the index of the closed connection is reused by the reconnect
+	cop.releaseSlot(1)
+	slot := cop.acquireSlot()
+	if slot != 1 {
+		t.Fatalf("acquireSlot = %d after released, expected 1", slot)
+	}
+	if slot := cop.acquireSlot(); slot != 3 {
+		t.Fatalf("acquireSlot = %d, expected 3", slot)
+	}
+
+	c, err := cop.amqpConfig(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := c.Properties["connection_name"]; name != "proxy@"+hostname+"#1" {
+		t.Fatalf("connection_name %q", name)
+	}
+}
@@ -0,0 +1,171 @@
+package pool
+
+import (
+	"context"
+	"math"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+// withChannel run fn on a pooled channel
+// the channel is discarded if fn returns a error, because a channel exception closes the channel
+func (cop *ConnPool) withChannel(ctx context.Context, fn func(cha *amqp.Channel) error) error {
+	cha, err := cop.getChannel(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(cha.cha); err != nil {
+		cop.discardChannel(cha)
+		return err
+	}
+	cop.putChannel(cha)
+	return nil
+}
+
+// DeclareExchange declare the exchange, it's a error if the exchange exists with the different settings
+func (cop *ConnPool) DeclareExchange(ctx context.Context, spec *config.ExchangeSpec) error {
+	args, err := toTable(spec.Arguments)
+	if err != nil {
+		return err
+	}
+	return cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		return cha.ExchangeDeclare(spec.Name, spec.Type, spec.Durable, spec.AutoDelete, spec.Internal, false, args)
+	})
+}
+
+// DeleteExchange delete the exchange, if ifUnused is true, it's not deleted if it has bindings
+func (cop *ConnPool) DeleteExchange(ctx context.Context, name string, ifUnused bool) error {
+	err := cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		return cha.ExchangeDelete(name, ifUnused, false)
+	})
+	if err == nil {
+		cop.publisher.forgetExchange(name)
+	}
+	return err
+}
+
+// declareExchangePassive check the exchange exists, the missing exchange gets the NOT_FOUND error
+func (cop *ConnPool) declareExchangePassive(ctx context.Context, name string) error {
+	return cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		// the server checks the name only
+		return cha.ExchangeDeclarePassive(name, amqp.ExchangeDirect, true, false, false, false, nil)
+	})
+}
+
+// DeclareQueue declare the queue and return it's message and consumer counts
+// it's a error if the queue exists with the different settings
+func (cop *ConnPool) DeclareQueue(ctx context.Context, spec *config.QueueSpec) (amqp.Queue, error) {
+	var q amqp.Queue
+	args, err := toTable(spec.Arguments)
+	if err != nil {
+		return q, err
+	}
+	err = cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		var err error
+		q, err = cha.QueueDeclare(spec.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, false, args)
+		return err
+	})
+	return q, err
+}
+
+// InspectQueue passive declare the queue and return it's message and consumer counts
+func (cop *ConnPool) InspectQueue(ctx context.Context, name string) (amqp.Queue, error) {
+	var q amqp.Queue
+	err := cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		var err error
+		q, err = cha.QueueInspect(name)
+		return err
+	})
+	return q, err
+}
+
+// DeleteQueue delete the queue and return the purged message count
+// if ifUnused is true, it's not deleted if it has consumers, if ifEmpty is true, it's not deleted if it has messages
+func (cop *ConnPool) DeleteQueue(ctx context.Context, name string, ifUnused bool, ifEmpty bool) (int, error) {
+	var n int
+	err := cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		var err error
+		n, err = cha.QueueDelete(name, ifUnused, ifEmpty, false)
+		return err
+	})
+	return n, err
+}
+
+// Bind bind the destination queue or exchange to the source exchange
+func (cop *ConnPool) Bind(ctx context.Context, spec *config.BindingSpec) error {
+	args, err := toTable(spec.Arguments)
+	if err != nil {
+		return err
+	}
+	return cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		if spec.DestinationType == config.DestinationExchange {
+			return cha.ExchangeBind(spec.Destination, spec.RoutingKey, spec.Exchange, false, args)
+		}
+		return cha.QueueBind(spec.Destination, spec.RoutingKey, spec.Exchange, false, args)
+	})
+}
+
+// Unbind remove the binding, the arguments must be the same as binding
+func (cop *ConnPool) Unbind(ctx context.Context, spec *config.BindingSpec) error {
+	args, err := toTable(spec.Arguments)
+	if err != nil {
+		return err
+	}
+	return cop.withChannel(ctx, func(cha *amqp.Channel) error {
+		if spec.DestinationType == config.DestinationExchange {
+			return cha.ExchangeUnbind(spec.Destination, spec.RoutingKey, spec.Exchange, false, args)
+		}
+		return cha.QueueUnbind(spec.Destination, spec.RoutingKey, spec.Exchange, args)
+	})
+}
+
+// ArgumentsError occured when the arguments of a exchange, queue or binding are not the amqp field values
+type ArgumentsError struct {
+	Err error
+}
+
+func (e *ArgumentsError) Error() string {
+	return "pool: invalid arguments: " + e.Err.Error()
+}
+
+// toTable convert the json decoded arguments to amqp.Table
+// the json numbers are float64, the integers are converted to int64,
+// because the server requires the integer arguments such as x-message-ttl
+func toTable(args map[string]interface{}) (amqp.Table, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	table := make(amqp.Table, len(args))
+	for k, v := range args {
+		table[k] = toTableValue(v)
+	}
+	if err := table.Validate(); err != nil {
+		return nil, &ArgumentsError{Err: err}
+	}
+	return table, nil
+}
+
+func toTableValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case map[string]interface{}:
+		table := make(amqp.Table, len(v))
+		for k, vv := range v {
+			table[k] = toTableValue(vv)
+		}
+		return table
+	case []interface{}:
+		vs := make([]interface{}, len(v))
+		for i, vv := range v {
+			vs[i] = toTableValue(vv)
+		}
+		return vs
+	}
+	return v
+}
@@ -0,0 +1,53 @@
+package pool
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestToTableValue(t *testing.T) {
+	cases := []struct {
+		json     string
+		expected interface{}
+	}{
+		{`60000`, int64(60000)},
+		{`-1`, int64(-1)},
+		{`1.5`, 1.5},
+		// larger than the float64 integers
+		{`1e20`, 1e20},
+		{`"quorum"`, "quorum"},
+		{`true`, true},
+		{`null`, nil},
+		{`[1, "a", 2.5]`, []interface{}{int64(1), "a", 2.5}},
+		{`{"x-max-length": 10, "nested": {"ttl": 1000}}`, amqp.Table{"x-max-length": int64(10), "nested": amqp.Table{"ttl": int64(1000)}}},
+		{`[{"a": 1}]`, []interface{}{amqp.Table{"a": int64(1)}}},
+	}
+	for _, c := range cases {
+		var v interface{}
+		if err := json.Unmarshal([]byte(c.json), &v); err != nil {
+			t.Fatal(err)
+		}
+		if got := toTableValue(v); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("toTableValue(%s) = %#v, expected %#v", c.json, got, c.expected)
+		}
+	}
+}
+
+func TestToTable(t *testing.T) {
+	table, err := toTable(nil)
+	if table != nil || err != nil {
+		t.Fatalf("toTable(nil) = %v, %v", table, err)
+	}
+	table, err = toTable(map[string]interface{}{"x-message-ttl": float64(1000), "x-queue-type": "quorum"})
+	if err != nil || table["x-message-ttl"] != int64(1000) || table["x-queue-type"] != "quorum" {
+		t.Fatalf("toTable = %v, %v", table, err)
+	}
+	// not a amqp field value
+	_, err = toTable(map[string]interface{}{"x-bad": struct{}{}})
+	if _, ok := err.(*ArgumentsError); !ok {
+		t.Fatalf("toTable invalid value = %v, expected ArgumentsError", err)
+	}
+}
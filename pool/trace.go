@@ -0,0 +1,66 @@
+package pool
+
+import (
+	"context"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/trace"
+	"github.com/streadway/amqp"
+)
+
+// the names of the pool spans, they are the children of the http request span
+const (
+	spanPublish      = "amqp.publish"
+	spanPublishBatch = "amqp.publish_batch"
+	spanAcquire      = "amqp.channel_acquire"
+	spanConfirmWait  = "amqp.confirm_wait"
+)
+
+// startPublishSpan start the producer span of the publish to the exchange
+func startPublishSpan(ctx context.Context, name string, exchange string, routingKey string) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, name, trace.KindProducer)
+	span.SetAttribute("messaging.system", "rabbitmq")
+	span.SetAttribute("messaging.destination.name", exchange)
+	if len(routingKey) > 0 {
+		span.SetAttribute("messaging.rabbitmq.destination.routing_key", routingKey)
+	}
+	return ctx, span
+}
+
+// injectTrace set the traceparent and tracestate headers of the message,
+// so the consumers can continue the trace.
+// The headers are copied because they may be shared by the publish options.
+func injectTrace(msg *amqp.Publishing, sc trace.SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	headers := make(amqp.Table, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[trace.HeaderTraceparent] = sc.Traceparent()
+	if len(sc.State) > 0 {
+		headers[trace.HeaderTracestate] = sc.State
+	}
+	msg.Headers = headers
+}
+
+// acquisition is the wait of a publish for a shared channel and a in-flight slot
+type acquisition struct {
+	start time.Time
+	span  *trace.Span
+}
+
+func startAcquisition(ctx context.Context) acquisition {
+	_, span := trace.StartSpan(ctx, spanAcquire, trace.KindInternal)
+	return acquisition{start: time.Now(), span: span}
+}
+
+// done observe the wait if it's acquired and end the span
+func (a acquisition) done(m *poolMetrics, err error) {
+	if err == nil {
+		m.acquireWait.Since(a.start, acquirePublish)
+	}
+	a.span.SetError(err)
+	a.span.End()
+}
@@ -0,0 +1,149 @@
+package pool
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+// CloseReason is the reason of a connection or channel closed by the server or network
+type CloseReason struct {
+	Code   int
+	Reason string
+	// Server is true if the close is initiated by the server
+	Server bool
+	Time   time.Time
+}
+
+func newCloseReason(err *amqp.Error) *CloseReason {
+	return &CloseReason{
+		Code:   err.Code,
+		Reason: err.Reason,
+		Server: err.Server,
+		Time:   time.Now(),
+	}
+}
+
+// newConnection wrap the amqp connection and watch it's close and blocked notifications
+// Notice: must be called with cop.l locked
+func (cop *ConnPool) newConnection(amqpConn *amqp.Connection, slot int) *Connection {
+	conn := &Connection{conn: amqpConn, slot: slot, numOpenedChannel: 0, maxChannels: cop.conf.MaxChannelsPerConnection}
+	if max := amqpConn.Config.ChannelMax; max > 0 && max < conn.maxChannels {
+		conn.maxChannels = max
+		cop.channelMaxOnce.Do(func() {
+			log.Warn("the channel max negotiated by the server is less than maxChannelsPerConnection",
+				log.Fields{"channelMax": max, "maxChannelsPerConnection": cop.conf.MaxChannelsPerConnection})
+		})
+	}
+
+	closeCh := amqpConn.NotifyClose(make(chan *amqp.Error, 1))
+	blockCh := amqpConn.NotifyBlocked(make(chan amqp.Blocking, 1))
+	go cop.watchConn(conn, closeCh, blockCh)
+	cop.metrics.connOpened.Inc()
+
+	// the topology may be lost after the server restarted
+	if cop.topologyStale {
+		cop.topologyStale = false
+		go cop.ApplyTopology()
+	}
+
+	return conn
+}
+
+// watchConn evict the connection from the pool when it's closed by the server or network
+// the notify channels are closed without error when the connection is closed by the pool
+func (cop *ConnPool) watchConn(conn *Connection, closeCh chan *amqp.Error, blockCh chan amqp.Blocking) {
+	for {
+		select {
+		case b, ok := <-blockCh:
+			if !ok {
+				blockCh = nil
+				continue
+			}
+			conn.setBlocked(b)
+			log.Warn("ConnPool.watchConn: connection blocked", log.Fields{"active": b.Active, "reason": b.Reason})
+			if !b.Active {
+				cop.notifyUnblocked()
+			}
+		case err, ok := <-closeCh:
+			if ok && err != nil {
+				cop.evictConn(conn, err)
+			}
+			return
+		}
+	}
+}
+
+// evictConn remove the closed connection and it's idle channels from the pool
+func (cop *ConnPool) evictConn(conn *Connection, err *amqp.Error) {
+	log.Error("ConnPool.evictConn: connection closed", log.Fields{"code": err.Code, "reason": err.Reason, "server": err.Server})
+	conn.markBad()
+
+	cop.l.Lock()
+	defer cop.l.Unlock()
+
+	cop.connClosedNum++
+	cop.lastConnClose = newCloseReason(err)
+
+	if cop.closed {
+		return
+	}
+	cop.topologyStale = true
+
+	idleChas := cop.idleChas[:0]
+	for _, cha := range cop.idleChas {
+		if cha.conn == conn {
+			cop.closeChannel(cha, closeReasonConnClosed)
+			continue
+		}
+		idleChas = append(idleChas, cha)
+	}
+	for i := len(idleChas); i < len(cop.idleChas); i++ {
+		cop.idleChas[i] = nil
+	}
+	cop.idleChas = idleChas
+
+	cop.removeConn(conn, closeReason(err))
+	cop.startReconnect()
+}
+
+// watchChannel evict the channel from the idle channels when it's closed by the server
+// a busy channel is discarded by it's user when the confirm channel is closed
+func (cop *ConnPool) watchChannel(cha *Channel, closeCh chan *amqp.Error) {
+	err, ok := <-closeCh
+	if !ok || err == nil {
+		return
+	}
+
+	log.Debug("[channel] channel closed", log.Fields{"code": err.Code, "reason": err.Reason})
+
+	cop.l.Lock()
+	defer cop.l.Unlock()
+
+	cop.chaClosedNum++
+	cop.lastChaClose = newCloseReason(err)
+
+	for i := 0; i < len(cop.idleChas); i++ {
+		if cop.idleChas[i] == cha {
+			cop.removeIdleChannel(i)
+			cop.closeChannel(cha, closeReasonServer)
+			return
+		}
+	}
+}
+
+// removeIdleChannel remove the i-th idle channel
+// Notice: must be called with cop.l locked
+func (cop *ConnPool) removeIdleChannel(i int) {
+	// shift from free pool
+	if i == 0 {
+		cop.idleChas[0] = nil
+		cop.idleChas = cop.idleChas[1:]
+		return
+	}
+	copy(cop.idleChas[i:], cop.idleChas[i+1:])
+	cop.idleChas[len(cop.idleChas)-1] = nil
+	cop.idleChas = cop.idleChas[:len(cop.idleChas)-1]
+}
@@ -0,0 +1,104 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+// watchTestConn add a connection watched by the pool, return it's notify channels
+func watchTestConn(cop *ConnPool) (*Connection, chan *amqp.Error, chan amqp.Blocking, chan struct{}) {
+	conn := &Connection{maxChannels: 1}
+	cop.l.Lock()
+	cop.conns = append(cop.conns, conn)
+	cop.l.Unlock()
+
+	closeCh := make(chan *amqp.Error, 1)
+	blockCh := make(chan amqp.Blocking, 1)
+	watched := make(chan struct{})
+	go func() {
+		cop.watchConn(conn, closeCh, blockCh)
+		close(watched)
+	}()
+	return conn, closeCh, blockCh, watched
+}
+
+func waitWatched(t *testing.T, watched chan struct{}) {
+	select {
+	case <-watched:
+	case <-time.After(time.Second):
+		t.Fatal("watchConn not returned")
+	}
+}
+
+func TestWatchConnEvict(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 2, MaxIdleChannels: 1, PublishChannels: 1, ReconnectInterval: 10, MaxReconnectInterval: 10})
+	defer cop.CloseAll()
+	conn, closeCh, _, watched := watchTestConn(cop)
+	other, _, _, _ := watchTestConn(cop)
+
+	closeCh <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure", Server: true}
+	waitWatched(t, watched)
+
+	if !conn.isBad() {
+		t.Fatal("the closed connection is not marked bad")
+	}
+	stats := cop.Stats()
+	if stats.ConnNum != 1 || cop.conns[0] != other {
+		t.Fatalf("%d connections left, expected the other one", stats.ConnNum)
+	}
+	r := stats.LastConnClose
+	if stats.ConnClosedNum != 1 || r == nil || r.Code != amqp.ConnectionForced || !r.Server || r.Time.IsZero() {
+		t.Fatalf("unexpected close stats %d %+v", stats.ConnClosedNum, r)
+	}
+	cop.l.Lock()
+	stale := cop.topologyStale
+	cop.l.Unlock()
+	if !stale {
+		t.Fatal("the topology is not applied again after the connection closed")
+	}
+}
+
+func TestWatchConnClosedByPool(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1})
+	defer cop.CloseAll()
+	conn, closeCh, _, watched := watchTestConn(cop)
+
+	// the notify channels are closed without error when the pool closes the connection
+	close(closeCh)
+	waitWatched(t, watched)
+	if conn.isBad() || cop.Stats().ConnNum != 1 || cop.Stats().ConnClosedNum != 0 {
+		t.Fatal("the connection closed by the pool is evicted")
+	}
+}
+
+func TestWatchChannelClosed(t *testing.T) {
+	cop := NewPool(&config.Config{MaxConnections: 1, MaxIdleChannels: 1, PublishChannels: 1})
+	defer cop.CloseAll()
+
+	// a busy channel closed by the server is only recorded, it's user discards it
+	cha := &Channel{conn: &Connection{}}
+	closeCh := make(chan *amqp.Error, 1)
+	closeCh <- &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no exchange 'missing'", Server: true}
+	cop.watchChannel(cha, closeCh)
+
+	stats := cop.Stats()
+	r := stats.LastChaClose
+	if stats.ChaClosedNum != 1 || r == nil || r.Code != amqp.NotFound || r.Reason != "NOT_FOUND - no exchange 'missing'" {
+		t.Fatalf("unexpected close stats %d %+v", stats.ChaClosedNum, r)
+	}
+	if cha.conn == nil {
+		t.Fatal("the busy channel closed by the watcher")
+	}
+
+	// the channel closed by the pool is not recorded
+	closeCh = make(chan *amqp.Error)
+	close(closeCh)
+	cop.watchChannel(cha, closeCh)
+	if cop.Stats().ChaClosedNum != 1 {
+		t.Fatal("the channel closed by the pool is recorded")
+	}
+}
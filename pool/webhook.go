@@ -0,0 +1,237 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+// ConsumerStats contains the states of a webhook consumer
+type ConsumerStats struct {
+	Name    string
+	Queue   string
+	Running bool
+
+	// Delivered is the messages received from the queue
+	Delivered int64
+	// Acked is the messages acked after the webhook returned 2xx
+	Acked int64
+	// Requeued and DeadLettered are the messages nacked after the retries exhausted
+	Requeued     int64
+	DeadLettered int64
+	// WebhookErrors is the failed webhook requests, including the retries
+	WebhookErrors int64
+
+	LastError string `json:",omitempty"`
+}
+
+// webhookConsumer delivers the queue messages to the http webhook
+type webhookConsumer struct {
+	conf   config.ConsumerConfig
+	cop    *ConnPool
+	client *http.Client
+
+	running       int32
+	delivered     int64
+	acked         int64
+	requeued      int64
+	deadLettered  int64
+	webhookErrors int64
+
+	l         sync.Mutex
+	lastError string
+}
+
+// StartConsumers start the webhook consumers in the config,
+// they are stopped when the pool is closed
+func (cop *ConnPool) StartConsumers() {
+	for _, c := range cop.conf.Consumers {
+		wc := &webhookConsumer{
+			conf: c,
+			cop:  cop,
+			client: &http.Client{
+				Timeout: time.Duration(c.Timeout) * time.Millisecond,
+			},
+		}
+		cop.webhooks = append(cop.webhooks, wc)
+		go wc.run()
+	}
+}
+
+// consumerStats return the states of the webhook consumers
+func (cop *ConnPool) consumerStats() []*ConsumerStats {
+	stats := make([]*ConsumerStats, 0, len(cop.webhooks))
+	for _, wc := range cop.webhooks {
+		stats = append(stats, wc.stats())
+	}
+	return stats
+}
+
+func (wc *webhookConsumer) stats() *ConsumerStats {
+	wc.l.Lock()
+	lastError := wc.lastError
+	wc.l.Unlock()
+
+	return &ConsumerStats{
+		Name:          wc.conf.Name,
+		Queue:         wc.conf.Queue,
+		Running:       atomic.LoadInt32(&wc.running) == 1,
+		Delivered:     atomic.LoadInt64(&wc.delivered),
+		Acked:         atomic.LoadInt64(&wc.acked),
+		Requeued:      atomic.LoadInt64(&wc.requeued),
+		DeadLettered:  atomic.LoadInt64(&wc.deadLettered),
+		WebhookErrors: atomic.LoadInt64(&wc.webhookErrors),
+		LastError:     lastError,
+	}
+}
+
+func (wc *webhookConsumer) setLastError(err error) {
+	wc.l.Lock()
+	defer wc.l.Unlock()
+	wc.lastError = err.Error()
+}
+
+// run consume the queue until the pool closed,
+// the consumer is restarted with backoff when it's channel is closed
+func (wc *webhookConsumer) run() {
+	minInterval := time.Duration(wc.cop.conf.ReconnectInterval) * time.Millisecond
+	maxInterval := time.Duration(wc.cop.conf.MaxReconnectInterval) * time.Millisecond
+	interval := minInterval
+
+	for {
+		c, err := wc.cop.Consume(context.Background(), wc.conf.Queue, wc.conf.Prefetch, false)
+		if err == ErrPoolClosed {
+			return
+		}
+		if err != nil {
+			log.Error("webhookConsumer.run: consume failed", log.Fields{"consumer": wc.conf.Name, "queue": wc.conf.Queue, "error": err, "retryInMs": interval})
+			wc.setLastError(err)
+		} else {
+			interval = minInterval
+			atomic.StoreInt32(&wc.running, 1)
+			wc.serve(c)
+			atomic.StoreInt32(&wc.running, 0)
+			c.Cancel()
+		}
+
+		select {
+		case <-time.After(jitter(interval)):
+		case <-wc.cop.done:
+			return
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// serve deliver the messages with the concurrent workers until the deliveries closed
+func (wc *webhookConsumer) serve(c *Consumer) {
+	w := &sync.WaitGroup{}
+	for i := 0; i < wc.conf.Concurrency; i++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			for d := range c.Deliveries {
+				atomic.AddInt64(&wc.delivered, 1)
+				wc.handle(&d)
+			}
+		}()
+	}
+	w.Wait()
+}
+
+// handle post the delivery to the webhook with retries, then settle it
+func (wc *webhookConsumer) handle(d *amqp.Delivery) {
+	body, err := json.Marshal(NewDelivery(d))
+	if err != nil {
+		// such as the NaN float header, it never succeeds, so it's not requeued whatever the OnFailure
+		log.Error("webhookConsumer.handle: marshal delivery failed", log.Fields{"consumer": wc.conf.Name, "deliveryTag": d.DeliveryTag, "error": err})
+		wc.setLastError(err)
+		if err := d.Nack(false, false); err != nil {
+			wc.setLastError(err)
+			return
+		}
+		atomic.AddInt64(&wc.deadLettered, 1)
+		return
+	}
+
+	interval := time.Duration(wc.conf.RetryInterval) * time.Millisecond
+	for i := 0; ; i++ {
+		err = wc.post(body)
+		if err == nil {
+			if err := d.Ack(false); err != nil {
+				wc.setLastError(err)
+				return
+			}
+			atomic.AddInt64(&wc.acked, 1)
+			return
+		}
+
+		atomic.AddInt64(&wc.webhookErrors, 1)
+		wc.setLastError(err)
+		if i >= wc.conf.MaxRetries {
+			break
+		}
+		select {
+		case <-time.After(jitter(interval)):
+		case <-wc.cop.done:
+			// the unacked message is requeued when the channel closed
+			return
+		}
+		interval *= 2
+	}
+
+	log.Error("webhookConsumer.handle: deliver failed", log.Fields{"consumer": wc.conf.Name, "deliveryTag": d.DeliveryTag, "error": err})
+	wc.nack(d)
+}
+
+// nack the delivery failed to deliver by the OnFailure policy
+func (wc *webhookConsumer) nack(d *amqp.Delivery) {
+	requeue := wc.conf.OnFailure == config.OnFailureRequeue
+	if err := d.Nack(false, requeue); err != nil {
+		wc.setLastError(err)
+		return
+	}
+	if requeue {
+		atomic.AddInt64(&wc.requeued, 1)
+	} else {
+		atomic.AddInt64(&wc.deadLettered, 1)
+	}
+}
+
+// post the delivery json to the webhook, the response status must be 2xx
+func (wc *webhookConsumer) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wc.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-AMQP-Queue", wc.conf.Queue)
+	req.Header.Set("X-AMQP-Consumer", wc.conf.Name)
+
+	res, err := wc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded %s", wc.conf.URL, res.Status)
+	}
+	return nil
+}
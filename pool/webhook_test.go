@@ -0,0 +1,118 @@
+package pool
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/streadway/amqp"
+
+	"github.com/iyidan/http-proxy-amqp/config"
+)
+
+// fakeAcknowledger records the settlement of the deliveries
+type fakeAcknowledger struct {
+	acks    int
+	nacks   int
+	requeue bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	a.requeue = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// newTestWebhook return the consumer of the webhook failing the first failures requests
+func newTestWebhook(failures int32, onFailure string) (*webhookConsumer, *int32, func()) {
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&posts, 1) <= failures {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	wc := &webhookConsumer{
+		conf: config.ConsumerConfig{
+			Name:          "test",
+			Queue:         "orders",
+			URL:           srv.URL,
+			MaxRetries:    2,
+			RetryInterval: 1,
+			OnFailure:     onFailure,
+		},
+		cop:    &ConnPool{done: make(chan struct{})},
+		client: &http.Client{},
+	}
+	return wc, &posts, srv.Close
+}
+
+func TestWebhookAck(t *testing.T) {
+	wc, posts, stop := newTestWebhook(2, config.OnFailureRequeue)
+	defer stop()
+
+	a := &fakeAcknowledger{}
+	wc.handle(&amqp.Delivery{Acknowledger: a, DeliveryTag: 1, Body: []byte("msg")})
+	if a.acks != 1 || a.nacks != 0 {
+		t.Fatalf("acks %d nacks %d, expected acked after the retries", a.acks, a.nacks)
+	}
+	if *posts != 3 || wc.webhookErrors != 2 || wc.acked != 1 {
+		t.Fatalf("posts %d webhookErrors %d acked %d", *posts, wc.webhookErrors, wc.acked)
+	}
+}
+
+func TestWebhookRetriesExhausted(t *testing.T) {
+	cases := []struct {
+		onFailure string
+		requeue   bool
+	}{
+		{config.OnFailureRequeue, true},
+		{config.OnFailureDeadLetter, false},
+	}
+	for _, c := range cases {
+		wc, posts, stop := newTestWebhook(100, c.onFailure)
+		a := &fakeAcknowledger{}
+		wc.handle(&amqp.Delivery{Acknowledger: a, DeliveryTag: 1, Body: []byte("msg")})
+		stop()
+
+		if a.acks != 0 || a.nacks != 1 || a.requeue != c.requeue {
+			t.Fatalf("%s: acks %d nacks %d requeue %v", c.onFailure, a.acks, a.nacks, a.requeue)
+		}
+		// the first post and MaxRetries retries
+		if *posts != 3 || wc.webhookErrors != 3 {
+			t.Fatalf("%s: posts %d webhookErrors %d, expected 3", c.onFailure, *posts, wc.webhookErrors)
+		}
+		if wc.requeued+wc.deadLettered != 1 || (wc.requeued == 1) != c.requeue {
+			t.Fatalf("%s: requeued %d deadLettered %d", c.onFailure, wc.requeued, wc.deadLettered)
+		}
+	}
+}
+
+func TestWebhookMarshalFailed(t *testing.T) {
+	// the delivery failed to marshal is never requeued, otherwise it loops forever
+	for _, onFailure := range []string{config.OnFailureDeadLetter, config.OnFailureRequeue} {
+		wc, posts, stop := newTestWebhook(0, onFailure)
+		a := &fakeAcknowledger{}
+		d := &amqp.Delivery{Acknowledger: a, DeliveryTag: 1, Headers: amqp.Table{"score": math.NaN()}}
+		wc.handle(d)
+		stop()
+
+		if *posts != 0 {
+			t.Fatalf("%s: %d posts of the delivery failed to marshal", onFailure, *posts)
+		}
+		if a.nacks != 1 || a.requeue || wc.deadLettered != 1 || wc.requeued != 0 {
+			t.Fatalf("%s: nacks %d requeue %v deadLettered %d requeued %d, expected dead-lettered",
+				onFailure, a.nacks, a.requeue, wc.deadLettered, wc.requeued)
+		}
+	}
+}
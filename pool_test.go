@@ -3,16 +3,17 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
-	"github.com/ngaut/log"
 	"github.com/streadway/amqp"
 
 	"flag"
 
 	"github.com/iyidan/http-proxy-amqp/config"
+	"github.com/iyidan/http-proxy-amqp/log"
 	"github.com/iyidan/http-proxy-amqp/pool"
 )
 
@@ -189,6 +190,12 @@ func BenchmarkConfirmSendMsg(b *testing.B) {
 	time.Sleep(time.Second * 5)
 }
 
-func init() {
-	initTestConf()
+// TestMain init the config after the testing flags are defined, init parses the flags too early.
+// The config is required by the benchmarks only, they need the server
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if f := flag.Lookup("test.bench"); f != nil && len(f.Value.String()) > 0 {
+		initTestConf()
+	}
+	os.Exit(m.Run())
 }
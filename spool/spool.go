@@ -0,0 +1,463 @@
+// Package spool is a segmented append-only log on local disk,
+// the records are replayed in the append order and removed after committed.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+var (
+	// ErrFull occured when append to a spool reached the max size
+	ErrFull = errors.New("spool: full")
+	// ErrEmpty occured when peek a spool without pending records
+	ErrEmpty = errors.New("spool: empty")
+	// ErrClosed occured when use a closed spool
+	ErrClosed = errors.New("spool: closed")
+)
+
+const (
+	// each record is [4 bytes length][4 bytes crc32 of data][data]
+	headerSize = 8
+
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+)
+
+// Stats contains the states of the spool
+type Stats struct {
+	// Segments is the segment files on disk
+	Segments int
+	// Size is the bytes of the segment files, including the committed records not removed yet
+	Size int64
+	// Pending is the records not committed
+	Pending int64
+	// Appended and Committed are the records since the spool opened
+	Appended  int64
+	Committed int64
+}
+
+// segment is a append-only file named by it's increasing id
+type segment struct {
+	id   int64
+	size int64
+}
+
+// Spool is a segmented append-only log, the records are fsynced when appended.
+// The first segment is the read segment, the last one is the write segment,
+// a segment is removed when all it's records are committed and it's not the write segment.
+// The read position is saved in the cursor file when a record is committed,
+// so a record is replayed again if the process exits before it's committed.
+type Spool struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	l        sync.Mutex
+	segments []*segment
+	size     int64
+	// lastID is the id of the last segment or the cursor, the segment ids never go back
+	lastID int64
+
+	// w is the write segment
+	w *os.File
+
+	// r is the read segment, rOff is the read offset,
+	// peeked is the size of the record returned by Peek
+	r      *os.File
+	rOff   int64
+	peeked int64
+
+	pending   int64
+	appended  int64
+	committed int64
+
+	// notify is signaled when a record appended
+	notify chan struct{}
+	closed bool
+}
+
+// Open open the spool in dir, the torn records at the tail of the segments are truncated.
+// A segment is rotated when it's larger than segmentSize,
+// the records are not appended when the spool is larger than maxSize.
+func Open(dir string, segmentSize int64, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		notify:      make(chan struct{}, 1),
+	}
+
+	ids, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	curID, curOff, err := s.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	s.lastID = curID
+
+	for _, id := range ids {
+		// committed segments not removed before exit
+		if id < curID {
+			if err := os.Remove(s.segmentPath(id)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seg, records, err := s.scanSegment(id)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+		s.pending += records
+		s.lastID = id
+	}
+
+	if len(s.segments) > 0 && s.segments[0].id == curID && curOff > 0 {
+		// the records before the cursor are committed
+		off, records, err := s.scanRecords(curID, curOff)
+		if err != nil {
+			return nil, err
+		}
+		s.pending = s.pending - records
+		s.rOff = off
+	}
+
+	if len(s.segments) == 0 {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	last := s.segments[len(s.segments)-1]
+	if s.w, err = os.OpenFile(s.segmentPath(last.id), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) segmentPath(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// listSegments return the segment ids in ascending order
+func (s *Spool) listSegments() ([]int64, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// readCursor return the segment id and offset of the first uncommitted record
+func (s *Spool) readCursor() (int64, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, cursorFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var id, off int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &off); err != nil {
+		return 0, 0, fmt.Errorf("spool: invalid cursor file: %s", err)
+	}
+	return id, off, nil
+}
+
+// writeCursor save the read position, the rename is atomic
+func (s *Spool) writeCursor() error {
+	path := filepath.Join(s.dir, cursorFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "%d %d", s.segments[0].id, s.rOff)
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// scanSegment count the valid records of the segment and truncate the torn tail
+func (s *Spool) scanSegment(id int64) (*segment, int64, error) {
+	size, records, err := s.scanRecords(id, -1)
+	if err != nil {
+		return nil, 0, err
+	}
+	path := s.segmentPath(id)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.Size() > size {
+		log.Warn("spool: segment truncated", log.Fields{"path": path, "from": fi.Size(), "to": size})
+		if err := os.Truncate(path, size); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &segment{id: id, size: size}, records, nil
+}
+
+// scanRecords read the records of the segment until the offset limit, -1 means the end,
+// return the offset after the last valid record and the record count
+func (s *Spool) scanRecords(id int64, limit int64) (int64, int64, error) {
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var off, records int64
+	for limit < 0 || off < limit {
+		n, err := readRecord(f, off, fi.Size(), nil)
+		if err != nil {
+			break
+		}
+		off += n
+		records++
+	}
+	return off, records, nil
+}
+
+// readRecord read the record at off before end, return it's size on disk,
+// the data is returned into *data if data is not nil
+func readRecord(f *os.File, off int64, end int64, data *[]byte) (int64, error) {
+	var header [headerSize]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	// the length of a torn record may be garbage
+	if off+headerSize+int64(length) > end {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	buf := make([]byte, length)
+	if _, err := f.ReadAt(buf, off+headerSize); err != nil {
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(buf) != sum {
+		return 0, errors.New("spool: record checksum mismatch")
+	}
+	if data != nil {
+		*data = buf
+	}
+	return headerSize + int64(length), nil
+}
+
+// rotate close the write segment and create a new one
+func (s *Spool) rotate() error {
+	id := s.lastID + 1
+	f, err := os.OpenFile(s.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if s.w != nil {
+		s.w.Close()
+	}
+	s.w = f
+	s.lastID = id
+	s.segments = append(s.segments, &segment{id: id})
+	return nil
+}
+
+// Append write the record and fsync it
+func (s *Spool) Append(data []byte) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	n := int64(headerSize + len(data))
+
+	// rotate before the size check, so the committed records of the old write segment are removed
+	last := s.segments[len(s.segments)-1]
+	if last.size > 0 && last.size+n > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		if err := s.advance(); err != nil {
+			return err
+		}
+		last = s.segments[len(s.segments)-1]
+	}
+	if s.size+n > s.maxSize {
+		return ErrFull
+	}
+
+	buf := make([]byte, n)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[headerSize:], data)
+
+	_, err := s.w.Write(buf)
+	if err == nil {
+		err = s.w.Sync()
+	}
+	if err != nil {
+		// drop the partial record, the next appends follow the valid records
+		s.w.Truncate(last.size)
+		return err
+	}
+
+	last.size += n
+	s.size += n
+	s.pending++
+	s.appended++
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Notify return the channel signaled when a record appended
+func (s *Spool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Peek return the first uncommitted record, it's returned again until Commit
+func (s *Spool) Peek() ([]byte, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.pending == 0 {
+		return nil, ErrEmpty
+	}
+	if err := s.advance(); err != nil {
+		return nil, err
+	}
+
+	if s.r == nil {
+		f, err := os.Open(s.segmentPath(s.segments[0].id))
+		if err != nil {
+			return nil, err
+		}
+		s.r = f
+	}
+
+	var data []byte
+	n, err := readRecord(s.r, s.rOff, s.segments[0].size, &data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.peeked = n
+	return data, nil
+}
+
+// Commit remove the record returned by Peek
+func (s *Spool) Commit() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.peeked == 0 {
+		return errors.New("spool: commit without peek")
+	}
+	s.rOff += s.peeked
+	s.peeked = 0
+	s.pending--
+	s.committed++
+
+	if err := s.advance(); err != nil {
+		return err
+	}
+	return s.writeCursor()
+}
+
+// advance remove the read segment if all it's records are committed and it's not the write segment
+func (s *Spool) advance() error {
+	for len(s.segments) > 1 && s.rOff >= s.segments[0].size {
+		if s.r != nil {
+			s.r.Close()
+			s.r = nil
+		}
+		if err := os.Remove(s.segmentPath(s.segments[0].id)); err != nil {
+			return err
+		}
+		s.size -= s.segments[0].size
+		s.segments[0] = nil
+		s.segments = s.segments[1:]
+		s.rOff = 0
+	}
+	return nil
+}
+
+// Stats return the states of the spool
+func (s *Spool) Stats() *Stats {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return &Stats{
+		Segments:  len(s.segments),
+		Size:      s.size,
+		Pending:   s.pending,
+		Appended:  s.appended,
+		Committed: s.committed,
+	}
+}
+
+// Close close the segment files, the uncommitted records are replayed after reopen
+func (s *Spool) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.r != nil {
+		s.r.Close()
+	}
+	return s.w.Close()
+}
@@ -0,0 +1,169 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// small segments to rotate every few records
+	s, err := Open(dir, 64, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := s.Stats(); st.Pending != 10 || st.Segments < 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// commit 3 records, the others are replayed after reopen
+	for i := 0; i < 3; i++ {
+		data, err := s.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != fmt.Sprintf("msg-%d", i) {
+			t.Fatalf("peek %d: got %q", i, data)
+		}
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	s, err = Open(dir, 64, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if st := s.Stats(); st.Pending != 7 {
+		t.Fatalf("unexpected pending after reopen: %+v", st)
+	}
+	for i := 3; i < 10; i++ {
+		data, err := s.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != fmt.Sprintf("msg-%d", i) {
+			t.Fatalf("peek %d: got %q", i, data)
+		}
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Peek(); err != ErrEmpty {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+	if st := s.Stats(); st.Segments != 1 {
+		t.Fatalf("the committed segments are not removed: %+v", st)
+	}
+}
+
+func TestSpoolTruncateTornRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Append([]byte("msg-0"))
+	s.Close()
+
+	// a partial record written before crash
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 1, segmentExt)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	f.Close()
+
+	s, err = Open(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Append([]byte("msg-1")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		data, err := s.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != fmt.Sprintf("msg-%d", i) {
+			t.Fatalf("peek %d: got %q", i, data)
+		}
+		s.Commit()
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, 1<<20, 2*(headerSize+5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		if err := s.Append([]byte("msg-0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append([]byte("msg-2")); err != ErrFull {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+}
+
+func TestSpoolFullAfterCommitted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// the smallest maxSize of the config, a read segment and a write segment
+	segmentSize := int64(2 * (headerSize + 5))
+	s, err := Open(dir, segmentSize, 2*segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 4; i++ {
+			if err := s.Append([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+				t.Fatalf("round %d: append %d: %v", round, i, err)
+			}
+		}
+		if err := s.Append([]byte("msg-4")); err != ErrFull {
+			t.Fatalf("round %d: expected ErrFull, got %v", round, err)
+		}
+		// the committed records of the write segment are not counted after it's rotated
+		for i := 0; i < 4; i++ {
+			if _, err := s.Peek(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
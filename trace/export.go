@@ -0,0 +1,212 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the OTLP/JSON encoding of the ExportTraceServiceRequest,
+// the ids are hex strings and the 64 bits integers are decimal strings
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	// Code is 0 unset, 1 ok, 2 error
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func stringValue(key string, v string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &v}}
+}
+
+// encodeSpans encode the spans as a ExportTraceServiceRequest
+func encodeSpans(service string, spans []*Span) ([]byte, error) {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/iyidan/http-proxy-amqp/trace"}}
+	for _, s := range spans {
+		s.l.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+			TraceState:        s.ctx.State,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, attr := range s.attrs {
+			kv := otlpKeyValue{Key: attr.key}
+			switch v := attr.value.(type) {
+			case string:
+				kv.Value.StringValue = &v
+			case int64:
+				i := strconv.FormatInt(v, 10)
+				kv.Value.IntValue = &i
+			case bool:
+				kv.Value.BoolValue = &v
+			}
+			span.Attributes = append(span.Attributes, kv)
+		}
+		if len(s.err) > 0 {
+			span.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.l.Unlock()
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	return json.Marshal(&otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: []otlpKeyValue{stringValue("service.name", service)}},
+			ScopeSpans: []otlpScopeSpans{scope},
+		}},
+	})
+}
+
+// OTLPExporter posts the spans to a OTLP/HTTP collector in the JSON encoding
+type OTLPExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewOTLPExporter create a exporter posts to the traces url, such as http://127.0.0.1:4318/v1/traces
+func NewOTLPExporter(endpoint string, headers map[string]string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Export post the spans
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	data, err := encodeSpans(service, spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("trace: otlp response %d: %s", res.StatusCode, body)
+	}
+	return nil
+}
+
+// Close do nothing
+func (e *OTLPExporter) Close() error {
+	return nil
+}
+
+// WriterExporter writes the spans of a export as a line of OTLP/JSON,
+// the lines can be read offline or loaded by a collector
+type WriterExporter struct {
+	l sync.Mutex
+	w io.Writer
+	c io.Closer
+}
+
+// NewWriterExporter create a exporter writes to w
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// NewFileExporter create a exporter appends to the file, stdout writes to the stdout
+func NewFileExporter(path string) (*WriterExporter, error) {
+	if path == "stdout" {
+		return NewWriterExporter(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{w: f, c: f}, nil
+}
+
+// Export write the spans as a line
+func (e *WriterExporter) Export(service string, spans []*Span) error {
+	data, err := encodeSpans(service, spans)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	e.l.Lock()
+	defer e.l.Unlock()
+	_, err = e.w.Write(data)
+	return err
+}
+
+// Close close the file
+func (e *WriterExporter) Close() error {
+	if e.c == nil {
+		return nil
+	}
+	return e.c.Close()
+}
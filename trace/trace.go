@@ -0,0 +1,324 @@
+// Package trace records the spans of the requests with the W3C trace context,
+// the spans are exported in batches in the OTLP/JSON format.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iyidan/http-proxy-amqp/log"
+)
+
+// the propagation headers of the W3C trace context
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+)
+
+// the kinds of the spans
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+	KindProducer = 4
+)
+
+// queueSize is the max finished spans waiting for the export, the spans are dropped when it's full
+const queueSize = 4096
+
+// SpanContext is the identity of a span propagated across the processes
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Sampled is true if the span is recorded
+	Sampled bool
+	// State is the vendor specific tracestate
+	State string
+}
+
+// IsValid report whether the trace id and span id are not zero
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent return the traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parse the traceparent header value and the tracestate,
+// ok is false if the traceparent is invalid
+func ParseTraceparent(traceparent string, tracestate string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	// the later versions may append fields, ff is invalid
+	if len(parts) < 4 || len(parts[0]) != 2 || !isLowerHex(parts[0]) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if !isLowerHex(parts[1]) || !isLowerHex(parts[2]) || !isLowerHex(parts[3]) {
+		return sc, false
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	flags, _ := hex.DecodeString(parts[3])
+	sc.Sampled = flags[0]&1 == 1
+	sc.State = strings.TrimSpace(tracestate)
+	return sc, sc.IsValid()
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Span is a timed operation of a trace, the methods of a nil span do nothing,
+// so the callers need not check whether the tracing is enabled
+type Span struct {
+	tracer *Tracer
+
+	name     string
+	kind     int
+	ctx      SpanContext
+	parentID [8]byte
+	start    time.Time
+
+	l     sync.Mutex
+	end   time.Time
+	attrs []attribute
+	err   string
+	ended bool
+}
+
+// attribute is a key value of a span, the value is a string, int64 or bool
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Context return the span context, it's invalid for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttribute set a string, int or bool attribute of the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case int32:
+		value = int64(v)
+	case uint64:
+		value = int64(v)
+	case string, int64, bool:
+	default:
+		value = fmt.Sprint(v)
+	}
+	s.l.Lock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+	s.l.Unlock()
+}
+
+// SetError mark the span failed with the error, nil is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.l.Lock()
+	s.err = err.Error()
+	s.l.Unlock()
+}
+
+// End finish the span and queue it for the export, the later calls are ignored
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.l.Lock()
+	if s.ended {
+		s.l.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.l.Unlock()
+
+	if s.ctx.Sampled {
+		s.tracer.queue(s)
+	}
+}
+
+type spanKey struct{}
+
+// FromContext return the span in the context, nil if not found
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// StartSpan start a child span of the span in the context,
+// the span is nil and the context is unchanged if the context has no span
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kind, parent.ctx)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Exporter sends the finished spans to the backend
+type Exporter interface {
+	Export(service string, spans []*Span) error
+	Close() error
+}
+
+// Tracer creates the root spans and exports the finished spans in the background,
+// the methods of a nil tracer do nothing
+type Tracer struct {
+	service       string
+	exporter      Exporter
+	batchSize     int
+	flushInterval time.Duration
+
+	spans chan *Span
+	// closed is closed by Close, done is closed after the queued spans exported
+	closed chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewTracer create a tracer exports the spans at most batchSize spans a time,
+// or every flushInterval
+func NewTracer(service string, exporter Exporter, batchSize int, flushInterval time.Duration) *Tracer {
+	t := &Tracer{
+		service:       service,
+		exporter:      exporter,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		spans:         make(chan *Span, queueSize),
+		closed:        make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Start start a span of the remote parent, a new trace is started if the parent is invalid
+func (t *Tracer) Start(ctx context.Context, name string, kind int, parent SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := t.newSpan(name, kind, parent)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) newSpan(name string, kind int, parent SpanContext) *Span {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.ctx.State = parent.State
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Sampled = true
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+// queue the finished span, it's dropped if the queue is full or the tracer is closed
+func (t *Tracer) queue(s *Span) {
+	select {
+	case <-t.closed:
+		return
+	default:
+	}
+	select {
+	case t.spans <- s:
+	default:
+		log.Warn("trace: queue full, span dropped", log.Fields{"span": s.name})
+	}
+}
+
+// loop export the spans in batches until the tracer closed
+func (t *Tracer) loop() {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.service, batch); err != nil {
+			log.Warn("trace: export failed", log.Fields{"spans": len(batch), "error": err})
+		}
+		batch = make([]*Span, 0, t.batchSize)
+	}
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= t.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.closed:
+			// export the queued spans before exit
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+					if len(batch) >= t.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					t.exporter.Close()
+					close(t.done)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close export the queued spans and close the exporter
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		close(t.closed)
+		<-t.done
+	})
+}
@@ -0,0 +1,76 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(tp, "congo=t61rcWkgMzE")
+	if !ok || !sc.Sampled || sc.State != "congo=t61rcWkgMzE" {
+		t.Fatalf("parse %s: %+v %v", tp, sc, ok)
+	}
+	if sc.Traceparent() != tp {
+		t.Fatalf("expected %s, got %s", tp, sc.Traceparent())
+	}
+
+	for _, tp := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := ParseTraceparent(tp, ""); ok {
+			t.Fatalf("expected invalid: %q", tp)
+		}
+	}
+}
+
+func TestExportSpans(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer("test", NewWriterExporter(&buf), 10, time.Hour)
+
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+	ctx, server := tracer.Start(context.Background(), "POST /confirm_send", KindServer, parent)
+	_, child := StartSpan(ctx, "amqp.publish", KindProducer)
+	child.SetAttribute("messaging.destination.name", "amq.topic")
+	child.End()
+	server.End()
+	tracer.Close()
+
+	var req otlpRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatalf("decode %s: %s", buf.String(), err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "amqp.publish" || spans[0].ParentSpanID != spans[1].SpanID {
+		t.Fatalf("the publish span is not the child of the server span: %+v", spans)
+	}
+	if spans[1].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[1].ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("the server span does not continue the remote trace: %+v", spans[1])
+	}
+	if *spans[0].Attributes[0].Value.StringValue != "amq.topic" {
+		t.Fatalf("unexpected attributes: %+v", spans[0].Attributes)
+	}
+
+	// not sampled by the caller
+	buf.Reset()
+	tracer = NewTracer("test", NewWriterExporter(&buf), 10, time.Hour)
+	parent.Sampled = false
+	_, server = tracer.Start(context.Background(), "POST /confirm_send", KindServer, parent)
+	server.End()
+	tracer.Close()
+	if buf.Len() > 0 {
+		t.Fatalf("the unsampled span is exported: %s", buf.String())
+	}
+}
@@ -1,18 +1,20 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+
+	"github.com/iyidan/http-proxy-amqp/log"
 )
 
 // FailOnError log stack and fatal with given message
 func FailOnError(err error, msg string) {
 	if err != nil {
-		stack := debug.Stack()
-		log.Fatalf("%s: %s - stack:\n%s", msg, err, stack)
+		log.Fatal(msg, log.Fields{"error": err, "stack": string(debug.Stack())})
 	}
 }
 
@@ -32,3 +34,12 @@ func GetRootPath() string {
 	}
 	return p
 }
+
+// RandomID return a random hex string of n bytes
+func RandomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}